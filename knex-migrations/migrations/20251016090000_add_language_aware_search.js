@@ -0,0 +1,39 @@
+// Language-aware full-text search for the postgres search backend.
+// pages_search_vector weights the title (A) above the content (B) and stems
+// each page with the text search configuration of its language. Its index
+// replaces the English-only idx_pages_content and idx_pages_title, which no
+// query uses any more.
+exports.up = function(knex) {
+    return knex.raw(`
+      CREATE OR REPLACE FUNCTION pages_search_config(lang TEXT) RETURNS regconfig
+      LANGUAGE sql IMMUTABLE PARALLEL SAFE AS $$
+        SELECT CASE lang
+          WHEN 'da' THEN 'danish'::regconfig
+          WHEN 'en' THEN 'english'::regconfig
+          ELSE 'simple'::regconfig
+        END
+      $$;
+
+      CREATE OR REPLACE FUNCTION pages_search_vector(lang TEXT, title TEXT, content TEXT) RETURNS tsvector
+      LANGUAGE sql IMMUTABLE PARALLEL SAFE AS $$
+        SELECT setweight(to_tsvector(pages_search_config(lang), coalesce(title, '')), 'A') ||
+               setweight(to_tsvector(pages_search_config(lang), coalesce(content, '')), 'B')
+      $$;
+
+      CREATE INDEX IF NOT EXISTS idx_pages_search ON pages USING GIN (pages_search_vector(language, title, content));
+
+      DROP INDEX IF EXISTS idx_pages_content;
+      DROP INDEX IF EXISTS idx_pages_title;
+    `);
+  };
+
+  exports.down = function(knex) {
+    return knex.raw(`
+      CREATE INDEX IF NOT EXISTS idx_pages_content ON pages USING GIN (to_tsvector('english', content));
+      CREATE INDEX IF NOT EXISTS idx_pages_title ON pages USING GIN (to_tsvector('english', title));
+
+      DROP INDEX IF EXISTS idx_pages_search;
+      DROP FUNCTION IF EXISTS pages_search_vector(TEXT, TEXT, TEXT);
+      DROP FUNCTION IF EXISTS pages_search_config(TEXT);
+    `);
+  };
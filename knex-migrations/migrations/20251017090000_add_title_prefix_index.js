@@ -0,0 +1,13 @@
+// Prefix index on lower-case titles for /api/suggest on the postgres search backend.
+// text_pattern_ops lets LIKE 'prefix%' use the index whatever the database collation.
+exports.up = function(knex) {
+    return knex.raw(`
+      CREATE INDEX IF NOT EXISTS idx_pages_title_lower ON pages (lower(title) text_pattern_ops);
+    `);
+  };
+
+  exports.down = function(knex) {
+    return knex.raw(`
+      DROP INDEX IF EXISTS idx_pages_title_lower;
+    `);
+  };
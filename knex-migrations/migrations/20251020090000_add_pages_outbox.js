@@ -0,0 +1,47 @@
+// Change data capture for the pages table. Every insert, update and delete is
+// recorded in pages_outbox and announced on the pages_outbox channel, so the Go
+// consumer can apply it to the search backend however the row was changed.
+exports.up = function(knex) {
+    return knex.raw(`
+      CREATE TABLE IF NOT EXISTS pages_outbox (
+        id BIGSERIAL PRIMARY KEY,
+        operation TEXT NOT NULL CHECK(operation IN ('upsert', 'delete')),
+        url TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+      );
+
+      CREATE OR REPLACE FUNCTION pages_outbox_capture() RETURNS trigger
+      LANGUAGE plpgsql AS $$
+      BEGIN
+        IF TG_OP = 'DELETE' THEN
+          INSERT INTO pages_outbox (operation, url) VALUES ('delete', OLD.url);
+        ELSIF TG_OP = 'INSERT' THEN
+          INSERT INTO pages_outbox (operation, url) VALUES ('upsert', NEW.url);
+        ELSE
+          IF OLD IS NOT DISTINCT FROM NEW THEN
+            RETURN NULL;
+          END IF;
+          IF OLD.url IS DISTINCT FROM NEW.url THEN
+            INSERT INTO pages_outbox (operation, url) VALUES ('delete', OLD.url);
+          END IF;
+          INSERT INTO pages_outbox (operation, url) VALUES ('upsert', NEW.url);
+        END IF;
+        PERFORM pg_notify('pages_outbox', '');
+        RETURN NULL;
+      END
+      $$;
+
+      DROP TRIGGER IF EXISTS pages_outbox_capture ON pages;
+      CREATE TRIGGER pages_outbox_capture
+        AFTER INSERT OR UPDATE OR DELETE ON pages
+        FOR EACH ROW EXECUTE FUNCTION pages_outbox_capture();
+    `);
+  };
+
+  exports.down = function(knex) {
+    return knex.raw(`
+      DROP TRIGGER IF EXISTS pages_outbox_capture ON pages;
+      DROP FUNCTION IF EXISTS pages_outbox_capture();
+      DROP TABLE IF EXISTS pages_outbox;
+    `);
+  };
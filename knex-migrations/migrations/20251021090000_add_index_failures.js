@@ -0,0 +1,23 @@
+// Dead-letter queue for pages that failed to index into Elasticsearch. Each page
+// has one row, holding its last error and how many times it has failed; the
+// server retries it at next_attempt_at until it indexes or gives up.
+exports.up = function(knex) {
+    return knex.raw(`
+      CREATE TABLE IF NOT EXISTS index_failures (
+        url TEXT PRIMARY KEY,
+        error TEXT NOT NULL,
+        attempts INTEGER NOT NULL DEFAULT 1,
+        first_failed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_failed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        next_attempt_at TIMESTAMP NOT NULL
+      );
+
+      CREATE INDEX IF NOT EXISTS idx_index_failures_next_attempt_at ON index_failures (next_attempt_at);
+    `);
+  };
+
+  exports.down = function(knex) {
+    return knex.raw(`
+      DROP TABLE IF EXISTS index_failures;
+    `);
+  };
@@ -0,0 +1,23 @@
+// Recrawl state of each page: the validators of its last response, for conditional
+// requests, and how often it is recrawled. The interval shrinks when the page has
+// changed and grows when it hasn't, and the page is due again at next_crawl_at.
+exports.up = function(knex) {
+    return knex.raw(`
+      CREATE TABLE IF NOT EXISTS page_recrawls (
+        url TEXT PRIMARY KEY REFERENCES pages (url) ON DELETE CASCADE ON UPDATE CASCADE,
+        etag TEXT,
+        last_modified TEXT,
+        interval_seconds DOUBLE PRECISION NOT NULL,
+        last_crawled_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        next_crawl_at TIMESTAMP NOT NULL
+      );
+
+      CREATE INDEX IF NOT EXISTS idx_page_recrawls_next_crawl_at ON page_recrawls (next_crawl_at);
+    `);
+  };
+
+  exports.down = function(knex) {
+    return knex.raw(`
+      DROP TABLE IF EXISTS page_recrawls;
+    `);
+  };
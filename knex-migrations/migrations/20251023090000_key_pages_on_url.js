@@ -0,0 +1,34 @@
+// Keys pages on url wherever title is still the primary key, e.g. databases created
+// from an older schema.sql, so pages with the same title can be saved side by side.
+// The unique constraint on url becomes redundant; foreign keys that relied on it are
+// recreated against the primary key.
+exports.up = function(knex) {
+    return knex.raw(`
+      DO $$
+      BEGIN
+        IF NOT EXISTS (
+          SELECT 1 FROM pg_index i
+          JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY (i.indkey)
+          WHERE i.indrelid = 'pages'::regclass AND i.indisprimary AND a.attname = 'url'
+        ) THEN
+          ALTER TABLE pages DROP CONSTRAINT IF EXISTS pages_pkey;
+          ALTER TABLE pages ADD CONSTRAINT pages_pkey PRIMARY KEY (url);
+          ALTER TABLE pages DROP CONSTRAINT IF EXISTS pages_url_key CASCADE;
+          ALTER TABLE pages DROP CONSTRAINT IF EXISTS pages_url_unique CASCADE;
+          IF to_regclass('page_recrawls') IS NOT NULL AND NOT EXISTS (
+            SELECT 1 FROM pg_constraint WHERE conname = 'page_recrawls_url_fkey'
+          ) THEN
+            ALTER TABLE page_recrawls ADD CONSTRAINT page_recrawls_url_fkey
+              FOREIGN KEY (url) REFERENCES pages (url) ON DELETE CASCADE ON UPDATE CASCADE;
+          END IF;
+        END IF;
+      END
+      $$;
+    `);
+  };
+
+  // Going back to keying pages on title is left to 20250506_change_pages_primary_key,
+  // as duplicate titles may have been saved since.
+  exports.down = function(knex) {
+    return Promise.resolve();
+  };
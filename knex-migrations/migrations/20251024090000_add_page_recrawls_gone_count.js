@@ -0,0 +1,14 @@
+// How many recrawls in a row have found a page gone (404 or 410). The page is only
+// deleted once this reaches the recrawler's limit, and any response showing the page
+// exists resets it.
+exports.up = function(knex) {
+    return knex.raw(`
+      ALTER TABLE page_recrawls ADD COLUMN IF NOT EXISTS gone_count INTEGER NOT NULL DEFAULT 0;
+    `);
+  };
+
+  exports.down = function(knex) {
+    return knex.raw(`
+      ALTER TABLE page_recrawls DROP COLUMN IF EXISTS gone_count;
+    `);
+  };
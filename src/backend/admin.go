@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// requireAdmin only lets the admin user, named by ADMIN_USER, through to next.
+// Everyone else gets a JSON error: 401 when not logged in, 403 otherwise.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := store.Get(r, "session-name")
+		userID, ok := session.Values["user_id"]
+		if err != nil || !ok || userID == nil {
+			writeJSONError(w, http.StatusUnauthorized, "log in as the admin user")
+			return
+		}
+
+		var username string
+		if err := db.QueryRowContext(r.Context(), "SELECT username FROM users WHERE id = $1", userID).Scan(&username); err != nil {
+			log.Printf("Error looking up user %v: %v", userID, err)
+			writeJSONError(w, http.StatusForbidden, "only the admin user may do this")
+			return
+		}
+		if username != adminUsername {
+			writeJSONError(w, http.StatusForbidden, "only the admin user may do this")
+			return
+		}
+		next(w, r)
+	}
+}
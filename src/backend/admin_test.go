@@ -0,0 +1,60 @@
+// Unit tests for the admin-only middleware
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// loggedInRequest returns a request from a session logged in as userID.
+func loggedInRequest(method, target string, userID int) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	w := httptest.NewRecorder()
+	session, _ := store.Get(req, "session-name")
+	session.Values["user_id"] = userID
+	_ = session.Save(req, w)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestRequireAdmin(t *testing.T) {
+	previousStore := store
+	store = sessions.NewCookieStore([]byte("test-secret"))
+	t.Cleanup(func() { store = previousStore })
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	handler := requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		username string
+		expected int
+	}{
+		{name: "not logged in", req: httptest.NewRequest(http.MethodGet, "/api/admin/reconcile", nil), expected: http.StatusUnauthorized},
+		{name: "other user", req: loggedInRequest(http.MethodGet, "/api/admin/reconcile", 2), username: "alice", expected: http.StatusForbidden},
+		{name: "admin", req: loggedInRequest(http.MethodGet, "/api/admin/reconcile", 1), username: adminUsername, expected: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.username != "" {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT username FROM users WHERE id = $1")).
+					WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow(tt.username))
+			}
+			w := httptest.NewRecorder()
+			handler(w, tt.req)
+			assert.Equal(t, tt.expected, w.Code)
+		})
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
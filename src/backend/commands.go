@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// commands are the maintenance commands the server binary runs instead of serving
+// when one is named on the command line, e.g. `gosearch reindex`. The database is
+// connected before a command runs.
+var commands = map[string]struct {
+	help string
+	run  func(ctx context.Context, args []string) error
+}{
+	"reindex": {
+		help: "build a new version of the Elasticsearch pages index and switch searches to it",
+		run: func(ctx context.Context, args []string) error {
+			if err := initElasticsearch(); err != nil {
+				return err
+			}
+			return reindexElasticsearch(ctx, nil)
+		},
+	},
+	"crawl": {
+		help: "crawl from the given URLs, or from CRAWLER_SEEDS if none are given",
+		run: func(ctx context.Context, args []string) error {
+			seeds := args
+			if len(seeds) == 0 {
+				seeds = crawlerSeeds
+			}
+			if len(seeds) == 0 {
+				return fmt.Errorf("no URLs to crawl, give some or set CRAWLER_SEEDS")
+			}
+			stats, err := newCrawler().crawl(ctx, seeds)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Fetched %d pages: %d saved, %d skipped, %d failed.\n", stats.Fetched, stats.Saved, stats.Skipped, stats.Failed)
+			return nil
+		},
+	},
+	"sitemap": {
+		help: "fetch the new and changed pages listed in the given sitemaps, or in SITEMAP_URLS if none are given",
+		run: func(ctx context.Context, args []string) error {
+			sitemaps := args
+			if len(sitemaps) == 0 {
+				sitemaps = sitemapURLs
+			}
+			if len(sitemaps) == 0 {
+				return fmt.Errorf("no sitemaps to ingest, give some or set SITEMAP_URLS")
+			}
+			stats, err := newCrawler().ingestSitemaps(ctx, sitemaps)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Sitemaps list %d pages, %d unchanged. Fetched %d pages: %d saved, %d skipped, %d failed.\n",
+				stats.URLs, stats.Unchanged, stats.Fetched, stats.Saved, stats.Skipped, stats.Failed)
+			return nil
+		},
+	},
+	"recrawl": {
+		help: "recrawl the given number of pages that are due, or RECRAWL_BATCH_SIZE",
+		run: func(ctx context.Context, args []string) error {
+			limit := recrawlBatchSize
+			if len(args) > 0 {
+				parsed, err := strconv.Atoi(args[0])
+				if err != nil || parsed <= 0 {
+					return fmt.Errorf("the number of pages must be a positive number, not %q", args[0])
+				}
+				limit = parsed
+			}
+			stats, err := recrawlStalePages(ctx, limit)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Recrawled %d pages: %d changed, %d unchanged, %d missing, %d gone, %d failed.\n",
+				stats.Changed+stats.Unchanged+stats.Missing+stats.Gone+stats.Failed, stats.Changed, stats.Unchanged, stats.Missing, stats.Gone, stats.Failed)
+			return nil
+		},
+	},
+	"index-failures": {
+		help: "list the pages that failed to index into Elasticsearch",
+		run: func(ctx context.Context, args []string) error {
+			failures, err := listIndexFailures(ctx)
+			if err != nil {
+				return err
+			}
+			return printIndexFailures(os.Stdout, failures)
+		},
+	},
+	"replay-failures": {
+		help: "index the given failed pages again, or every failed page if none are given",
+		run: func(ctx context.Context, args []string) error {
+			if err := initElasticsearch(); err != nil {
+				return err
+			}
+			var replay IndexFailureReplay
+			var err error
+			if len(args) > 0 {
+				replay, err = replayIndexFailures(ctx, args)
+			} else {
+				replay, err = replayAllIndexFailures(ctx)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Indexed %d pages, %d failed again and %d no longer exist.\n", replay.Indexed, replay.Failed, replay.Removed)
+			if replay.Failed > 0 {
+				return fmt.Errorf("%d pages failed to index", replay.Failed)
+			}
+			return nil
+		},
+	},
+	"rollback": {
+		help: "switch searches back to the previous version of the Elasticsearch pages index",
+		run: func(ctx context.Context, args []string) error {
+			if err := initElasticsearch(); err != nil {
+				return err
+			}
+			return rollbackElasticsearchIndex(ctx)
+		},
+	},
+}
+
+// runCommand runs the command named by args[0] with the rest of args.
+func runCommand(args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, expected one of:\n%s", args[0], commandUsage())
+	}
+	return command.run(context.Background(), args[1:])
+}
+
+// commandUsage lists the commands with their help, one per line.
+func commandUsage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var usage strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&usage, "  %-16s %s\n", name, commands[name].help)
+	}
+	return usage.String()
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/gorilla/sessions"
@@ -23,6 +26,46 @@ var db *sql.DB
 
 var esClient *elasticsearch.Client
 
+var searchBackendName string
+
+var searchFallbackBackendName string
+
+var searchIndexPath string
+
+var searchCacheName string
+
+var searchCacheTTL time.Duration
+
+var searchCacheSize int
+
+var searchCacheRedisAddr string
+
+var searchCacheRedisPassword string
+
+var esSyncBatchSize int
+
+var esSyncWorkers int
+
+var adminUsername string
+
+var esReconcileRepair bool
+
+var crawlerSeeds []string
+
+var crawlerAllowedDomains []string
+
+var crawlerMaxDepth int
+
+var crawlerMaxPages int
+
+var sitemapURLs []string
+
+var recrawlBatchSize int
+
+var scraperUserAgent string
+
+var scraperHostDelay time.Duration
+
 var store *sessions.CookieStore
 
 func init() {
@@ -65,6 +108,149 @@ func init() {
 		staticPath = "../frontend/static/"
 	}
 
+	// elasticsearch (default), postgres, sqlite or embedded - see newSearchBackend.
+	searchBackendName = strings.ToLower(strings.TrimSpace(os.Getenv("SEARCH_BACKEND")))
+	if searchBackendName == "" {
+		searchBackendName = elasticsearchBackendName
+	}
+
+	// Backend used when searching the main backend fails; "none" turns the fallback off.
+	searchFallbackBackendName = strings.ToLower(strings.TrimSpace(os.Getenv("SEARCH_FALLBACK_BACKEND")))
+	if searchFallbackBackendName == "" && searchBackendName == elasticsearchBackendName {
+		searchFallbackBackendName = postgresBackendName
+	}
+
+	// File the embedded search backend saves its index to.
+	searchIndexPath = os.Getenv("SEARCH_INDEX_PATH")
+	if searchIndexPath == "" {
+		searchIndexPath = "search_index.gob"
+	}
+
+	// memory (default), redis or none - see newSearchCache.
+	searchCacheName = strings.ToLower(strings.TrimSpace(os.Getenv("SEARCH_CACHE")))
+
+	searchCacheTTL = time.Minute
+	if ttl := os.Getenv("SEARCH_CACHE_TTL"); ttl != "" {
+		parsed, err := time.ParseDuration(ttl)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("SEARCH_CACHE_TTL must be a positive duration like 30s, not %q", ttl)
+		}
+		searchCacheTTL = parsed
+	}
+
+	searchCacheSize = 1000
+	if size := os.Getenv("SEARCH_CACHE_SIZE"); size != "" {
+		parsed, err := strconv.Atoi(size)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("SEARCH_CACHE_SIZE must be a positive number, not %q", size)
+		}
+		searchCacheSize = parsed
+	}
+
+	searchCacheRedisAddr = os.Getenv("SEARCH_CACHE_REDIS_ADDR")
+	if searchCacheRedisAddr == "" {
+		searchCacheRedisAddr = "localhost:6379"
+	}
+	searchCacheRedisPassword = os.Getenv("SEARCH_CACHE_REDIS_PASSWORD")
+
+	// Pages per bulk request, and bulk requests in flight, when syncing Elasticsearch.
+	esSyncBatchSize = 500
+	if size := os.Getenv("ES_SYNC_BATCH_SIZE"); size != "" {
+		parsed, err := strconv.Atoi(size)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("ES_SYNC_BATCH_SIZE must be a positive number, not %q", size)
+		}
+		esSyncBatchSize = parsed
+	}
+
+	esSyncWorkers = 2
+	if workers := os.Getenv("ES_SYNC_WORKERS"); workers != "" {
+		parsed, err := strconv.Atoi(workers)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("ES_SYNC_WORKERS must be a positive number, not %q", workers)
+		}
+		esSyncWorkers = parsed
+	}
+
+	// The user allowed to use the /api/admin endpoints, the same one the migrations create.
+	adminUsername = os.Getenv("ADMIN_USER")
+	if adminUsername == "" {
+		adminUsername = "admin"
+	}
+
+	// Whether the scheduled reconciliation repairs the drift it finds, see reconcileElasticsearch.
+	esReconcileRepair = os.Getenv("ES_RECONCILE_REPAIR") == "1"
+
+	// URLs the crawler starts from, and the domains it may follow links to (by
+	// default those of the seeds), see crawler.
+	crawlerSeeds = commaSeparated(os.Getenv("CRAWLER_SEEDS"))
+	for _, seed := range crawlerSeeds {
+		if _, err := canonicalizeURL(seed); err != nil {
+			log.Fatalf("CRAWLER_SEEDS must be http or https URLs: %v", err)
+		}
+	}
+	crawlerAllowedDomains = commaSeparated(os.Getenv("CRAWLER_ALLOWED_DOMAINS"))
+
+	crawlerMaxDepth = 2
+	if depth := os.Getenv("CRAWLER_MAX_DEPTH"); depth != "" {
+		parsed, err := strconv.Atoi(depth)
+		if err != nil || parsed < 0 {
+			log.Fatalf("CRAWLER_MAX_DEPTH must be zero or a positive number, not %q", depth)
+		}
+		crawlerMaxDepth = parsed
+	}
+
+	crawlerMaxPages = 100
+	if pages := os.Getenv("CRAWLER_MAX_PAGES"); pages != "" {
+		parsed, err := strconv.Atoi(pages)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("CRAWLER_MAX_PAGES must be a positive number, not %q", pages)
+		}
+		crawlerMaxPages = parsed
+	}
+
+	// Sitemaps listing pages for the crawler to fetch, see ingestSitemaps.
+	sitemapURLs = commaSeparated(os.Getenv("SITEMAP_URLS"))
+	for _, sitemap := range sitemapURLs {
+		if _, err := canonicalizeURL(sitemap); err != nil {
+			log.Fatalf("SITEMAP_URLS must be http or https URLs: %v", err)
+		}
+	}
+
+	// How many stale pages each recrawl run fetches, 0 to not recrawl, see recrawlStalePages.
+	recrawlBatchSize = 50
+	if size := os.Getenv("RECRAWL_BATCH_SIZE"); size != "" {
+		parsed, err := strconv.Atoi(size)
+		if err != nil || parsed < 0 {
+			log.Fatalf("RECRAWL_BATCH_SIZE must be zero or a positive number, not %q", size)
+		}
+		recrawlBatchSize = parsed
+	}
+
+	// How pages of each site are extracted, see site_profiles.yaml.
+	profiles, err := loadSiteProfiles(os.Getenv("SITE_PROFILES"))
+	if err != nil {
+		log.Fatalf("Invalid site profiles: %v", err)
+	}
+	siteProfiles = profiles
+
+	// How the scraper and the crawler identify themselves, and the least time
+	// between two of their requests to a host, see politeness.
+	scraperUserAgent = os.Getenv("SCRAPER_USER_AGENT")
+	if scraperUserAgent == "" {
+		scraperUserAgent = "GoSearchBot/1.0"
+	}
+
+	scraperHostDelay = time.Second
+	if delay := os.Getenv("SCRAPER_HOST_DELAY"); delay != "" {
+		parsed, err := time.ParseDuration(delay)
+		if err != nil || parsed < 0 {
+			log.Fatalf("SCRAPER_HOST_DELAY must be a duration like 500ms, not %q", delay)
+		}
+		scraperHostDelay = parsed
+	}
+	scraperPoliteness = newPoliteness(scraperUserAgent, scraperHostDelay)
+
 	sessionSecret := os.Getenv("SESSION_SECRET")
 	if sessionSecret == "" || sessionSecret == "Very-secret-key" {
 		log.Fatal("SESSION_SECRET is not set or insecure. Please set a strong SESSION_SECRET in your environment.")
@@ -73,3 +259,14 @@ func init() {
 	store = sessions.NewCookieStore([]byte(sessionSecret))
 
 }
+
+// commaSeparated splits a comma-separated setting into its non-empty values.
+func commaSeparated(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly"
+)
+
+// The crawler indexes sites beyond Wikipedia. Starting from the seed URLs it
+// follows links breadth first, staying on the allowed domains, until it has gone
+// maxDepth links deep or fetched maxPages pages. URLs are canonicalized before
+// they are compared, so each page is fetched and saved once per crawl.
+
+// crawlerRequestTimeout bounds each page fetch.
+const crawlerRequestTimeout = 15 * time.Second
+
+// trackingParams are query parameters removed by canonicalizeURL, as they don't
+// change the page.
+var trackingParams = []string{"fbclid", "gclid", "msclkid"}
+
+// errCrawlRunning is returned by crawlSeeds while another crawl from the seeds is going.
+var errCrawlRunning = errors.New("a crawl is already running")
+
+// crawlMu makes crawls from the seeds take turns, as one may outlast the cron interval.
+var crawlMu sync.Mutex
+
+// crawler crawls the web from seed URLs, see newCrawler.
+type crawler struct {
+	allowedDomains []string
+	maxDepth       int
+	maxPages       int
+	// save stores a crawled page in the given language.
+	save func(page Page, lang string) error
+}
+
+// newCrawler returns a crawler configured by the CRAWLER_* settings, saving pages
+// with savePageToDBWithLang.
+func newCrawler() *crawler {
+	return &crawler{
+		allowedDomains: crawlerAllowedDomains,
+		maxDepth:       crawlerMaxDepth,
+		maxPages:       crawlerMaxPages,
+		save:           savePageToDBWithLang,
+	}
+}
+
+// CrawlStats counts what a crawl did.
+type CrawlStats struct {
+	// Fetched counts the pages requested, including those that failed.
+	Fetched int
+	Saved   int
+	Failed  int
+	// Skipped counts the fetched pages that weren't saved because they had no
+	// text or were duplicates of a page saved under their canonical URL.
+	Skipped int
+}
+
+// crawledPage is a fetched page and the links found on it.
+type crawledPage struct {
+	Page
+	// Canonical is the URL the page names as its canonical one, if any.
+	Canonical string
+	Links     []string
+	// StatusCode, ETag and LastModified are those of the response, for
+	// conditional requests the next time the page is fetched.
+	StatusCode   int
+	ETag         string
+	LastModified string
+}
+
+type crawlTarget struct {
+	url   string
+	depth int
+}
+
+// crawl crawls from seeds until the budgets are spent, there are no more links to
+// follow or ctx is done. Seeds outside the allowed domains are skipped; if no
+// domains are allowed, the domains of the seeds are.
+func (c *crawler) crawl(ctx context.Context, seeds []string) (CrawlStats, error) {
+	var stats CrawlStats
+	allowed := c.allowedDomains
+	if len(allowed) == 0 {
+		for _, seed := range seeds {
+			if u, err := url.Parse(seed); err == nil && u.Hostname() != "" {
+				allowed = append(allowed, strings.ToLower(u.Hostname()))
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var queue []crawlTarget
+	enqueue := func(raw string, depth int) {
+		canonical, err := canonicalizeURL(raw)
+		if err != nil || seen[canonical] || !domainAllowed(canonical, allowed) {
+			return
+		}
+		seen[canonical] = true
+		queue = append(queue, crawlTarget{url: canonical, depth: depth})
+	}
+	for _, seed := range seeds {
+		enqueue(seed, 0)
+	}
+
+	saved := make(map[string]bool)
+	for len(queue) > 0 && stats.Fetched < c.maxPages {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		target := queue[0]
+		queue = queue[1:]
+
+		stats.Fetched++
+		page, err := fetchCrawledPage(target.url)
+		if err != nil {
+			log.Printf("Error crawling %s: %v", target.url, err)
+			stats.Failed++
+			crawlerPagesTotal.WithLabelValues("failed").Inc()
+			continue
+		}
+
+		// A page redirected off the allowed domains is neither saved nor followed.
+		if page.URL != target.url {
+			if !domainAllowed(page.URL, allowed) {
+				stats.Skipped++
+				crawlerPagesTotal.WithLabelValues("skipped").Inc()
+				continue
+			}
+			seen[page.URL] = true
+		}
+
+		if target.depth < c.maxDepth {
+			for _, link := range page.Links {
+				enqueue(link, target.depth+1)
+			}
+		}
+
+		// A page naming another allowed URL as canonical is saved under that URL,
+		// so the variants of a page end up as one.
+		if page.Canonical != "" && domainAllowed(page.Canonical, allowed) {
+			page.URL = page.Canonical
+			seen[page.Canonical] = true
+		}
+		if page.Title == "" || page.Content == "" || saved[page.URL] {
+			stats.Skipped++
+			crawlerPagesTotal.WithLabelValues("skipped").Inc()
+			continue
+		}
+		if err := c.save(page.Page, page.Language); err != nil {
+			log.Printf("Error saving crawled page %s: %v", page.URL, err)
+			stats.Failed++
+			crawlerPagesTotal.WithLabelValues("failed").Inc()
+			continue
+		}
+		saved[page.URL] = true
+		stats.Saved++
+		crawlerPagesTotal.WithLabelValues("saved").Inc()
+	}
+
+	log.Printf("Crawled %d pages: %d saved, %d skipped, %d failed, %d links left",
+		stats.Fetched, stats.Saved, stats.Skipped, stats.Failed, len(queue))
+	return stats, nil
+}
+
+// fetchCrawledPage fetches a page and extracts its links, and its title, text and
+// language as the site profile matching it says, see siteProfileFor. Pages that
+// aren't HTML come back without a title or content. Requests are subject to
+// scraperPoliteness.
+func fetchCrawledPage(pageURL string) (crawledPage, error) {
+	return fetchPage(pageURL, nil)
+}
+
+// fetchPage fetches a page like fetchCrawledPage, adding header to the request.
+// A 304 Not Modified answer to a conditional request comes back as a page with
+// that StatusCode and nothing extracted; other unsuccessful responses are errors,
+// with the page holding their StatusCode.
+func fetchPage(pageURL string, header http.Header) (crawledPage, error) {
+	collector := newPoliteCollector(crawlerRequestTimeout, colly.ParseHTTPErrorResponse())
+
+	page := crawledPage{Page: Page{URL: pageURL, Language: "en"}}
+	collector.OnResponse(func(r *colly.Response) {
+		page.StatusCode = r.StatusCode
+		page.ETag = r.Headers.Get("ETag")
+		page.LastModified = r.Headers.Get("Last-Modified")
+		// Redirects are saved under the URL they end at.
+		if final, err := canonicalizeURL(r.Request.URL.String()); err == nil {
+			page.URL = final
+		}
+	})
+	collector.OnHTML("html", func(e *colly.HTMLElement) {
+		if e.Response.StatusCode >= http.StatusMultipleChoices {
+			return
+		}
+		if canonical := e.ChildAttr(`link[rel="canonical"]`, "href"); canonical != "" {
+			if resolved, err := canonicalizeURL(e.Request.AbsoluteURL(canonical)); err == nil {
+				page.Canonical = resolved
+			}
+		}
+		// Links are collected before the profile strips elements they may be in.
+		e.ForEach("a[href]", func(_ int, a *colly.HTMLElement) {
+			if strings.Contains(strings.ToLower(a.Attr("rel")), "nofollow") {
+				return
+			}
+			if link := a.Request.AbsoluteURL(a.Attr("href")); link != "" {
+				page.Links = append(page.Links, link)
+			}
+		})
+
+		profile := siteProfileFor(e.Request.URL.String())
+		if profile == nil {
+			profile = genericSiteProfile
+		}
+		page.Title, page.Content, page.Language = profile.extract(e)
+	})
+
+	// Without a header colly sets the User-Agent itself.
+	if header != nil {
+		header = header.Clone()
+		header.Set("User-Agent", collector.UserAgent)
+	}
+	if err := collector.Request(http.MethodGet, pageURL, nil, nil, header); err != nil {
+		return page, err
+	}
+	if page.StatusCode >= http.StatusMultipleChoices && page.StatusCode != http.StatusNotModified {
+		return page, fmt.Errorf("fetching %s: %d %s", pageURL, page.StatusCode, http.StatusText(page.StatusCode))
+	}
+	return page, nil
+}
+
+// pageLanguage maps the lang attribute of a page to one of the languages of the
+// pages table, en unless it is Danish.
+func pageLanguage(lang string) string {
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(lang)), "da") {
+		return "da"
+	}
+	return "en"
+}
+
+// canonicalizeURL returns the form of an absolute http(s) URL that crawls compare
+// and save: scheme and host in lower case without the default port, dot segments
+// resolved, an empty path as /, no fragment or user info, and the query sorted by
+// key without tracking parameters.
+func canonicalizeURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%q is not an http or https URL", raw)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("%q has no host", raw)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" && !(u.Scheme == "http" && port == "80") && !(u.Scheme == "https" && port == "443") {
+		host += ":" + port
+	}
+	u.Host = host
+	u.User = nil
+	u.Fragment = ""
+	u.RawFragment = ""
+	// Resolving against the URL itself removes . and .. segments.
+	u = u.ResolveReference(&url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery})
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	query := u.Query()
+	for key := range query {
+		if strings.HasPrefix(strings.ToLower(key), "utm_") || containsFold(trackingParams, key) {
+			query.Del(key)
+		}
+	}
+	u.RawQuery = query.Encode()
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainAllowed reports whether the host of a URL is one of domains or a
+// subdomain of one.
+func domainAllowed(rawURL string, domains []string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// crawlSeeds crawls from the seed URLs configured in CRAWLER_SEEDS.
+func crawlSeeds(ctx context.Context) (CrawlStats, error) {
+	if !crawlMu.TryLock() {
+		return CrawlStats{}, errCrawlRunning
+	}
+	defer crawlMu.Unlock()
+	return newCrawler().crawl(ctx, crawlerSeeds)
+}
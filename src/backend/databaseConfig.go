@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -128,37 +129,77 @@ func startCronScheduler() {
 		if logPath == "" {
 			logPath = "search.log"
 		}
-		// Track the number of pages before scraping
-		var countBefore int
-		err := db.QueryRow("SELECT COUNT(*) FROM pages").Scan(&countBefore)
-		if err != nil {
-			log.Printf("Error getting page count before scraping: %v", err)
-		}
-
 		// Run scraping
 		StartScraping(logPath)
 
-		// Check if new pages were added
-		var countAfter int
-		err = db.QueryRow("SELECT COUNT(*) FROM pages").Scan(&countAfter)
-		if err != nil {
-			log.Printf("Error getting page count after scraping: %v", err)
+		// Push the pages scraped (or changed otherwise) since the last sync to Elasticsearch.
+		if esClient == nil {
+			log.Println("Elasticsearch is not in use. Skipping Elasticsearch sync.")
+		} else if err := syncPagesToElasticsearch(); err != nil {
+			log.Printf("Error syncing to Elasticsearch: %v", err)
 		}
+	}); err != nil {
+		log.Fatalf("Error scheduling Wikipedia scraper cron job: %v", err)
+	}
 
-		// Only sync to Elasticsearch if new pages were added
-		if countAfter > countBefore {
-			log.Printf("New pages added (%d -> %d). Syncing to Elasticsearch.", countBefore, countAfter)
-			err := syncPagesToElasticsearch()
-			if err != nil {
-				log.Printf("Error syncing to Elasticsearch: %v", err)
-			} else {
-				log.Println("Synced scraped pages to Elasticsearch successfully.")
-			}
-		} else {
-			log.Println("No new pages added. Skipping Elasticsearch sync.")
+	// Crawl the sites in CRAWLER_SEEDS every hour, see crawler.
+	if _, err := c.AddFunc("15 * * * *", func() {
+		if len(crawlerSeeds) == 0 {
+			return
+		}
+		if _, err := crawlSeeds(context.Background()); err != nil {
+			log.Printf("Error crawling: %v", err)
 		}
 	}); err != nil {
-		log.Fatalf("Error scheduling Wikipedia scraper cron job: %v", err)
+		log.Fatalf("Error scheduling crawler cron job: %v", err)
+	}
+
+	// Fetch the new and changed pages listed in SITEMAP_URLS every hour, see ingestSitemaps.
+	if _, err := c.AddFunc("45 * * * *", func() {
+		if len(sitemapURLs) == 0 {
+			return
+		}
+		if _, err := ingestConfiguredSitemaps(context.Background()); err != nil {
+			log.Printf("Error ingesting sitemaps: %v", err)
+		}
+	}); err != nil {
+		log.Fatalf("Error scheduling sitemap cron job: %v", err)
+	}
+
+	// Recrawl the pages that are due every ten minutes, see recrawlStalePages.
+	if _, err := c.AddFunc("*/10 * * * *", func() {
+		if recrawlBatchSize == 0 {
+			return
+		}
+		if _, err := recrawlStalePages(context.Background(), recrawlBatchSize); err != nil {
+			log.Printf("Error recrawling pages: %v", err)
+		}
+	}); err != nil {
+		log.Fatalf("Error scheduling recrawl cron job: %v", err)
+	}
+
+	// Retry the pages that failed to index once their backoff is over, see retryIndexFailures.
+	if _, err := c.AddFunc("* * * * *", func() {
+		if esClient == nil {
+			return
+		}
+		if _, err := retryIndexFailures(context.Background()); err != nil {
+			log.Printf("Error retrying index failures: %v", err)
+		}
+	}); err != nil {
+		log.Fatalf("Error scheduling index failure retry cron job: %v", err)
+	}
+
+	// Compare the Elasticsearch index with the pages table every hour, see reconcileElasticsearch.
+	if _, err := c.AddFunc("30 * * * *", func() {
+		if esClient == nil {
+			return
+		}
+		if _, err := reconcileElasticsearch(context.Background(), esReconcileRepair); err != nil {
+			log.Printf("Error reconciling Elasticsearch: %v", err)
+		}
+	}); err != nil {
+		log.Fatalf("Error scheduling reconciliation cron job: %v", err)
 	}
 
 	c.Start()
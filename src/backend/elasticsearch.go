@@ -7,13 +7,15 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
 )
 
-func initElasticsearch() {
+// initElasticsearch connects esClient to Elasticsearch, retrying for a while. If
+// it can't connect, esClient is left pointing at the plain HTTP address, so requests
+// succeed once Elasticsearch is up, and an error is returned.
+func initElasticsearch() error {
 	var err error
 	maxRetries := 10
 	retryDelay := time.Second * 5
@@ -68,55 +70,12 @@ func initElasticsearch() {
 			defer func() { _ = res.Body.Close() }()
 			log.Printf("Successfully connected to Elasticsearch via %s", config.Addresses[0])
 
-			// Check if 'pages' index exists
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				existsRes, err := esClient.Indices.Exists(
-					[]string{"pages"},
-					esClient.Indices.Exists.WithContext(ctx),
-				)
-				cancel()
-
-				if err != nil {
-					log.Printf("Error checking if index exists: %v", err)
-				} else {
-					if existsRes.StatusCode == 404 {
-						log.Println("Creating 'pages' index with proper mappings")
-
-						// Define index mappings with correct field types
-						mappings := `{
-                            "mappings": {
-                                "properties": {
-                                    "title": { "type": "text" },
-                                    "url": { "type": "keyword" },
-                                    "content": { "type": "text" },
-                                    "language": { "type": "keyword" },
-                                    "last_updated": { "type": "date" }
-                                }
-                            }
-                        }`
-
-						ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-						createRes, err := esClient.Indices.Create(
-							"pages",
-							esClient.Indices.Create.WithBody(strings.NewReader(mappings)),
-							esClient.Indices.Create.WithContext(ctx),
-						)
-						cancel()
-
-						if err != nil {
-							log.Printf("Error creating index: %v", err)
-						} else if createRes.IsError() {
-							log.Printf("Error response when creating index: %s", createRes.String())
-						} else {
-							log.Println("Created 'pages' index successfully")
-						}
-					} else {
-						log.Println("'pages' index already exists")
-					}
-				}
-
-				return
+			// Create the pages index, or the alias of its first version, if it doesn't exist yet.
+			if err := ensurePagesIndex(context.Background(), esPagesIndex); err != nil {
+				log.Printf("Error setting up %q index: %v", esPagesIndex, err)
 			}
+			return nil
+		}
 
 			log.Printf("Error connecting to Elasticsearch via %s: %v", config.Addresses[0], err)
 		}
@@ -126,5 +85,14 @@ func initElasticsearch() {
 		time.Sleep(retryDelay)
 	}
 
-	log.Fatalf("Failed to connect to Elasticsearch after %d attempts", maxRetries)
+	esClient, err = elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{fmt.Sprintf("http://%s:9200", esHost)},
+		Username:  esUsername,
+		Password:  esPassword,
+	})
+	if err != nil {
+		esClient = nil
+		return fmt.Errorf("error creating Elasticsearch client: %w", err)
+	}
+	return fmt.Errorf("failed to connect to Elasticsearch after %d attempts", maxRetries)
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// esBulkMaxAttempts is how many times a page rejected with 429 Too Many Requests
+	// is sent before it counts as failed.
+	esBulkMaxAttempts = 5
+	// esBulkInitialBackoff is the wait before the first retry of rejected pages. It
+	// doubles with every further retry.
+	esBulkInitialBackoff = 500 * time.Millisecond
+)
+
+// esBulkIndexer indexes pages with the Elasticsearch bulk API, sending batches of
+// batchSize pages from up to workers goroutines. Documents are not refreshed, so
+// callers refresh the index once they are done.
+type esBulkIndexer struct {
+	index     string
+	batchSize int
+	workers   int
+	backoff   time.Duration
+}
+
+func newESBulkIndexer(index string) *esBulkIndexer {
+	return &esBulkIndexer{index: index, batchSize: esSyncBatchSize, workers: esSyncWorkers, backoff: esBulkInitialBackoff}
+}
+
+// esBulkResult is the outcome of indexing one page.
+type esBulkResult struct {
+	page Page
+	err  error
+}
+
+// indexPages indexes the pages read from pages until it is closed, and calls done
+// with the outcome of each page. done is never called concurrently.
+func (bi *esBulkIndexer) indexPages(ctx context.Context, pages <-chan Page, done func(esBulkResult)) {
+	batches := make(chan []Page)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < bi.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				results := bi.indexBatch(ctx, batch)
+				mu.Lock()
+				for _, result := range results {
+					done(result)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	batch := make([]Page, 0, bi.batchSize)
+	for page := range pages {
+		batch = append(batch, page)
+		if len(batch) == bi.batchSize {
+			batches <- batch
+			batch = make([]Page, 0, bi.batchSize)
+		}
+	}
+	if len(batch) > 0 {
+		batches <- batch
+	}
+	close(batches)
+	wg.Wait()
+}
+
+// indexBatch indexes a batch of pages, retrying the pages Elasticsearch rejects
+// because it is overloaded with exponential backoff.
+func (bi *esBulkIndexer) indexBatch(ctx context.Context, batch []Page) []esBulkResult {
+	start := time.Now()
+	results := make([]esBulkResult, 0, len(batch))
+	pending := batch
+	backoff := bi.backoff
+retries:
+	for attempt := 1; len(pending) > 0; attempt++ {
+		rejected, failed := bi.bulk(ctx, pending)
+		for _, page := range pending {
+			if _, ok := rejected[page.URL]; ok {
+				continue
+			}
+			results = append(results, esBulkResult{page: page, err: failed[page.URL]})
+		}
+
+		retry := make([]Page, 0, len(rejected))
+		for _, page := range pending {
+			if _, ok := rejected[page.URL]; ok {
+				retry = append(retry, page)
+			}
+		}
+		pending = retry
+		if len(pending) == 0 {
+			break
+		}
+
+		if attempt == esBulkMaxAttempts {
+			for _, page := range pending {
+				results = append(results, esBulkResult{page: page, err: fmt.Errorf("%w (gave up after %d attempts)", rejected[page.URL], attempt)})
+			}
+			break
+		}
+		esBulkRetriesTotal.Add(float64(len(pending)))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			for _, page := range pending {
+				results = append(results, esBulkResult{page: page, err: ctx.Err()})
+			}
+			break retries
+		}
+		backoff *= 2
+	}
+
+	var indexed, failed int
+	for _, result := range results {
+		if result.err == nil {
+			indexed++
+		} else {
+			failed++
+		}
+	}
+	esBulkBatchDocuments.WithLabelValues("indexed").Observe(float64(indexed))
+	esBulkBatchDocuments.WithLabelValues("failed").Observe(float64(failed))
+	esBulkBatchDuration.Observe(time.Since(start).Seconds())
+	return results
+}
+
+// esBulkResponse is the response of the bulk API. Each item is keyed by its action.
+type esBulkResponse struct {
+	Errors bool                      `json:"errors"`
+	Items  []map[string]esBulkStatus `json:"items"`
+}
+
+type esBulkStatus struct {
+	ID     string       `json:"_id"`
+	Status int          `json:"status"`
+	Error  *esBulkError `json:"error,omitempty"`
+}
+
+type esBulkError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// bulk sends one bulk request indexing pages. It returns the errors of the pages
+// rejected with 429 Too Many Requests, which may be retried, and of the pages that
+// failed for any other reason, keyed by URL.
+func (bi *esBulkIndexer) bulk(ctx context.Context, pages []Page) (rejected, failed map[string]error) {
+	rejected = make(map[string]error)
+	failed = make(map[string]error)
+	failAll := func(into map[string]error, err error) (map[string]error, map[string]error) {
+		for _, page := range pages {
+			into[page.URL] = err
+		}
+		return rejected, failed
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, page := range pages {
+		action := map[string]map[string]string{"index": {"_id": pageDocumentID(page.URL)}}
+		if err := encoder.Encode(action); err != nil {
+			return failAll(failed, err)
+		}
+		if err := encoder.Encode(newESPageDocument(page)); err != nil {
+			return failAll(failed, fmt.Errorf("error encoding %s: %w", page.URL, err))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+	res, err := esClient.Bulk(&body, esClient.Bulk.WithIndex(bi.index), esClient.Bulk.WithContext(ctx))
+	if err != nil {
+		return failAll(failed, fmt.Errorf("error sending bulk request: %w", err))
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode == http.StatusTooManyRequests {
+		return failAll(rejected, fmt.Errorf("bulk request rejected: %s", res.String()))
+	}
+	if res.IsError() {
+		return failAll(failed, fmt.Errorf("error response to bulk request: %s", res.String()))
+	}
+
+	var r esBulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return failAll(failed, fmt.Errorf("error parsing bulk response: %w", err))
+	}
+	if len(r.Items) != len(pages) {
+		return failAll(failed, fmt.Errorf("bulk response has %d items for %d pages", len(r.Items), len(pages)))
+	}
+
+	// Items are in the order of the request.
+	for i, item := range r.Items {
+		page := pages[i]
+		for _, status := range item {
+			switch {
+			case status.Status == http.StatusTooManyRequests:
+				rejected[page.URL] = fmt.Errorf("indexing %s rejected: %s", page.URL, status.errorReason())
+			case status.Error != nil || status.Status >= 300:
+				failed[page.URL] = fmt.Errorf("error indexing %s: %s", page.URL, status.errorReason())
+			}
+		}
+	}
+	return rejected, failed
+}
+
+func (s esBulkStatus) errorReason() string {
+	if s.Error == nil {
+		return http.StatusText(s.Status)
+	}
+	return s.Error.Type + ": " + s.Error.Reason
+}
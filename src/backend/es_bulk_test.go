@@ -0,0 +1,54 @@
+// Unit tests for bulk indexing pages into Elasticsearch
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestESBulkIndexer(t *testing.T) {
+	es := newFakeES(t)
+	index := es.createIndex("pages_v1")
+	es.rejections["https://en.wikipedia.org/wiki/Rust"] = 2
+	es.rejections["https://en.wikipedia.org/wiki/Zig"] = esBulkMaxAttempts
+	es.failURLs["https://en.wikipedia.org/wiki/Odin"] = true
+	es.rejectBulk = 1
+	retries := testutil.ToFloat64(esBulkRetriesTotal)
+
+	urls := []string{
+		"https://en.wikipedia.org/wiki/Go",
+		"https://en.wikipedia.org/wiki/Rust",
+		"https://en.wikipedia.org/wiki/Zig",
+		"https://en.wikipedia.org/wiki/Odin",
+		"https://en.wikipedia.org/wiki/C",
+	}
+	pages := make(chan Page)
+	go func() {
+		defer close(pages)
+		for _, url := range urls {
+			pages <- Page{Title: url, URL: url, Language: "en"}
+		}
+	}()
+
+	bi := &esBulkIndexer{index: "pages_v1", batchSize: 2, workers: 2, backoff: time.Millisecond}
+	errs := make(map[string]error)
+	bi.indexPages(context.Background(), pages, func(result esBulkResult) {
+		errs[result.page.URL] = result.err
+	})
+
+	require.Len(t, errs, len(urls), "every page has an outcome")
+	assert.NoError(t, errs["https://en.wikipedia.org/wiki/Go"])
+	assert.NoError(t, errs["https://en.wikipedia.org/wiki/Rust"], "rejected pages are retried")
+	assert.NoError(t, errs["https://en.wikipedia.org/wiki/C"])
+	assert.ErrorContains(t, errs["https://en.wikipedia.org/wiki/Zig"], "gave up after")
+	assert.ErrorContains(t, errs["https://en.wikipedia.org/wiki/Odin"], "error indexing")
+	assert.Len(t, index.documents, 3)
+	assert.Equal(t, 0, es.rejectBulk, "rejected bulk requests are retried")
+	assert.Equal(t, 0, index.refreshes, "bulk requests don't refresh the index")
+	assert.Greater(t, testutil.ToFloat64(esBulkRetriesTotal), retries+float64(esBulkMaxAttempts))
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The types below mirror the parts of the Elasticsearch request DSL we use.
+// Request bodies are always built from them and marshalled with encoding/json,
+// never by formatting strings, so user input can only ever end up as a JSON string value.
+
+// esSearchBody is the request body of a _search call.
+type esSearchBody struct {
+	Query      esQuery                  `json:"query"`
+	PostFilter *esQuery                 `json:"post_filter,omitempty"`
+	Source     *esSourceFilter          `json:"_source,omitempty"`
+	Aggs       map[string]esAggregation `json:"aggs,omitempty"`
+	Highlight  *esHighlight             `json:"highlight,omitempty"`
+	From       int                      `json:"from"`
+	Size       int                      `json:"size"`
+}
+
+// esScanBody is the request body of a _search call paging through every document
+// in url order, continuing after the last url of the previous page.
+type esScanBody struct {
+	Size        int                 `json:"size"`
+	Source      []string            `json:"_source"`
+	Sort        []map[string]string `json:"sort"`
+	SearchAfter []string            `json:"search_after,omitempty"`
+}
+
+// esQuery is a single query clause. Exactly one field should be set.
+type esQuery struct {
+	Bool       *esBoolQuery            `json:"bool,omitempty"`
+	MultiMatch *esMultiMatch           `json:"multi_match,omitempty"`
+	Term       map[string]string       `json:"term,omitempty"`
+	Prefix     map[string]string       `json:"prefix,omitempty"`
+	Range      map[string]esRangeQuery `json:"range,omitempty"`
+}
+
+type esBoolQuery struct {
+	Must               []esQuery `json:"must,omitempty"`
+	Filter             []esQuery `json:"filter,omitempty"`
+	Should             []esQuery `json:"should,omitempty"`
+	MustNot            []esQuery `json:"must_not,omitempty"`
+	MinimumShouldMatch int       `json:"minimum_should_match,omitempty"`
+}
+
+type esMultiMatch struct {
+	Query  string   `json:"query"`
+	Type   string   `json:"type,omitempty"`
+	Fields []string `json:"fields"`
+}
+
+type esRangeQuery struct {
+	LT  string `json:"lt,omitempty"`
+	GTE string `json:"gte,omitempty"`
+}
+
+type esSourceFilter struct {
+	Excludes []string `json:"excludes,omitempty"`
+}
+
+type esAggregation struct {
+	Terms *esTermsAggregation `json:"terms,omitempty"`
+}
+
+type esTermsAggregation struct {
+	Field string `json:"field"`
+	Size  int    `json:"size,omitempty"`
+}
+
+type esHighlight struct {
+	PreTags  []string                    `json:"pre_tags"`
+	PostTags []string                    `json:"post_tags"`
+	Fields   map[string]esHighlightField `json:"fields"`
+}
+
+type esHighlightField struct {
+	FragmentSize      *int `json:"fragment_size,omitempty"`
+	NumberOfFragments *int `json:"number_of_fragments,omitempty"`
+	NoMatchSize       *int `json:"no_match_size,omitempty"`
+}
+
+// esIndexDefinition is the body of an index creation call.
+type esIndexDefinition struct {
+	Mappings esMappings `json:"mappings"`
+	// Aliases are the aliases pointing to the index once it is created.
+	Aliases map[string]struct{} `json:"aliases,omitempty"`
+}
+
+type esMappings struct {
+	Properties map[string]esFieldMapping `json:"properties,omitempty"`
+	// Meta is stored with the mapping without affecting it.
+	Meta map[string]string `json:"_meta,omitempty"`
+}
+
+type esFieldMapping struct {
+	Type string `json:"type"`
+	// IgnoreAbove leaves longer keyword values out of the index.
+	IgnoreAbove int `json:"ignore_above,omitempty"`
+	// Fields index the same value again in other ways, e.g. title.keyword.
+	Fields map[string]esFieldMapping `json:"fields,omitempty"`
+}
+
+// esPageDocument is how a row of the pages table is stored in the pages index:
+// every column, plus fields derived from them for filtering and sorting.
+type esPageDocument struct {
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	Content  string `json:"content"`
+	Language string `json:"language"`
+	// LastUpdated is left out for pages without one, rather than claiming year 1.
+	LastUpdated string `json:"last_updated,omitempty"`
+	// TitleSuggest feeds the completion suggester used for autocompletion.
+	TitleSuggest string `json:"title_suggest"`
+	// Domain is the lower-case host of URL.
+	Domain string `json:"domain"`
+	// WordCount is the number of words in Content.
+	WordCount int `json:"word_count"`
+	// ContentHash identifies the indexed values, see pageContentHash.
+	ContentHash string `json:"content_hash"`
+}
+
+// newESPageDocument converts a page into its document in the pages index.
+func newESPageDocument(page Page) esPageDocument {
+	doc := esPageDocument{
+		Title:        page.Title,
+		URL:          page.URL,
+		Content:      page.Content,
+		Language:     page.Language,
+		TitleSuggest: page.Title,
+		Domain:       pageHost(page.URL),
+		WordCount:    len(tokenize(page.Content)),
+		ContentHash:  pageContentHash(page),
+	}
+	if !page.LastUpdated.IsZero() {
+		doc.LastUpdated = page.LastUpdated.Format(time.RFC3339Nano)
+	}
+	return doc
+}
+
+// pageContentHash is a hash of the columns of a page that end up in its document.
+// Comparing it with the hash of the page's row tells whether the document is stale.
+func pageContentHash(page Page) string {
+	lastUpdated := ""
+	if !page.LastUpdated.IsZero() {
+		lastUpdated = page.LastUpdated.UTC().Format(time.RFC3339Nano)
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{page.Title, page.URL, page.Language, lastUpdated, page.Content}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// esSuggestBody is the request body of a _search call that only runs suggesters.
+type esSuggestBody struct {
+	Size    int                    `json:"size"`
+	Source  bool                   `json:"_source"`
+	Suggest map[string]esSuggester `json:"suggest"`
+}
+
+type esSuggester struct {
+	Prefix     string                 `json:"prefix,omitempty"`
+	Text       string                 `json:"text,omitempty"`
+	Completion *esCompletionSuggester `json:"completion,omitempty"`
+	Phrase     *esPhraseSuggester     `json:"phrase,omitempty"`
+}
+
+type esCompletionSuggester struct {
+	Field          string `json:"field"`
+	Size           int    `json:"size"`
+	SkipDuplicates bool   `json:"skip_duplicates"`
+}
+
+type esPhraseSuggester struct {
+	Field           string              `json:"field"`
+	Size            int                 `json:"size"`
+	MaxErrors       float64             `json:"max_errors"`
+	DirectGenerator []esDirectGenerator `json:"direct_generator"`
+}
+
+type esDirectGenerator struct {
+	Field       string `json:"field"`
+	SuggestMode string `json:"suggest_mode"`
+}
+
+// searchableFields are the fields a free-text query is matched against, with boosts.
+var searchableFields = []string{"title^3", "url^2", "content"}
+
+func multiMatchQuery(query string, fields ...string) esQuery {
+	return esQuery{MultiMatch: &esMultiMatch{Query: query, Fields: fields}}
+}
+
+func termQuery(field, value string) esQuery {
+	return esQuery{Term: map[string]string{field: value}}
+}
+
+// esQueryFromAST compiles a parsed search query. Operators become filters, which don't affect scores.
+func esQueryFromAST(node queryNode) esQuery {
+	switch n := node.(type) {
+	case queryAnd:
+		var b esBoolQuery
+		for _, clause := range n.Clauses {
+			switch c := clause.(type) {
+			case queryNot:
+				b.MustNot = append(b.MustNot, esQueryFromAST(c.Clause))
+			case querySite, queryLanguage, queryDate:
+				b.Filter = append(b.Filter, esQueryFromAST(c))
+			default:
+				b.Must = append(b.Must, esQueryFromAST(c))
+			}
+		}
+		return esQuery{Bool: &b}
+	case queryOr:
+		b := esBoolQuery{MinimumShouldMatch: 1}
+		for _, clause := range n.Clauses {
+			b.Should = append(b.Should, esQueryFromAST(clause))
+		}
+		return esQuery{Bool: &b}
+	case queryNot:
+		return esQuery{Bool: &esBoolQuery{MustNot: []esQuery{esQueryFromAST(n.Clause)}}}
+	case queryText:
+		q := multiMatchQuery(n.Text, searchableFields...)
+		if n.Phrase {
+			q.MultiMatch.Type = "phrase"
+		}
+		return q
+	case querySite:
+		b := esBoolQuery{MinimumShouldMatch: 1}
+		for _, prefix := range siteURLPrefixes(n.Host) {
+			b.Should = append(b.Should, esQuery{Prefix: map[string]string{"url": prefix}})
+		}
+		return esQuery{Bool: &b}
+	case queryLanguage:
+		return termQuery("language", n.Language)
+	case queryDate:
+		r := esRangeQuery{GTE: n.Date.Format(queryDateLayout)}
+		if n.Before {
+			r = esRangeQuery{LT: n.Date.Format(queryDateLayout)}
+		}
+		return esQuery{Range: map[string]esRangeQuery{"last_updated": r}}
+	}
+	panic(fmt.Sprintf("unknown query node %T", node))
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// newPagesSearchBody builds the search request for searchReq against the pages index.
+func newPagesSearchBody(searchReq SearchRequest) (esSearchBody, error) {
+	query, err := parseQuery(searchReq.Query)
+	if err != nil {
+		return esSearchBody{}, err
+	}
+
+	body := esSearchBody{
+		Query:  esQueryFromAST(query),
+		Source: &esSourceFilter{Excludes: []string{"content"}},
+		Aggs: map[string]esAggregation{
+			"languages": {Terms: &esTermsAggregation{Field: "language"}},
+		},
+		Highlight: &esHighlight{
+			PreTags:  []string{highlightPreTag},
+			PostTags: []string{highlightPostTag},
+			Fields: map[string]esHighlightField{
+				"title": {NumberOfFragments: intPtr(0), NoMatchSize: intPtr(1000)},
+				"content": {
+					FragmentSize:      intPtr(snippetLength),
+					NumberOfFragments: intPtr(1),
+					NoMatchSize:       intPtr(snippetLength),
+				},
+			},
+		},
+		From: searchReq.From,
+		Size: searchReq.Size,
+	}
+
+	// A post filter restricts the hits without affecting the language aggregation.
+	if searchReq.Language != "" {
+		filter := termQuery("language", searchReq.Language)
+		body.PostFilter = &filter
+	}
+
+	return body, nil
+}
+
+// newTitleSuggestBody builds the request for up to size titles starting with prefix.
+func newTitleSuggestBody(prefix string, size int) esSuggestBody {
+	return esSuggestBody{
+		Suggest: map[string]esSuggester{
+			"titles": {
+				Prefix:     prefix,
+				Completion: &esCompletionSuggester{Field: "title_suggest", Size: size, SkipDuplicates: true},
+			},
+		},
+	}
+}
+
+// newSpellingSuggestBody builds the request for the best spelling of words. Candidate
+// words come from titles and content, and are scored with the content's term statistics.
+func newSpellingSuggestBody(words []string) esSuggestBody {
+	return esSuggestBody{
+		Suggest: map[string]esSuggester{
+			"spelling": {
+				Text: strings.Join(words, " "),
+				Phrase: &esPhraseSuggester{
+					Field:     "content",
+					Size:      1,
+					MaxErrors: 2,
+					DirectGenerator: []esDirectGenerator{
+						{Field: "content", SuggestMode: "always"},
+						{Field: "title", SuggestMode: "always"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// pagesIndexDefinition is the mapping of the pages index.
+func pagesIndexDefinition() esIndexDefinition {
+	return esIndexDefinition{
+		Mappings: esMappings{
+			Properties: map[string]esFieldMapping{
+				// title.keyword sorts and filters on the exact title.
+				"title":         {Type: "text", Fields: map[string]esFieldMapping{"keyword": {Type: "keyword", IgnoreAbove: 256}}},
+				"url":           {Type: "keyword"},
+				"content":       {Type: "text"},
+				"language":      {Type: "keyword"},
+				"last_updated":  {Type: "date"},
+				"title_suggest": {Type: "completion"},
+				"domain":        {Type: "keyword"},
+				"word_count":    {Type: "integer"},
+				"content_hash":  {Type: "keyword"},
+			},
+		},
+	}
+}
+
+// esJSONBody marshals v into a request body for the Elasticsearch client.
+func esJSONBody(v interface{}) (io.Reader, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding Elasticsearch request: %w", err)
+	}
+	return bytes.NewReader(b), nil
+}
@@ -0,0 +1,216 @@
+// Unit and fuzz tests for the typed Elasticsearch query builder
+// Run the fuzzer with: go test -run=^$ -fuzz=FuzzElasticsearchBackendSearch ./src/backend/...
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const emptyESSearchResponse = `{"took":1,"hits":{"total":{"value":0,"relation":"eq"},"hits":[]},"aggregations":{"languages":{"buckets":[]}}}`
+
+// useFakeElasticsearch points esClient at a test server that answers like
+// Elasticsearch, handing every request to handler. esClient is restored on cleanup.
+func useFakeElasticsearch(t testing.TB, handler http.HandlerFunc) {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The client refuses to talk to servers that don't identify as Elasticsearch.
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		handler(w, r)
+	}))
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	require.NoError(t, err)
+
+	previous := esClient
+	esClient = client
+	t.Cleanup(func() {
+		esClient = previous
+		srv.Close()
+	})
+}
+
+func TestNewPagesSearchBody(t *testing.T) {
+	searchBody, err := newPagesSearchBody(SearchRequest{Query: `say "hi there"`, From: 20, Size: 10, Language: "da"})
+	require.NoError(t, err)
+	body, err := json.Marshal(searchBody)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{
+		"query": {"bool": {"must": [
+			{"multi_match": {"query": "say", "fields": ["title^3", "url^2", "content"]}},
+			{"multi_match": {"query": "hi there", "type": "phrase", "fields": ["title^3", "url^2", "content"]}}
+		]}},
+		"post_filter": {"term": {"language": "da"}},
+		"_source": {"excludes": ["content"]},
+		"aggs": {"languages": {"terms": {"field": "language"}}},
+		"highlight": {
+			"pre_tags": ["\ue000"],
+			"post_tags": ["\ue001"],
+			"fields": {
+				"title": {"number_of_fragments": 0, "no_match_size": 1000},
+				"content": {"fragment_size": 200, "number_of_fragments": 1, "no_match_size": 200}
+			}
+		},
+		"from": 20,
+		"size": 10
+	}`, string(body))
+}
+
+func TestNewPagesSearchBodyWithoutLanguage(t *testing.T) {
+	searchBody, err := newPagesSearchBody(SearchRequest{Query: "go", Size: 10})
+	require.NoError(t, err)
+	body, err := json.Marshal(searchBody)
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "post_filter")
+}
+
+func TestNewPagesSearchBodyInvalidQuery(t *testing.T) {
+	_, err := newPagesSearchBody(SearchRequest{Query: `"go`, Size: 10})
+	var queryErr *QueryError
+	assert.ErrorAs(t, err, &queryErr)
+}
+
+func TestESQueryFromAST(t *testing.T) {
+	query, err := parseQuery(`go OR golang -java site:da.wikipedia.org lang:da before:2024-02-01 after:2023-01-01`)
+	require.NoError(t, err)
+	body, err := json.Marshal(esQueryFromAST(query))
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{"bool": {
+		"must": [
+			{"bool": {"should": [
+				{"multi_match": {"query": "go", "fields": ["title^3", "url^2", "content"]}},
+				{"multi_match": {"query": "golang", "fields": ["title^3", "url^2", "content"]}}
+			], "minimum_should_match": 1}}
+		],
+		"must_not": [
+			{"multi_match": {"query": "java", "fields": ["title^3", "url^2", "content"]}}
+		],
+		"filter": [
+			{"bool": {"should": [
+				{"prefix": {"url": "http://da.wikipedia.org/"}},
+				{"prefix": {"url": "https://da.wikipedia.org/"}}
+			], "minimum_should_match": 1}},
+			{"term": {"language": "da"}},
+			{"range": {"last_updated": {"lt": "2024-02-01"}}},
+			{"range": {"last_updated": {"gte": "2023-01-01"}}}
+		]
+	}}`, string(body))
+}
+
+func TestNewESPageDocument(t *testing.T) {
+	page := Page{
+		Title:       "Go (programming language)",
+		URL:         "https://EN.wikipedia.org/wiki/Go_(programming_language)",
+		Content:     "Go is a statically typed, compiled language.",
+		Language:    "en",
+		LastUpdated: time.Date(2025, 5, 1, 12, 30, 15, 250000000, time.UTC),
+	}
+	body, err := json.Marshal(newESPageDocument(page))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"title": "Go (programming language)",
+		"url": "https://EN.wikipedia.org/wiki/Go_(programming_language)",
+		"content": "Go is a statically typed, compiled language.",
+		"language": "en",
+		"last_updated": "2025-05-01T12:30:15.25Z",
+		"title_suggest": "Go (programming language)",
+		"domain": "en.wikipedia.org",
+		"word_count": 7,
+		"content_hash": "`+pageContentHash(page)+`"
+	}`, string(body))
+
+	var decoded Page
+	require.NoError(t, json.Unmarshal(body, &decoded), "documents decode back into pages")
+	assert.True(t, page.LastUpdated.Equal(decoded.LastUpdated))
+
+	changed := page
+	changed.Content += " It has goroutines."
+	assert.NotEqual(t, pageContentHash(page), pageContentHash(changed))
+	inOtherZone := page
+	inOtherZone.LastUpdated = page.LastUpdated.In(time.FixedZone("CEST", 2*60*60))
+	assert.Equal(t, pageContentHash(page), pageContentHash(inOtherZone))
+
+	page.LastUpdated = time.Time{}
+	body, err = json.Marshal(newESPageDocument(page))
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "last_updated", "pages without last_updated have none")
+}
+
+func FuzzElasticsearchBackendSearch(f *testing.F) {
+	for _, seed := range []string{
+		"golang",
+		`"`,
+		`\`,
+		`\"`,
+		`"}}, "size": 10000, "script": {"source": "x`,
+		`{"match_all": {}}`,
+		" \x00\x1f",
+		"æøå tag",
+		"\xff\xfe invalid utf-8",
+	} {
+		f.Add(seed)
+	}
+
+	var mu sync.Mutex
+	var captured []byte
+	useFakeElasticsearch(f, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		captured = body
+		mu.Unlock()
+		_, _ = io.WriteString(w, emptyESSearchResponse)
+	})
+
+	backend := newElasticsearchBackend()
+	f.Fuzz(func(t *testing.T, query string) {
+		mu.Lock()
+		captured = nil
+		mu.Unlock()
+
+		_, err := backend.Search(context.Background(), SearchRequest{Query: query, Size: 10, Language: "en"})
+		if _, parseErr := parseQuery(query); parseErr != nil {
+			assert.Equal(t, parseErr, err)
+			assert.Nil(t, captured, "invalid queries are not sent")
+			return
+		}
+		require.NoError(t, err)
+
+		mu.Lock()
+		sent := captured
+		mu.Unlock()
+
+		var body map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(sent, &body), "request body must be valid JSON")
+		assert.Equal(t, []string{"_source", "aggs", "from", "highlight", "post_filter", "query", "size"}, sortedKeys(body))
+		assert.JSONEq(t, `10`, string(body["size"]))
+		assert.JSONEq(t, `{"term": {"language": "en"}}`, string(body["post_filter"]))
+
+		var q map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(body["query"], &q))
+		assert.Equal(t, []string{"bool"}, sortedKeys(q))
+	})
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// esReconcileScanSize is the number of documents read per request when
+	// reconciling the pages index.
+	esReconcileScanSize = 1000
+	// reconcileReportedURLs caps the URLs listed per kind of drift in a report.
+	reconcileReportedURLs = 100
+)
+
+// errReconcileRunning is returned when a reconciliation is asked for while one runs.
+var errReconcileRunning = errors.New("a reconciliation is already running")
+
+// ReconcileReport is the outcome of comparing the pages table with the pages index.
+type ReconcileReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	// Pages and Documents are the number of rows in the table and documents in the index.
+	Pages     int `json:"pages"`
+	Documents int `json:"documents"`
+	// Missing pages have no document, stale documents differ from their page, and
+	// orphaned documents have no page.
+	Missing  DriftURLs `json:"missing"`
+	Stale    DriftURLs `json:"stale"`
+	Orphaned DriftURLs `json:"orphaned"`
+	// Repaired tells whether the drift was repaired after it was measured.
+	Repaired bool `json:"repaired"`
+}
+
+// DriftURLs counts the documents that drifted one way and lists the first of them.
+type DriftURLs struct {
+	Count int      `json:"count"`
+	URLs  []string `json:"urls"`
+	all   []string
+	// ids are the IDs of the drifted documents, for drift found in the index.
+	ids []string
+}
+
+func (d *DriftURLs) add(url string) {
+	d.Count++
+	d.all = append(d.all, url)
+	if len(d.URLs) < reconcileReportedURLs {
+		d.URLs = append(d.URLs, url)
+	}
+}
+
+func (d *DriftURLs) addDocument(id, url string) {
+	d.add(url)
+	d.ids = append(d.ids, id)
+}
+
+var (
+	// reconcileMu is held while a reconciliation runs.
+	reconcileMu sync.Mutex
+	// lastReconcileReport is the report of the last reconciliation, guarded by lastReconcileMu.
+	lastReconcileReport *ReconcileReport
+	lastReconcileMu     sync.Mutex
+)
+
+// reconcileElasticsearch compares the URLs and content hashes of the pages table
+// with those of the pages index and records the drift in metrics and as the last
+// report. Documents not under the ID of their URL, i.e. duplicates and documents
+// indexed before pages were keyed on their URL, are orphaned too. With repair,
+// missing and stale pages are indexed again and orphaned documents deleted.
+func reconcileElasticsearch(ctx context.Context, repair bool) (ReconcileReport, error) {
+	if !reconcileMu.TryLock() {
+		return ReconcileReport{}, errReconcileRunning
+	}
+	defer reconcileMu.Unlock()
+
+	report := ReconcileReport{StartedAt: time.Now()}
+	hashes, err := pageContentHashes(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Pages = len(hashes)
+
+	err = scanPageDocuments(ctx, esPagesIndex, func(id, url, hash string) {
+		report.Documents++
+		if id != pageDocumentID(url) {
+			report.Orphaned.addDocument(id, url)
+			return
+		}
+		pageHash, ok := hashes[url]
+		switch {
+		case !ok:
+			report.Orphaned.addDocument(id, url)
+		case pageHash != hash:
+			report.Stale.add(url)
+		}
+		delete(hashes, url)
+	})
+	if err != nil {
+		return report, err
+	}
+	missing := make([]string, 0, len(hashes))
+	for url := range hashes {
+		missing = append(missing, url)
+	}
+	sort.Strings(missing)
+	for _, url := range missing {
+		report.Missing.add(url)
+	}
+
+	esIndexDriftDocuments.WithLabelValues("missing").Set(float64(report.Missing.Count))
+	esIndexDriftDocuments.WithLabelValues("stale").Set(float64(report.Stale.Count))
+	esIndexDriftDocuments.WithLabelValues("orphaned").Set(float64(report.Orphaned.Count))
+	esIndexReconciledTimestamp.SetToCurrentTime()
+	log.Printf("Reconciled %d pages with %d documents: %d missing, %d stale, %d orphaned",
+		report.Pages, report.Documents, report.Missing.Count, report.Stale.Count, report.Orphaned.Count)
+
+	var repairErr error
+	if repair && report.Missing.Count+report.Stale.Count+report.Orphaned.Count > 0 {
+		repairErr = repairDrift(ctx, append(report.Missing.all, report.Stale.all...), report.Orphaned)
+		report.Repaired = repairErr == nil
+	}
+	report.DurationMs = time.Since(report.StartedAt).Milliseconds()
+
+	lastReconcileMu.Lock()
+	lastReconcileReport = &report
+	lastReconcileMu.Unlock()
+	return report, repairErr
+}
+
+// pageContentHashes returns the content hash of every page by URL.
+func pageContentHashes(ctx context.Context) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT title, url, language, last_updated, content FROM pages")
+	if err != nil {
+		return nil, fmt.Errorf("error querying pages from DB: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	hashes := make(map[string]string)
+	for rows.Next() {
+		page, err := scanPage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning page: %w", err)
+		}
+		hashes[page.URL] = pageContentHash(page)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading pages from DB: %w", err)
+	}
+	return hashes, nil
+}
+
+// esScannedDocument is a document read by scanPageDocuments.
+type esScannedDocument struct {
+	ID     string         `json:"_id"`
+	Source esPageDocument `json:"_source"`
+}
+
+// scanPageDocuments calls fn with the ID, URL and content hash of every document in index.
+func scanPageDocuments(ctx context.Context, index string, fn func(id, url, hash string)) error {
+	body := esScanBody{
+		Size:   esReconcileScanSize,
+		Source: []string{"url", "content_hash"},
+		Sort:   []map[string]string{{"url": "asc"}},
+	}
+	for {
+		page, err := scanPageDocumentsAfter(ctx, index, body)
+		if err != nil {
+			return err
+		}
+		for _, doc := range page {
+			fn(doc.ID, doc.Source.URL, doc.Source.ContentHash)
+		}
+		if len(page) < body.Size {
+			return nil
+		}
+		body.SearchAfter = []string{page[len(page)-1].Source.URL}
+	}
+}
+
+func scanPageDocumentsAfter(ctx context.Context, index string, body esScanBody) ([]esScannedDocument, error) {
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+
+	searchBody, err := esJSONBody(body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := esClient.Search(
+		esClient.Search.WithContext(ctx),
+		esClient.Search.WithIndex(index),
+		esClient.Search.WithBody(searchBody),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error reading documents: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.IsError() {
+		return nil, fmt.Errorf("error response when reading documents: %s", res.String())
+	}
+
+	var r struct {
+		Hits struct {
+			Hits []esScannedDocument `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	return r.Hits.Hits, nil
+}
+
+// repairDrift indexes the pages with the given URLs again and deletes the
+// orphaned documents, except those whose pages were saved since they were found.
+func repairDrift(ctx context.Context, reindex []string, orphaned DriftURLs) error {
+	if len(reindex) > 0 {
+		rows, err := db.QueryContext(ctx, "SELECT title, url, language, last_updated, content FROM pages WHERE url = ANY($1)", pq.Array(reindex))
+		if err != nil {
+			return fmt.Errorf("error querying pages from DB: %w", err)
+		}
+		defer func() { _ = rows.Close() }()
+
+		failed := 0
+		err = bulkIndexRows(ctx, esPagesIndex, rows, func(result esBulkResult) {
+			if result.err != nil {
+				log.Printf("Error repairing page: %v", result.err)
+				failed++
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d pages failed to index", failed, len(reindex))
+		}
+	}
+
+	ids, err := stillOrphaned(ctx, orphaned)
+	if err != nil {
+		return err
+	}
+	backend := &elasticsearchBackend{index: esPagesIndex}
+	for _, id := range ids {
+		if err := backend.deleteDocument(ctx, id, "document "+id); err != nil {
+			return err
+		}
+	}
+
+	if err := refreshIndex(ctx, esPagesIndex); err != nil {
+		return err
+	}
+	invalidateSearchCache(ctx)
+	log.Printf("Repaired drift: indexed %d pages, deleted %d documents", len(reindex), len(ids))
+	return nil
+}
+
+// stillOrphaned returns the IDs of the orphaned documents to delete. Pages saved
+// while reconciling are indexed by the pages outbox, so documents under the ID of
+// their URL stay if the page exists by now. Documents under any other ID always go.
+func stillOrphaned(ctx context.Context, orphaned DriftURLs) ([]string, error) {
+	var urls []string
+	for i, id := range orphaned.ids {
+		if id == pageDocumentID(orphaned.all[i]) {
+			urls = append(urls, orphaned.all[i])
+		}
+	}
+	if len(urls) == 0 {
+		return orphaned.ids, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT url FROM pages WHERE url = ANY($1)", pq.Array(urls))
+	if err != nil {
+		return nil, fmt.Errorf("error querying pages from DB: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	saved := make(map[string]bool)
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		saved[url] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for i, id := range orphaned.ids {
+		if id != pageDocumentID(orphaned.all[i]) || !saved[orphaned.all[i]] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// apiReconcileHandler serves /api/admin/reconcile. GET returns the last report;
+// POST reconciles now, repairing the drift if repair=1, and returns its report.
+func apiReconcileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		lastReconcileMu.Lock()
+		report := lastReconcileReport
+		lastReconcileMu.Unlock()
+		if report == nil {
+			writeJSONError(w, http.StatusNotFound, "no reconciliation has run yet")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	if esClient == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "Elasticsearch is not in use")
+		return
+	}
+	report, err := reconcileElasticsearch(r.Context(), r.URL.Query().Get("repair") == "1")
+	if errors.Is(err, errReconcileRunning) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error reconciling Elasticsearch: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "reconciliation failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,120 @@
+// Unit tests for reconciling the pages table with the Elasticsearch index
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcileElasticsearch(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	es := newFakeES(t)
+	index := es.createIndex("pages_v1")
+	es.aliases[esPagesIndex] = "pages_v1"
+	ctx := context.Background()
+	lastUpdated := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	goPage := Page{Title: "Go", URL: "https://en.wikipedia.org/wiki/Go", Language: "en", LastUpdated: lastUpdated, Content: "Go is a language"}
+	rustPage := Page{Title: "Rust", URL: "https://en.wikipedia.org/wiki/Rust", Language: "en", LastUpdated: lastUpdated, Content: "Rust is a language"}
+	zigPage := Page{Title: "Zig", URL: "https://en.wikipedia.org/wiki/Zig", Language: "en", LastUpdated: lastUpdated, Content: "Zig is a language"}
+	staleRust := rustPage
+	staleRust.Content = "Rust is a fungus"
+	odinPage := Page{Title: "Odin", URL: "https://en.wikipedia.org/wiki/Odin", Language: "en", LastUpdated: lastUpdated, Content: "Odin is a language"}
+	for _, page := range []Page{goPage, staleRust, odinPage} {
+		index.documents[pageDocumentID(page.URL)] = newESPageDocument(page)
+	}
+	// A duplicate of Go, indexed before pages were keyed on their URL.
+	index.documents["Xy3kq"] = newESPageDocument(goPage)
+
+	pageRows := func(pages ...Page) *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"title", "url", "language", "last_updated", "content"})
+		for _, p := range pages {
+			rows.AddRow(p.Title, p.URL, p.Language, p.LastUpdated, p.Content)
+		}
+		return rows
+	}
+	selectPages := regexp.QuoteMeta("SELECT title, url, language, last_updated, content FROM pages")
+
+	mock.ExpectQuery(selectPages).WillReturnRows(pageRows(goPage, rustPage, zigPage))
+	report, err := reconcileElasticsearch(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Pages)
+	assert.Equal(t, 4, report.Documents)
+	assert.Equal(t, DriftURLs{Count: 1, URLs: []string{zigPage.URL}, all: []string{zigPage.URL}}, report.Missing)
+	assert.Equal(t, []string{rustPage.URL}, report.Stale.URLs)
+	assert.Equal(t, []string{goPage.URL, odinPage.URL}, report.Orphaned.URLs)
+	assert.False(t, report.Repaired)
+	assert.Equal(t, 1.0, testutil.ToFloat64(esIndexDriftDocuments.WithLabelValues("stale")))
+	assert.Len(t, index.documents, 4, "drift is only repaired when asked to")
+
+	// Repairing indexes missing and stale pages and deletes orphaned documents by
+	// their ID. Documents under another ID than their URL's go even if the page exists.
+	mock.ExpectQuery(selectPages).WillReturnRows(pageRows(goPage, rustPage, zigPage))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT title, url, language, last_updated, content FROM pages WHERE url = ANY($1)")).
+		WithArgs(pq.Array([]string{zigPage.URL, rustPage.URL})).
+		WillReturnRows(pageRows(rustPage, zigPage))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT url FROM pages WHERE url = ANY($1)")).
+		WithArgs(pq.Array([]string{odinPage.URL})).
+		WillReturnRows(sqlmock.NewRows([]string{"url"}))
+	report, err = reconcileElasticsearch(ctx, true)
+	require.NoError(t, err)
+	assert.True(t, report.Repaired)
+	assert.Len(t, index.documents, 3)
+	assert.Equal(t, rustPage.Content, index.documents[pageDocumentID(rustPage.URL)].Content)
+	assert.Contains(t, index.documents, pageDocumentID(zigPage.URL))
+	assert.NotContains(t, index.documents, pageDocumentID(odinPage.URL))
+	assert.NotContains(t, index.documents, "Xy3kq")
+	assert.Contains(t, index.documents, pageDocumentID(goPage.URL))
+	assert.Equal(t, 1, index.refreshes)
+
+	// Orphans saved again while reconciling keep their documents.
+	index.documents[pageDocumentID(odinPage.URL)] = newESPageDocument(odinPage)
+	mock.ExpectQuery(selectPages).WillReturnRows(pageRows(goPage, rustPage, zigPage))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT url FROM pages WHERE url = ANY($1)")).
+		WithArgs(pq.Array([]string{odinPage.URL})).
+		WillReturnRows(sqlmock.NewRows([]string{"url"}).AddRow(odinPage.URL))
+	report, err = reconcileElasticsearch(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{odinPage.URL}, report.Orphaned.URLs)
+	assert.Contains(t, index.documents, pageDocumentID(odinPage.URL))
+
+	mock.ExpectQuery(selectPages).WillReturnRows(pageRows(goPage, rustPage, zigPage, odinPage))
+	report, err = reconcileElasticsearch(ctx, true)
+	require.NoError(t, err)
+	assert.Zero(t, report.Missing.Count+report.Stale.Count+report.Orphaned.Count)
+	assert.False(t, report.Repaired, "there was nothing to repair")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAPIReconcileHandler(t *testing.T) {
+	lastReconcileMu.Lock()
+	previous := lastReconcileReport
+	lastReconcileReport = nil
+	lastReconcileMu.Unlock()
+	t.Cleanup(func() { lastReconcileReport = previous })
+
+	w := httptest.NewRecorder()
+	apiReconcileHandler(w, httptest.NewRequest(http.MethodGet, "/api/admin/reconcile", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	lastReconcileReport = &ReconcileReport{Pages: 2, Documents: 1, Missing: DriftURLs{Count: 1, URLs: []string{"https://en.wikipedia.org/wiki/Go"}}}
+	w = httptest.NewRecorder()
+	apiReconcileHandler(w, httptest.NewRequest(http.MethodGet, "/api/admin/reconcile", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report ReconcileReport
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+	assert.Equal(t, 1, report.Missing.Count)
+	assert.Equal(t, []string{"https://en.wikipedia.org/wiki/Go"}, report.Missing.URLs)
+}
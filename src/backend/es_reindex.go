@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The pages index is an alias of a versioned index, pages_v1, pages_v2 and so on.
+// reindexElasticsearch builds the next version next to the current one and swaps
+// the alias, so searches never see a missing or half-built index. The version the
+// alias pointed to before is kept, so rollbackElasticsearchIndex can go back to it.
+
+// esIndexVersionSeparator separates the name of the pages alias from the version.
+const esIndexVersionSeparator = "_v"
+
+// esVersionedIndex returns the name of a version of the pages index.
+func esVersionedIndex(version int) string {
+	return esPagesIndex + esIndexVersionSeparator + strconv.Itoa(version)
+}
+
+// esIndexVersion returns the version of a versioned pages index, or false if index isn't one.
+func esIndexVersion(index string) (int, bool) {
+	suffix, ok := strings.CutPrefix(index, esPagesIndex+esIndexVersionSeparator)
+	if !ok {
+		return 0, false
+	}
+	version, err := strconv.Atoi(suffix)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// nextIndexVersion returns the version after the newest of versions.
+func nextIndexVersion(versions []int) int {
+	if len(versions) == 0 {
+		return 1
+	}
+	return versions[len(versions)-1] + 1
+}
+
+// esIndexVersions returns the versions of the pages index that exist, oldest first.
+func esIndexVersions(ctx context.Context) ([]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+
+	res, err := esClient.Indices.Get([]string{esPagesIndex + esIndexVersionSeparator + "*"}, esClient.Indices.Get.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error listing index versions: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.IsError() {
+		return nil, fmt.Errorf("error response when listing index versions: %s", res.String())
+	}
+
+	var indices map[string]json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return nil, err
+	}
+	var versions []int
+	for index := range indices {
+		if version, ok := esIndexVersion(index); ok {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// esAliasTargets returns the indices the alias points to, or none if it doesn't exist.
+func esAliasTargets(ctx context.Context, alias string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+
+	res, err := esClient.Indices.GetAlias(esClient.Indices.GetAlias.WithName(alias), esClient.Indices.GetAlias.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error reading alias: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("error response when reading alias %q: %s", alias, res.String())
+	}
+
+	var aliases map[string]json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&aliases); err != nil {
+		return nil, err
+	}
+	var targets []string
+	for index := range aliases {
+		targets = append(targets, index)
+	}
+	sort.Strings(targets)
+	return targets, nil
+}
+
+// esAliasActions is the body of an alias update, which Elasticsearch applies atomically.
+type esAliasActions struct {
+	Actions []map[string]esAliasAction `json:"actions"`
+}
+
+type esAliasAction struct {
+	Index string `json:"index"`
+	Alias string `json:"alias,omitempty"`
+}
+
+// swapPagesAlias points the pages alias to index and nothing else. A pages index
+// created before versioning is deleted in the same step, as the alias can't be
+// added while an index has its name.
+func swapPagesAlias(ctx context.Context, index string) error {
+	targets, err := esAliasTargets(ctx, esPagesIndex)
+	if err != nil {
+		return err
+	}
+
+	var update esAliasActions
+	if len(targets) == 0 {
+		exists, err := esIndexExists(ctx, esPagesIndex)
+		if err != nil {
+			return err
+		}
+		if exists {
+			update.Actions = append(update.Actions, map[string]esAliasAction{"remove_index": {Index: esPagesIndex}})
+		}
+	}
+	for _, target := range targets {
+		if target != index {
+			update.Actions = append(update.Actions, map[string]esAliasAction{"remove": {Index: target, Alias: esPagesIndex}})
+		}
+	}
+	update.Actions = append(update.Actions, map[string]esAliasAction{"add": {Index: index, Alias: esPagesIndex}})
+
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+	body, err := esJSONBody(update)
+	if err != nil {
+		return err
+	}
+	res, err := esClient.Indices.UpdateAliases(body, esClient.Indices.UpdateAliases.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error updating alias: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.IsError() {
+		return fmt.Errorf("error response when pointing alias %q to %q: %s", esPagesIndex, index, res.String())
+	}
+	log.Printf("Alias %q now points to %q", esPagesIndex, index)
+	return nil
+}
+
+// esIndexExists reports whether an index or alias exists.
+func esIndexExists(ctx context.Context, index string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+
+	res, err := esClient.Indices.Exists([]string{index}, esClient.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return false, fmt.Errorf("error checking if index exists: %w", err)
+	}
+	_ = res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %d when checking if index exists", res.StatusCode)
+	}
+}
+
+// deleteIndex deletes an index and its documents.
+func deleteIndex(ctx context.Context, index string) error {
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+
+	res, err := esClient.Indices.Delete([]string{index}, esClient.Indices.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error deleting index: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.IsError() {
+		return fmt.Errorf("error response when deleting index %q: %s", index, res.String())
+	}
+	log.Printf("Deleted index %q", index)
+	return nil
+}
+
+// ReindexProgress is how far a reindex has come. Processed counts the pages sent to
+// the new index so far, including the Failed ones.
+type ReindexProgress struct {
+	Total     int64 `json:"total"`
+	Processed int64 `json:"processed"`
+	Failed    int64 `json:"failed"`
+}
+
+// reindexElasticsearch builds a new version of the pages index from the pages
+// table with the current mapping. Once its document count matches the table, the
+// pages alias is moved to it and versions other than the new and the previous one
+// are deleted. The pages outbox is paused until the alias is moved, so changes
+// made meanwhile are applied to the new version rather than lost with the old one. If anything goes wrong, or ctx is cancelled, the new version is
+// deleted and the alias is left alone. progress, if not nil, is called as pages
+// are indexed.
+func reindexElasticsearch(ctx context.Context, progress func(ReindexProgress)) error {
+	versions, err := esIndexVersions(ctx)
+	if err != nil {
+		return err
+	}
+	previous, err := esAliasTargets(ctx, esPagesIndex)
+	if err != nil {
+		return err
+	}
+
+	resume, err := pausePagesOutbox(ctx)
+	if err != nil {
+		return err
+	}
+	defer resume()
+
+	index := esVersionedIndex(nextIndexVersion(versions))
+	if err := createIndex(ctx, index, pagesIndexDefinition()); err != nil {
+		return err
+	}
+	if err := buildIndexVersion(ctx, index, progress); err != nil {
+		// The new version is deleted even when the reindex was cancelled.
+		if deleteErr := deleteIndex(context.WithoutCancel(ctx), index); deleteErr != nil {
+			log.Printf("Error deleting incomplete index %q: %v", index, deleteErr)
+		}
+		return err
+	}
+
+	if err := swapPagesAlias(ctx, index); err != nil {
+		return err
+	}
+	invalidateSearchCache(ctx)
+
+	keep := append([]string{index}, previous...)
+	for _, version := range versions {
+		old := esVersionedIndex(version)
+		if slices.Contains(keep, old) {
+			continue
+		}
+		if err := deleteIndex(ctx, old); err != nil {
+			log.Printf("Error deleting old index %q: %v", old, err)
+		}
+	}
+	return nil
+}
+
+// buildIndexVersion indexes every page into index, refreshes it and checks that it
+// holds as many documents as the pages table. The sync watermark of the index is
+// set to the newest page, so syncs pick up from there once the alias points to it.
+func buildIndexVersion(ctx context.Context, index string, progress func(ReindexProgress)) error {
+	// Counting and reading the pages in one snapshot keeps pages the scraper adds
+	// meanwhile out of both.
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var expected int64
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pages").Scan(&expected); err != nil {
+		return fmt.Errorf("error counting pages: %w", err)
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT title, url, language, last_updated, content FROM pages ORDER BY last_updated")
+	if err != nil {
+		return fmt.Errorf("error querying pages from DB: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	state := ReindexProgress{Total: expected}
+	if progress != nil {
+		progress(state)
+	}
+	var firstErr error
+	var watermark time.Time
+	err = bulkIndexRows(ctx, index, rows, func(result esBulkResult) {
+		state.Processed++
+		if result.err != nil {
+			if state.Failed == 0 {
+				firstErr = result.err
+			}
+			state.Failed++
+		}
+		if progress != nil {
+			progress(state)
+		}
+		if result.err != nil {
+			return
+		}
+		if result.page.LastUpdated.After(watermark) {
+			watermark = result.page.LastUpdated
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if state.Failed > 0 {
+		return fmt.Errorf("%d pages failed to index into %q: %w", state.Failed, index, firstErr)
+	}
+
+	if err := refreshIndex(ctx, index); err != nil {
+		return err
+	}
+	stats, err := (&elasticsearchBackend{index: index}).Stats(ctx)
+	if err != nil {
+		return err
+	}
+	if stats.Documents != expected {
+		return fmt.Errorf("index %q has %d documents, but the pages table has %d rows", index, stats.Documents, expected)
+	}
+
+	if !watermark.IsZero() {
+		if err := setESSyncWatermark(ctx, index, watermark); err != nil {
+			return err
+		}
+	}
+	log.Printf("Indexed %d pages into %q", expected, index)
+	return nil
+}
+
+// rollbackElasticsearchIndex points the pages alias back to the newest version
+// older than the one it points to now.
+func rollbackElasticsearchIndex(ctx context.Context) error {
+	targets, err := esAliasTargets(ctx, esPagesIndex)
+	if err != nil {
+		return err
+	}
+	if len(targets) != 1 {
+		return fmt.Errorf("alias %q points to %d indices, expected 1", esPagesIndex, len(targets))
+	}
+	current, ok := esIndexVersion(targets[0])
+	if !ok {
+		return fmt.Errorf("alias %q points to %q, which is not a version of it", esPagesIndex, targets[0])
+	}
+
+	versions, err := esIndexVersions(ctx)
+	if err != nil {
+		return err
+	}
+	previous := 0
+	for _, version := range versions {
+		if version < current {
+			previous = version
+		}
+	}
+	if previous == 0 {
+		return errors.New("there is no older version of the pages index to roll back to")
+	}
+
+	if err := swapPagesAlias(ctx, esVersionedIndex(previous)); err != nil {
+		return err
+	}
+	invalidateSearchCache(ctx)
+	return nil
+}
@@ -0,0 +1,126 @@
+// Unit tests for blue/green reindexing of the Elasticsearch pages index
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestESIndexVersion(t *testing.T) {
+	tests := []struct {
+		index   string
+		version int
+		ok      bool
+	}{
+		{"pages_v1", 1, true},
+		{"pages_v12", 12, true},
+		{"pages", 0, false},
+		{"pages_v", 0, false},
+		{"pages_v0", 0, false},
+		{"pages_vnext", 0, false},
+		{"users_v1", 0, false},
+	}
+	for _, tt := range tests {
+		version, ok := esIndexVersion(tt.index)
+		assert.Equal(t, tt.ok, ok, tt.index)
+		assert.Equal(t, tt.version, version, tt.index)
+	}
+	assert.Equal(t, "pages_v3", esVersionedIndex(nextIndexVersion([]int{1, 2})))
+}
+
+// expectReindexQueries expects the queries of one buildIndexVersion, which reads
+// count pages from the table.
+func expectReindexQueries(mock sqlmock.Sqlmock, count int, lastUpdated time.Time) {
+	rows := sqlmock.NewRows([]string{"title", "url", "language", "last_updated", "content"})
+	urls := []string{"https://en.wikipedia.org/wiki/Go", "https://en.wikipedia.org/wiki/Rust", "https://en.wikipedia.org/wiki/Zig"}
+	for _, url := range urls[:count] {
+		rows.AddRow(url, url, "en", lastUpdated, "A language")
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).
+		WithArgs(pagesOutboxLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM pages")).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT title, url, language, last_updated, content FROM pages ORDER BY last_updated")).
+		WillReturnRows(rows)
+	mock.ExpectRollback()
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).
+		WithArgs(pagesOutboxLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestReindexElasticsearch(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	es := newFakeES(t)
+	ctx := context.Background()
+	lastUpdated := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// An index created before versioning is replaced by the first version.
+	es.createIndex(esPagesIndex)
+	expectReindexQueries(mock, 2, lastUpdated)
+	require.NoError(t, reindexElasticsearch(ctx, nil))
+	assert.Equal(t, "pages_v1", es.aliases[esPagesIndex])
+	require.NotContains(t, es.indices, esPagesIndex)
+	index := es.index(esPagesIndex)
+	assert.Len(t, index.documents, 2)
+	assert.Equal(t, 1, index.refreshes)
+	assert.Equal(t, lastUpdated.Format(time.RFC3339Nano), index.meta[esWatermarkKey], "syncs continue from the newest page")
+
+	// Each reindex builds a new version and keeps the previous one, reporting its progress.
+	expectReindexQueries(mock, 3, lastUpdated)
+	var progress []ReindexProgress
+	require.NoError(t, reindexElasticsearch(ctx, func(p ReindexProgress) { progress = append(progress, p) }))
+	assert.Equal(t, []ReindexProgress{{Total: 3}, {Total: 3, Processed: 1}, {Total: 3, Processed: 2}, {Total: 3, Processed: 3}}, progress)
+	assert.Equal(t, "pages_v2", es.aliases[esPagesIndex])
+	assert.Len(t, es.index(esPagesIndex).documents, 3)
+	assert.Contains(t, es.indices, "pages_v1")
+
+	expectReindexQueries(mock, 3, lastUpdated)
+	require.NoError(t, reindexElasticsearch(ctx, nil))
+	assert.Equal(t, "pages_v3", es.aliases[esPagesIndex])
+	assert.Contains(t, es.indices, "pages_v2")
+	assert.NotContains(t, es.indices, "pages_v1", "older versions are deleted")
+
+	// A version missing documents is deleted without switching to it.
+	es.failCount = 1
+	expectReindexQueries(mock, 3, lastUpdated)
+	assert.ErrorContains(t, reindexElasticsearch(ctx, nil), "has 2 documents, but the pages table has 3 rows")
+	assert.Equal(t, "pages_v3", es.aliases[esPagesIndex])
+	assert.NotContains(t, es.indices, "pages_v4")
+	assert.Contains(t, es.indices, "pages_v2")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRollbackElasticsearchIndex(t *testing.T) {
+	es := newFakeES(t)
+	ctx := context.Background()
+
+	assert.Error(t, rollbackElasticsearchIndex(ctx), "there is no alias")
+
+	es.createIndex("pages_v2")
+	es.createIndex("pages_v5")
+	es.createIndex("pages_v7")
+	es.aliases[esPagesIndex] = "pages_v7"
+
+	require.NoError(t, rollbackElasticsearchIndex(ctx))
+	assert.Equal(t, "pages_v5", es.aliases[esPagesIndex])
+	require.NoError(t, rollbackElasticsearchIndex(ctx))
+	assert.Equal(t, "pages_v2", es.aliases[esPagesIndex])
+	assert.ErrorContains(t, rollbackElasticsearchIndex(ctx), "no older version")
+	assert.Len(t, es.indices, 3, "rolling back deletes nothing")
+}
+
+func TestRunCommand(t *testing.T) {
+	err := runCommand([]string{"reindx"})
+	assert.ErrorContains(t, err, `unknown command "reindx"`)
+	assert.ErrorContains(t, err, "rollback")
+}
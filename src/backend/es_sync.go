@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// esPagesIndex is the Elasticsearch index holding the copy of the pages table.
+	esPagesIndex = "pages"
+	// esWatermarkKey is the _meta key of the pages index holding the last_updated
+	// of the newest page synced into it.
+	esWatermarkKey = "synced_until"
+	// esSyncOverlap is how far before the watermark a sync starts reading, so rows
+	// committed late with an older last_updated are still picked up. Re-indexing a
+	// page only overwrites its document.
+	esSyncOverlap = time.Minute
+	// esRequestTimeout bounds each bulk, mapping and refresh call made by a sync.
+	esRequestTimeout = 10 * time.Second
+)
+
+// syncPagesToElasticsearch indexes the pages updated since the last sync, creating
+// the pages index if it doesn't exist. Documents are keyed by pageDocumentID, so
+// re-indexing a page overwrites it, and searches keep working during a sync. The
+// watermark is stored in the index itself, so a new index gets every page.
+// Pages are sent in bulk requests by newESBulkIndexer and the index is refreshed
+// once at the end. Pages deleted from the table are removed from the index by the
+// pages outbox consumer, see startPagesOutboxConsumer. Pages that fail to index
+// are recorded in the index_failures table and retried from there, see
+// retryIndexFailures.
+func syncPagesToElasticsearch() error {
+	ctx := context.Background()
+	if err := ensurePagesIndex(ctx, esPagesIndex); err != nil {
+		return err
+	}
+
+	watermark, err := esSyncWatermark(ctx, esPagesIndex)
+	if err != nil {
+		return err
+	}
+
+	var rows *sql.Rows
+	if watermark.IsZero() {
+		rows, err = db.QueryContext(ctx, "SELECT title, url, language, last_updated, content FROM pages ORDER BY last_updated")
+	} else {
+		rows, err = db.QueryContext(ctx, "SELECT title, url, language, last_updated, content FROM pages WHERE last_updated > $1 ORDER BY last_updated",
+			watermark.Add(-esSyncOverlap))
+	}
+	if err != nil {
+		return fmt.Errorf("error querying pages from DB: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var indexed, failed, unrecorded int
+	var indexedAt []time.Time
+	var failedAt time.Time
+	err = bulkIndexRows(ctx, esPagesIndex, rows, func(result esBulkResult) {
+		if result.err != nil {
+			log.Printf("Error syncing page: %v", result.err)
+			failed++
+			if err := recordIndexFailure(ctx, result.page.URL, result.err); err != nil {
+				log.Printf("Error syncing page: %v", err)
+				if unrecorded == 0 || result.page.LastUpdated.Before(failedAt) {
+					failedAt = result.page.LastUpdated
+				}
+				unrecorded++
+			}
+			return
+		}
+		indexed++
+		indexedAt = append(indexedAt, result.page.LastUpdated)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Failed pages are retried from index_failures, but the watermark must stay
+	// below the first one that couldn't be recorded there, so the next sync retries it.
+	newWatermark := watermark
+	for _, lastUpdated := range indexedAt {
+		if (unrecorded == 0 || lastUpdated.Before(failedAt)) && lastUpdated.After(newWatermark) {
+			newWatermark = lastUpdated
+		}
+	}
+
+	if indexed > 0 {
+		if err := refreshIndex(ctx, esPagesIndex); err != nil {
+			return err
+		}
+		invalidateSearchCache(ctx)
+	}
+	if newWatermark.After(watermark) {
+		if err := setESSyncWatermark(ctx, esPagesIndex, newWatermark); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Synced %d pages to Elasticsearch (%d failed, watermark %s)", indexed, failed, newWatermark.Format(time.RFC3339))
+	return nil
+}
+
+// bulkIndexRows indexes the pages read from rows into index with an esBulkIndexer,
+// calling done with the outcome of each page. Pages are read while earlier ones are
+// being indexed.
+func bulkIndexRows(ctx context.Context, index string, rows *sql.Rows, done func(esBulkResult)) error {
+	pages := make(chan Page)
+	var scanErr error
+	go func() {
+		defer close(pages)
+		for rows.Next() {
+			page, err := scanPage(rows)
+			if err != nil {
+				scanErr = fmt.Errorf("error scanning page: %w", err)
+				return
+			}
+			pages <- page
+		}
+		if err := rows.Err(); err != nil {
+			scanErr = fmt.Errorf("error reading pages from DB: %w", err)
+		}
+	}()
+
+	newESBulkIndexer(index).indexPages(ctx, pages, done)
+	return scanErr
+}
+
+// ensurePagesIndex creates the index if it doesn't exist, or else adds any fields
+// missing from its mapping. A new index is created as the first version behind an
+// alias, see reindexElasticsearch. A pages index created before versioning is
+// replaced by a version built from the pages table, as its documents have random
+// IDs that syncs would add a second copy next to. Changing the type of an existing
+// field needs a reindex.
+func ensurePagesIndex(ctx context.Context, index string) error {
+	exists, err := esIndexExists(ctx, index)
+	if err != nil {
+		return err
+	}
+	if exists && index == esPagesIndex {
+		targets, err := esAliasTargets(ctx, index)
+		if err != nil {
+			return err
+		}
+		if len(targets) == 0 {
+			log.Printf("Index %q was created before versioning, replacing it with a versioned index", index)
+			return reindexElasticsearch(ctx, nil)
+		}
+	}
+
+	definition := pagesIndexDefinition()
+	if !exists {
+		versions, err := esIndexVersions(ctx)
+		if err != nil {
+			return err
+		}
+		definition.Aliases = map[string]struct{}{index: {}}
+		return createIndex(ctx, esVersionedIndex(nextIndexVersion(versions)), definition)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+	body, err := esJSONBody(esMappings{Properties: definition.Mappings.Properties})
+	if err != nil {
+		return err
+	}
+	res, err := esClient.Indices.PutMapping([]string{index}, body, esClient.Indices.PutMapping.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error updating mapping: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.IsError() {
+		return fmt.Errorf("error response when updating mapping of index %q: %s", index, res.String())
+	}
+	return nil
+}
+
+// createIndex creates an index from its definition.
+func createIndex(ctx context.Context, index string, definition esIndexDefinition) error {
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+
+	body, err := esJSONBody(definition)
+	if err != nil {
+		return err
+	}
+	res, err := esClient.Indices.Create(index, esClient.Indices.Create.WithBody(body), esClient.Indices.Create.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error creating index: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.IsError() {
+		return fmt.Errorf("error response when creating index %q: %s", index, res.String())
+	}
+	log.Printf("Created index %q", index)
+	return nil
+}
+
+// esSyncWatermark returns the watermark stored in the index, or the zero time if it has none.
+func esSyncWatermark(ctx context.Context, index string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+
+	res, err := esClient.Indices.GetMapping(esClient.Indices.GetMapping.WithIndex(index), esClient.Indices.GetMapping.WithContext(ctx))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading mapping: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.IsError() {
+		return time.Time{}, fmt.Errorf("error response when reading mapping of index %q: %s", index, res.String())
+	}
+
+	// The response is keyed by the name of the index, which differs from index for aliases.
+	var mappings map[string]struct {
+		Mappings esMappings `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&mappings); err != nil {
+		return time.Time{}, err
+	}
+
+	var watermark time.Time
+	for _, m := range mappings {
+		value, ok := m.Mappings.Meta[esWatermarkKey]
+		if !ok {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s in mapping of index %q: %w", esWatermarkKey, index, err)
+		}
+		watermark = parsed
+	}
+	return watermark, nil
+}
+
+// setESSyncWatermark stores the watermark in the mapping of the index.
+func setESSyncWatermark(ctx context.Context, index string, watermark time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+
+	body, err := esJSONBody(esMappings{Meta: map[string]string{esWatermarkKey: watermark.Format(time.RFC3339Nano)}})
+	if err != nil {
+		return err
+	}
+	res, err := esClient.Indices.PutMapping([]string{index}, body, esClient.Indices.PutMapping.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error storing sync watermark: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.IsError() {
+		return fmt.Errorf("error response when storing sync watermark: %s", res.String())
+	}
+	return nil
+}
+
+// refreshIndex makes the documents indexed so far visible to searches.
+func refreshIndex(ctx context.Context, index string) error {
+	ctx, cancel := context.WithTimeout(ctx, esRequestTimeout)
+	defer cancel()
+
+	res, err := esClient.Indices.Refresh(esClient.Indices.Refresh.WithIndex(index), esClient.Indices.Refresh.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error refreshing index: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.IsError() {
+		return fmt.Errorf("error response when refreshing index: %s", res.String())
+	}
+	return nil
+}
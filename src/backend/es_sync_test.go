@@ -0,0 +1,334 @@
+// Unit tests for the incremental Elasticsearch sync
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeES is an Elasticsearch cluster served by useFakeElasticsearch, holding the
+// pages indices and their aliases.
+type fakeES struct {
+	mu      sync.Mutex
+	indices map[string]*fakeESIndex
+	// aliases maps each alias to the index it points to.
+	aliases map[string]string
+	// failURLs are the URLs of pages that fail to index.
+	failURLs map[string]bool
+	// rejections are how many more times pages are rejected with 429, by URL.
+	rejections map[string]int
+	// rejectBulk is how many more bulk requests are rejected with 429 as a whole.
+	rejectBulk int
+	// failCount makes _count answer this many documents less than there are.
+	failCount int
+	requests  []string
+}
+
+type fakeESIndex struct {
+	meta      map[string]string
+	documents map[string]esPageDocument
+	refreshes int
+}
+
+func newFakeES(t *testing.T) *fakeES {
+	es := &fakeES{
+		indices:    make(map[string]*fakeESIndex),
+		aliases:    make(map[string]string),
+		failURLs:   make(map[string]bool),
+		rejections: make(map[string]int),
+	}
+	useFakeElasticsearch(t, es.handle)
+	return es
+}
+
+// createIndex creates an empty index.
+func (f *fakeES) createIndex(name string) *fakeESIndex {
+	index := &fakeESIndex{documents: make(map[string]esPageDocument)}
+	f.indices[name] = index
+	return index
+}
+
+// index returns the index with the given name or alias, or nil if there is none.
+func (f *fakeES) index(name string) *fakeESIndex {
+	if target, ok := f.aliases[name]; ok {
+		name = target
+	}
+	return f.indices[name]
+}
+
+func (f *fakeES) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	index := f.index(name)
+	switch {
+	case name == "_alias":
+		response := make(map[string]interface{})
+		for alias, target := range f.aliases {
+			if alias == action {
+				response[target] = map[string]interface{}{"aliases": map[string]interface{}{alias: struct{}{}}}
+			}
+		}
+		if len(response) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	case name == "_aliases":
+		var update esAliasActions
+		_ = json.Unmarshal(body, &update)
+		for _, actions := range update.Actions {
+			for kind, a := range actions {
+				switch kind {
+				case "add":
+					f.aliases[a.Alias] = a.Index
+				case "remove":
+					if f.aliases[a.Alias] == a.Index {
+						delete(f.aliases, a.Alias)
+					}
+				case "remove_index":
+					delete(f.indices, a.Index)
+				}
+			}
+		}
+		_, _ = io.WriteString(w, `{"acknowledged":true}`)
+	case strings.HasSuffix(name, "*"):
+		response := make(map[string]interface{})
+		for existing := range f.indices {
+			if strings.HasPrefix(existing, strings.TrimSuffix(name, "*")) {
+				response[existing] = struct{}{}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	case action == "" && r.Method == http.MethodHead:
+		if index == nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case action == "" && r.Method == http.MethodPut:
+		var definition esIndexDefinition
+		_ = json.Unmarshal(body, &definition)
+		f.createIndex(name)
+		for alias := range definition.Aliases {
+			f.aliases[alias] = name
+		}
+		_, _ = io.WriteString(w, `{"acknowledged":true}`)
+	case action == "" && r.Method == http.MethodDelete:
+		delete(f.indices, name)
+		for alias, target := range f.aliases {
+			if target == name {
+				delete(f.aliases, alias)
+			}
+		}
+		_, _ = io.WriteString(w, `{"acknowledged":true}`)
+	case index == nil:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, `{"error":{"type":"index_not_found_exception"}}`)
+	case action == "_mapping" && r.Method == http.MethodGet:
+		concrete := name
+		if target, ok := f.aliases[name]; ok {
+			concrete = target
+		}
+		response, _ := json.Marshal(map[string]interface{}{concrete: map[string]interface{}{"mappings": esMappings{Meta: index.meta}}})
+		_, _ = w.Write(response)
+	case action == "_mapping" && r.Method == http.MethodPut:
+		var mappings esMappings
+		_ = json.Unmarshal(body, &mappings)
+		if mappings.Meta != nil {
+			index.meta = mappings.Meta
+		}
+		_, _ = io.WriteString(w, `{"acknowledged":true}`)
+	case action == "_refresh":
+		index.refreshes++
+		_, _ = io.WriteString(w, `{}`)
+	case action == "_count":
+		_, _ = fmt.Fprintf(w, `{"count":%d}`, len(index.documents)-f.failCount)
+	case action == "_search":
+		f.search(w, index, body)
+	case strings.HasPrefix(action, "_doc/") && r.Method == http.MethodDelete:
+		id := strings.TrimPrefix(action, "_doc/")
+		if _, ok := index.documents[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		delete(index.documents, id)
+		_, _ = io.WriteString(w, `{"result":"deleted"}`)
+	case action == "_bulk":
+		if f.rejectBulk > 0 {
+			f.rejectBulk--
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = io.WriteString(w, `{"error":{"type":"es_rejected_execution_exception"}}`)
+			return
+		}
+		f.bulk(w, index, body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// search answers the searches of scanPageDocuments.
+func (f *fakeES) search(w http.ResponseWriter, index *fakeESIndex, body []byte) {
+	var scan esScanBody
+	_ = json.Unmarshal(body, &scan)
+	var hits []esScannedDocument
+	for id, doc := range index.documents {
+		if len(scan.SearchAfter) == 0 || doc.URL > scan.SearchAfter[0] {
+			hits = append(hits, esScannedDocument{ID: id, Source: doc})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Source.URL != hits[j].Source.URL {
+			return hits[i].Source.URL < hits[j].Source.URL
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	if len(hits) > scan.Size {
+		hits = hits[:scan.Size]
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"hits": map[string]interface{}{"hits": hits}})
+}
+
+// bulk answers a bulk request of index actions.
+func (f *fakeES) bulk(w http.ResponseWriter, index *fakeESIndex, body []byte) {
+	var items []map[string]esBulkStatus
+	errors := false
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	for i := 0; i+1 < len(lines); i += 2 {
+		var action map[string]map[string]string
+		var doc esPageDocument
+		_ = json.Unmarshal([]byte(lines[i]), &action)
+		_ = json.Unmarshal([]byte(lines[i+1]), &doc)
+		id := action["index"]["_id"]
+
+		status := esBulkStatus{ID: id, Status: http.StatusCreated}
+		switch {
+		case f.rejections[doc.URL] > 0:
+			f.rejections[doc.URL]--
+			status.Status = http.StatusTooManyRequests
+		case f.failURLs[doc.URL]:
+			status.Status = http.StatusBadRequest
+		default:
+			index.documents[id] = doc
+		}
+		if status.Status != http.StatusCreated {
+			errors = true
+			status.Error = &esBulkError{Type: "mapper_parsing_exception", Reason: http.StatusText(status.Status)}
+		}
+		items = append(items, map[string]esBulkStatus{"index": status})
+	}
+	response, _ := json.Marshal(esBulkResponse{Errors: errors, Items: items})
+	_, _ = w.Write(response)
+}
+
+func TestSyncPagesToElasticsearch(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	es := newFakeES(t)
+
+	t1 := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	t3 := t2.Add(time.Hour)
+	columns := []string{"title", "url", "language", "last_updated", "content"}
+
+	// The first sync creates the index and indexes every page.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT title, url, language, last_updated, content FROM pages ORDER BY last_updated")).
+		WithoutArgs().
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("Go", "https://en.wikipedia.org/wiki/Go", "en", t1, "Go is a language").
+			AddRow("Rust", "https://en.wikipedia.org/wiki/Rust", "en", t2, "Rust is a language"))
+
+	require.NoError(t, syncPagesToElasticsearch())
+	assert.Contains(t, es.requests, "PUT /pages_v1", "the index is created as the first version")
+	assert.Equal(t, "pages_v1", es.aliases[esPagesIndex])
+	index := es.index(esPagesIndex)
+	assert.Len(t, index.documents, 2)
+	doc := index.documents[pageDocumentID("https://en.wikipedia.org/wiki/Go")]
+	assert.Equal(t, "en", doc.Language)
+	assert.Equal(t, "2025-05-01T12:00:00Z", doc.LastUpdated)
+	assert.Equal(t, 1, index.refreshes)
+	assert.Contains(t, es.requests, "POST /pages/_bulk", "pages are indexed in bulk")
+	assert.Equal(t, t2.Format(time.RFC3339Nano), index.meta[esWatermarkKey])
+
+	// The next sync only reads pages updated since the watermark, and keeps
+	// the watermark below pages that failed to index and couldn't be recorded
+	// in index_failures.
+	es.requests = nil
+	es.failURLs["https://en.wikipedia.org/wiki/Zig"] = true
+	changedRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).
+			AddRow("Rust", "https://en.wikipedia.org/wiki/Rust", "en", t2, "Rust is a systems language").
+			AddRow("Zig", "https://en.wikipedia.org/wiki/Zig", "en", t3, "Zig is a language").
+			AddRow("Odin", "https://en.wikipedia.org/wiki/Odin", "en", t3.Add(time.Hour), "Odin is a language")
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT title, url, language, last_updated, content FROM pages WHERE last_updated > $1 ORDER BY last_updated")).
+		WithArgs(t2.Add(-esSyncOverlap)).
+		WillReturnRows(changedRows())
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO index_failures")).
+		WithArgs("https://en.wikipedia.org/wiki/Zig", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnError(errors.New("connection reset"))
+
+	require.NoError(t, syncPagesToElasticsearch())
+	assert.NotContains(t, es.requests, "PUT /pages_v2", "the existing index is kept")
+	assert.Contains(t, es.requests, "PUT /pages/_mapping", "new fields are added to the mapping")
+	assert.Len(t, index.documents, 3, "updated pages overwrite their document")
+	assert.Equal(t, "Rust is a systems language", index.documents[pageDocumentID("https://en.wikipedia.org/wiki/Rust")].Content)
+	assert.Equal(t, t2.Format(time.RFC3339Nano), index.meta[esWatermarkKey])
+
+	// Once the failure is recorded, the watermark moves past it.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT title, url, language, last_updated, content FROM pages WHERE last_updated > $1 ORDER BY last_updated")).
+		WithArgs(t2.Add(-esSyncOverlap)).
+		WillReturnRows(changedRows())
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO index_failures")).
+		WithArgs("https://en.wikipedia.org/wiki/Zig", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	require.NoError(t, syncPagesToElasticsearch())
+	assert.Equal(t, t3.Add(time.Hour).Format(time.RFC3339Nano), index.meta[esWatermarkKey])
+
+	// Nothing changed, so nothing is refreshed.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT title, url, language, last_updated, content FROM pages WHERE last_updated > $1")).
+		WithArgs(t3.Add(time.Hour).Add(-esSyncOverlap)).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	require.NoError(t, syncPagesToElasticsearch())
+	assert.Equal(t, 3, index.refreshes)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSyncPagesToUnversionedIndex(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	es := newFakeES(t)
+	lastUpdated := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// A pages index from before versioning holds documents under random IDs, which
+	// are replaced by a version keyed by pageDocumentID before syncing.
+	legacy := es.createIndex(esPagesIndex)
+	legacy.documents["Xy3kq"] = esPageDocument{Title: "Go", URL: "https://en.wikipedia.org/wiki/Go"}
+	expectReindexQueries(mock, 2, lastUpdated)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT title, url, language, last_updated, content FROM pages WHERE last_updated > $1 ORDER BY last_updated")).
+		WithArgs(lastUpdated.Add(-esSyncOverlap)).
+		WillReturnRows(sqlmock.NewRows([]string{"title", "url", "language", "last_updated", "content"}))
+
+	require.NoError(t, syncPagesToElasticsearch())
+	assert.Equal(t, "pages_v1", es.aliases[esPagesIndex])
+	assert.NotContains(t, es.indices, esPagesIndex)
+	index := es.index(esPagesIndex)
+	assert.Len(t, index.documents, 2)
+	assert.Contains(t, index.documents, pageDocumentID("https://en.wikipedia.org/wiki/Go"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Pages that fail to index into Elasticsearch are recorded in the index_failures
+// table, one row per page with its last error and how many times it has failed.
+// retryIndexFailures indexes them again with exponential backoff until they
+// succeed or have failed indexFailureMaxAttempts times; after that they stay until
+// an admin replays them from /admin/index-failures or with `replay-failures`.
+
+const (
+	// indexFailureMaxAttempts is how many times a page may fail before it is only
+	// retried when replayed by hand.
+	indexFailureMaxAttempts = 8
+	// indexFailureInitialBackoff is the wait before the first retry of a failed
+	// page. It doubles with every further failure, up to indexFailureMaxBackoff.
+	indexFailureInitialBackoff = time.Minute
+	indexFailureMaxBackoff     = 6 * time.Hour
+	// indexFailureRetryBatchSize is the number of due pages retried per run.
+	indexFailureRetryBatchSize = 500
+	// indexFailuresListed caps the failures listed by listIndexFailures.
+	indexFailuresListed = 500
+)
+
+// errIndexFailureRetryRunning is returned by retryIndexFailures while another retry is going.
+var errIndexFailureRetryRunning = errors.New("an index failure retry is already running")
+
+// indexFailureRetryMu makes retries take turns, as one may outlast the cron interval.
+var indexFailureRetryMu sync.Mutex
+
+// IndexFailure is a row of the index_failures table.
+type IndexFailure struct {
+	URL           string    `json:"url"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastFailedAt  time.Time `json:"last_failed_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+// GaveUp tells whether the page is no longer retried automatically.
+func (f IndexFailure) GaveUp() bool {
+	return f.Attempts >= indexFailureMaxAttempts
+}
+
+// IndexFailureReplay is the outcome of indexing failed pages again.
+type IndexFailureReplay struct {
+	// Indexed pages were indexed and removed from the failures.
+	Indexed int `json:"indexed"`
+	// Failed pages failed again and were recorded with one more attempt.
+	Failed int `json:"failed"`
+	// Removed pages no longer exist, so their failures were removed.
+	Removed int `json:"removed"`
+}
+
+// recordIndexFailure records that the page failed to index because of cause and
+// schedules its next retry.
+func recordIndexFailure(ctx context.Context, url string, cause error) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO index_failures (url, error, attempts, first_failed_at, last_failed_at, next_attempt_at)
+		VALUES ($1, $2, 1, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP + $3 * INTERVAL '1 second')
+		ON CONFLICT (url) DO UPDATE SET
+			error = EXCLUDED.error,
+			attempts = index_failures.attempts + 1,
+			last_failed_at = EXCLUDED.last_failed_at,
+			next_attempt_at = CURRENT_TIMESTAMP + LEAST($3 * power(2, index_failures.attempts), $4) * INTERVAL '1 second'`,
+		url, cause.Error(), indexFailureInitialBackoff.Seconds(), indexFailureMaxBackoff.Seconds())
+	if err != nil {
+		return fmt.Errorf("error recording index failure of %s: %w", url, err)
+	}
+	indexFailuresTotal.WithLabelValues("recorded").Inc()
+	return nil
+}
+
+// listIndexFailures returns the most recent failures, newest first.
+func listIndexFailures(ctx context.Context) ([]IndexFailure, error) {
+	rows, err := db.QueryContext(ctx, `SELECT url, error, attempts, first_failed_at, last_failed_at, next_attempt_at
+		FROM index_failures ORDER BY last_failed_at DESC LIMIT $1`, indexFailuresListed)
+	if err != nil {
+		return nil, fmt.Errorf("error querying index failures: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	failures := []IndexFailure{}
+	for rows.Next() {
+		var f IndexFailure
+		if err := rows.Scan(&f.URL, &f.Error, &f.Attempts, &f.FirstFailedAt, &f.LastFailedAt, &f.NextAttemptAt); err != nil {
+			return nil, fmt.Errorf("error scanning index failure: %w", err)
+		}
+		failures = append(failures, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading index failures: %w", err)
+	}
+	return failures, nil
+}
+
+// retryIndexFailures indexes the failed pages whose next retry is due.
+func retryIndexFailures(ctx context.Context) (IndexFailureReplay, error) {
+	if !indexFailureRetryMu.TryLock() {
+		return IndexFailureReplay{}, errIndexFailureRetryRunning
+	}
+	defer indexFailureRetryMu.Unlock()
+
+	urls, err := queryURLs(ctx, `SELECT url FROM index_failures
+		WHERE attempts < $1 AND next_attempt_at <= CURRENT_TIMESTAMP ORDER BY next_attempt_at LIMIT $2`,
+		indexFailureMaxAttempts, indexFailureRetryBatchSize)
+	if err != nil {
+		return IndexFailureReplay{}, err
+	}
+	return replayIndexFailures(ctx, urls)
+}
+
+// replayAllIndexFailures indexes every failed page again, including those that
+// are no longer retried automatically.
+func replayAllIndexFailures(ctx context.Context) (IndexFailureReplay, error) {
+	urls, err := queryURLs(ctx, "SELECT url FROM index_failures ORDER BY url")
+	if err != nil {
+		return IndexFailureReplay{}, err
+	}
+	return replayIndexFailures(ctx, urls)
+}
+
+func queryURLs(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying index failures: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, fmt.Errorf("error scanning index failure: %w", err)
+		}
+		urls = append(urls, url)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading index failures: %w", err)
+	}
+	return urls, nil
+}
+
+// replayIndexFailures indexes the current rows of the pages with the given URLs,
+// and deletes the documents of those that no longer exist. Pages that index or
+// are deleted are removed from the failures; pages that fail again are recorded
+// with one more attempt.
+func replayIndexFailures(ctx context.Context, urls []string) (IndexFailureReplay, error) {
+	var replay IndexFailureReplay
+	if len(urls) == 0 {
+		return replay, nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT title, url, language, last_updated, content FROM pages WHERE url = ANY($1)", pq.Array(urls))
+	if err != nil {
+		return replay, fmt.Errorf("error querying pages from DB: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	seen := make(map[string]bool)
+	var resolved []string
+	err = bulkIndexRows(ctx, esPagesIndex, rows, func(result esBulkResult) {
+		seen[result.page.URL] = true
+		if result.err != nil {
+			replay.Failed++
+			if err := recordIndexFailure(ctx, result.page.URL, result.err); err != nil {
+				log.Printf("Error replaying page: %v (%v)", result.err, err)
+			}
+			return
+		}
+		replay.Indexed++
+		resolved = append(resolved, result.page.URL)
+	})
+	if err != nil {
+		return replay, err
+	}
+	// Pages that no longer exist failed to be deleted, so their documents are deleted now.
+	backend := &elasticsearchBackend{index: esPagesIndex}
+	for _, url := range urls {
+		if seen[url] {
+			continue
+		}
+		if err := backend.Delete(ctx, url); err != nil {
+			replay.Failed++
+			if err := recordIndexFailure(ctx, url, err); err != nil {
+				log.Printf("Error replaying page: %v", err)
+			}
+			continue
+		}
+		replay.Removed++
+		resolved = append(resolved, url)
+	}
+
+	if len(resolved) > 0 {
+		if _, err := db.ExecContext(ctx, "DELETE FROM index_failures WHERE url = ANY($1)", pq.Array(resolved)); err != nil {
+			return replay, fmt.Errorf("error removing resolved index failures: %w", err)
+		}
+		indexFailuresTotal.WithLabelValues("resolved").Add(float64(len(resolved)))
+	}
+	if replay.Indexed > 0 || replay.Removed > 0 {
+		if err := refreshIndex(ctx, esPagesIndex); err != nil {
+			return replay, err
+		}
+		invalidateSearchCache(ctx)
+	}
+	log.Printf("Replayed %d failed pages: %d indexed, %d failed again, %d no longer exist", len(urls), replay.Indexed, replay.Failed, replay.Removed)
+	return replay, nil
+}
+
+// printIndexFailures writes failures as a table.
+func printIndexFailures(w io.Writer, failures []IndexFailure) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "URL\tATTEMPTS\tLAST FAILED\tNEXT ATTEMPT\tERROR")
+	for _, f := range failures {
+		next := f.NextAttemptAt.Format(time.RFC3339)
+		if f.GaveUp() {
+			next = "gave up"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", f.URL, f.Attempts, f.LastFailedAt.Format(time.RFC3339), next, f.Error)
+	}
+	return tw.Flush()
+}
+
+// indexFailuresHandler serves the admin page listing the pages that failed to index.
+func indexFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	renderIndexFailuresPage(w, r, http.StatusOK, "")
+}
+
+// apiIndexFailuresHandler serves the failures as JSON.
+func apiIndexFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	failures, err := listIndexFailures(r.Context())
+	if err != nil {
+		log.Printf("Error listing index failures: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "could not list index failures")
+		return
+	}
+	writeJSON(w, http.StatusOK, failures)
+}
+
+// apiReplayIndexFailuresHandler replays the pages named by the url form values,
+// or every failed page if there are none, and shows the admin page again.
+func apiReplayIndexFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	if esClient == nil {
+		renderIndexFailuresPage(w, r, http.StatusServiceUnavailable, "Elasticsearch is not in use")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		renderIndexFailuresPage(w, r, http.StatusBadRequest, "Invalid form")
+		return
+	}
+
+	var replay IndexFailureReplay
+	var err error
+	if urls := r.PostForm["url"]; len(urls) > 0 {
+		replay, err = replayIndexFailures(r.Context(), urls)
+	} else {
+		replay, err = replayAllIndexFailures(r.Context())
+	}
+	if err != nil {
+		log.Printf("Error replaying index failures: %v", err)
+		renderIndexFailuresPage(w, r, http.StatusInternalServerError, "Replay failed: "+err.Error())
+		return
+	}
+	renderIndexFailuresPage(w, r, http.StatusOK,
+		fmt.Sprintf("Indexed %d pages, %d failed again and %d no longer exist.", replay.Indexed, replay.Failed, replay.Removed))
+}
+
+func renderIndexFailuresPage(w http.ResponseWriter, r *http.Request, status int, message string) {
+	data := map[string]interface{}{
+		"Title":        "Index failures",
+		"UserLoggedIn": true,
+		"Message":      message,
+	}
+	failures, err := listIndexFailures(r.Context())
+	if err != nil {
+		log.Printf("Error listing index failures: %v", err)
+		status = http.StatusInternalServerError
+		data["Error"] = "Could not list index failures"
+	}
+	data["Failures"] = failures
+
+	tmpl, err := loadTemplates("layout.html", "indexFailures.html")
+	if err != nil {
+		log.Printf("Error parsing templates: %v", err)
+		http.Error(w, "Error loading templates", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	if err := tmpl.ExecuteTemplate(w, "layout.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+// Unit tests for the dead-letter queue of pages that failed to index
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	selectFailedPagesQuery    = "SELECT title, url, language, last_updated, content FROM pages WHERE url = ANY($1)"
+	deleteIndexFailuresQuery  = "DELETE FROM index_failures WHERE url = ANY($1)"
+	selectIndexFailuresQuery  = "SELECT url, error, attempts, first_failed_at, last_failed_at, next_attempt_at FROM index_failures"
+	indexFailureRecordedQuery = "INSERT INTO index_failures"
+)
+
+var indexFailureColumns = []string{"url", "error", "attempts", "first_failed_at", "last_failed_at", "next_attempt_at"}
+
+func TestRecordIndexFailure(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+
+	mock.ExpectExec(regexp.QuoteMeta(indexFailureRecordedQuery)).
+		WithArgs("https://en.wikipedia.org/wiki/Go", "mapper_parsing_exception: failed to parse", 60.0, 21600.0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, recordIndexFailure(context.Background(), "https://en.wikipedia.org/wiki/Go", errors.New("mapper_parsing_exception: failed to parse")))
+
+	mock.ExpectExec(regexp.QuoteMeta(indexFailureRecordedQuery)).WillReturnError(errors.New("connection reset"))
+	assert.Error(t, recordIndexFailure(context.Background(), "https://en.wikipedia.org/wiki/Go", errors.New("timeout")))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReplayIndexFailures(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	es := newFakeES(t)
+	index := es.createIndex("pages_v1")
+	es.aliases[esPagesIndex] = "pages_v1"
+	es.failURLs["https://en.wikipedia.org/wiki/Zig"] = true
+	lastUpdated := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Go indexes, Zig fails again and Odin has been deleted since it failed.
+	urls := []string{"https://en.wikipedia.org/wiki/Go", "https://en.wikipedia.org/wiki/Zig", "https://en.wikipedia.org/wiki/Odin"}
+	mock.ExpectQuery(regexp.QuoteMeta(selectFailedPagesQuery)).
+		WithArgs(pq.Array(urls)).
+		WillReturnRows(sqlmock.NewRows(pageColumns).
+			AddRow("Go", "https://en.wikipedia.org/wiki/Go", "en", lastUpdated, "Go is a language").
+			AddRow("Zig", "https://en.wikipedia.org/wiki/Zig", "en", lastUpdated, "Zig is a language"))
+	mock.ExpectExec(regexp.QuoteMeta(indexFailureRecordedQuery)).
+		WithArgs("https://en.wikipedia.org/wiki/Zig", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(deleteIndexFailuresQuery)).
+		WithArgs(pq.Array([]string{"https://en.wikipedia.org/wiki/Go", "https://en.wikipedia.org/wiki/Odin"})).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	replay, err := replayIndexFailures(context.Background(), urls)
+	require.NoError(t, err)
+	assert.Equal(t, IndexFailureReplay{Indexed: 1, Failed: 1, Removed: 1}, replay)
+	assert.Contains(t, index.documents, pageDocumentID("https://en.wikipedia.org/wiki/Go"))
+	assert.NotContains(t, index.documents, pageDocumentID("https://en.wikipedia.org/wiki/Zig"))
+	assert.Equal(t, 1, index.refreshes)
+
+	// Nothing to replay, nothing to do.
+	replay, err = replayIndexFailures(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Zero(t, replay)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRetryIndexFailures(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	es := newFakeES(t)
+	index := es.createIndex("pages_v1")
+	es.aliases[esPagesIndex] = "pages_v1"
+
+	// Only failures that are due and haven't run out of attempts are retried.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT url FROM index_failures WHERE attempts < $1 AND next_attempt_at <= CURRENT_TIMESTAMP")).
+		WithArgs(indexFailureMaxAttempts, indexFailureRetryBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"url"}).AddRow("https://en.wikipedia.org/wiki/Go"))
+	mock.ExpectQuery(regexp.QuoteMeta(selectFailedPagesQuery)).
+		WithArgs(pq.Array([]string{"https://en.wikipedia.org/wiki/Go"})).
+		WillReturnRows(sqlmock.NewRows(pageColumns).
+			AddRow("Go", "https://en.wikipedia.org/wiki/Go", "en", time.Now(), "Go is a language"))
+	mock.ExpectExec(regexp.QuoteMeta(deleteIndexFailuresQuery)).
+		WithArgs(pq.Array([]string{"https://en.wikipedia.org/wiki/Go"})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	replay, err := retryIndexFailures(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, IndexFailureReplay{Indexed: 1}, replay)
+	assert.Len(t, index.documents, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Retries take turns.
+	indexFailureRetryMu.Lock()
+	_, err = retryIndexFailures(context.Background())
+	indexFailureRetryMu.Unlock()
+	assert.ErrorIs(t, err, errIndexFailureRetryRunning)
+}
+
+func TestIndexFailuresHandlers(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	failedAt := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	failureRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(indexFailureColumns).
+			AddRow("https://en.wikipedia.org/wiki/Go", "mapper_parsing_exception: failed to parse", 2, failedAt, failedAt, failedAt.Add(2*time.Minute)).
+			AddRow("https://en.wikipedia.org/wiki/Zig", "timeout", indexFailureMaxAttempts, failedAt, failedAt, failedAt.Add(time.Hour))
+	}
+
+	t.Run("json", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(selectIndexFailuresQuery)).WithArgs(indexFailuresListed).WillReturnRows(failureRows())
+		w := httptest.NewRecorder()
+		apiIndexFailuresHandler(w, httptest.NewRequest(http.MethodGet, "/api/admin/index-failures", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var failures []IndexFailure
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&failures))
+		require.Len(t, failures, 2)
+		assert.Equal(t, 2, failures[0].Attempts)
+		assert.True(t, failures[1].GaveUp())
+	})
+
+	t.Run("page", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(selectIndexFailuresQuery)).WillReturnRows(failureRows())
+		w := httptest.NewRecorder()
+		indexFailuresHandler(w, httptest.NewRequest(http.MethodGet, "/admin/index-failures", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "https://en.wikipedia.org/wiki/Go")
+		assert.Contains(t, w.Body.String(), "mapper_parsing_exception")
+		assert.Contains(t, w.Body.String(), "Gave up")
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		es := newFakeES(t)
+		es.createIndex("pages_v1")
+		es.aliases[esPagesIndex] = "pages_v1"
+		mock.ExpectQuery(regexp.QuoteMeta(selectFailedPagesQuery)).
+			WithArgs(pq.Array([]string{"https://en.wikipedia.org/wiki/Zig"})).
+			WillReturnRows(sqlmock.NewRows(pageColumns).
+				AddRow("Zig", "https://en.wikipedia.org/wiki/Zig", "en", failedAt, "Zig is a language"))
+		mock.ExpectExec(regexp.QuoteMeta(deleteIndexFailuresQuery)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta(selectIndexFailuresQuery)).WillReturnRows(sqlmock.NewRows(indexFailureColumns))
+
+		form := url.Values{"url": {"https://en.wikipedia.org/wiki/Zig"}}
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/index-failures/replay", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		apiReplayIndexFailuresHandler(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "Indexed 1 pages, 0 failed again and 0 no longer exist.")
+		assert.Contains(t, w.Body.String(), "Every page is indexed.")
+	})
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPrintIndexFailures(t *testing.T) {
+	failedAt := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out bytes.Buffer
+	require.NoError(t, printIndexFailures(&out, []IndexFailure{
+		{URL: "https://en.wikipedia.org/wiki/Go", Error: "timeout", Attempts: 1, LastFailedAt: failedAt, NextAttemptAt: failedAt.Add(time.Minute)},
+		{URL: "https://en.wikipedia.org/wiki/Zig", Error: "timeout", Attempts: indexFailureMaxAttempts, LastFailedAt: failedAt},
+	}))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], "URL"))
+	assert.Contains(t, lines[1], "2025-05-01T12:01:00Z")
+	assert.Contains(t, lines[2], "gave up")
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters, the same as Elasticsearch's defaults.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// titleWeight is how many content terms a term in a page title counts as.
+const titleWeight = 3
+
+// invertedIndexVersion is stored in index files; files with another version are rebuilt.
+const invertedIndexVersion = 2
+
+// stemLanguages are the languages terms are stemmed in. Pages in any other
+// language are indexed under the "" language, without stemming.
+var stemLanguages = []string{"da", "en", ""}
+
+func stemLanguage(lang string) string {
+	if lang == "da" || lang == "en" {
+		return lang
+	}
+	return ""
+}
+
+// indexedPage is a page in the inverted index.
+type indexedPage struct {
+	Page
+	// TitleTerms and Terms are the number of terms in the title and in the whole page.
+	// Title terms have positions below TitleTerms, content terms positions above it.
+	TitleTerms int
+	Terms      int
+}
+
+// invertedIndex is an in-memory inverted index of pages, scored with BM25.
+// Terms are stemmed in the language of their page.
+type invertedIndex struct {
+	mu sync.RWMutex
+	// pages are the indexed pages by URL.
+	pages map[string]*indexedPage
+	// postings are the positions of every stemmed term, by page URL.
+	postings   map[string]map[string][]int
+	totalTerms int
+	// words are the unstemmed words of all pages, for spelling corrections.
+	words vocabulary
+}
+
+// invertedIndexFile is the on-disk form of an invertedIndex.
+type invertedIndexFile struct {
+	Version  int
+	Pages    map[string]*indexedPage
+	Postings map[string]map[string][]int
+	Words    vocabulary
+}
+
+// scoredPage is a page matched by an index search.
+type scoredPage struct {
+	page  *indexedPage
+	score float64
+}
+
+func newInvertedIndex() *invertedIndex {
+	return &invertedIndex{
+		pages:    make(map[string]*indexedPage),
+		postings: make(map[string]map[string][]int),
+		words:    make(vocabulary),
+	}
+}
+
+// tokenize splits text into lower-case words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// stemAll stems every word in lang.
+func stemAll(words []string, lang string) []string {
+	stems := make([]string, len(words))
+	for i, word := range words {
+		stems[i] = stemWord(word, lang)
+	}
+	return stems
+}
+
+// pageTerms returns the stemmed terms of a page's title and content, and the number of title terms.
+func pageTerms(page Page) ([]string, int) {
+	lang := stemLanguage(page.Language)
+	title := stemAll(tokenize(page.Title), lang)
+	return append(title, stemAll(tokenize(page.Content), lang)...), len(title)
+}
+
+// add indexes page, replacing any page with the same URL.
+func (idx *invertedIndex) add(page Page) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(page.URL)
+
+	terms, titleTerms := pageTerms(page)
+	for i, term := range terms {
+		pos := i
+		if i >= titleTerms {
+			pos++ // leave a gap after the title so phrases never span title and content
+		}
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[string][]int)
+		}
+		idx.postings[term][page.URL] = append(idx.postings[term][page.URL], pos)
+	}
+	idx.pages[page.URL] = &indexedPage{Page: page, TitleTerms: titleTerms, Terms: len(terms)}
+	idx.totalTerms += len(terms)
+	idx.words.addPage(page)
+}
+
+// remove removes the page with the given URL, if it is indexed.
+func (idx *invertedIndex) remove(url string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(url)
+}
+
+func (idx *invertedIndex) removeLocked(url string) {
+	page, ok := idx.pages[url]
+	if !ok {
+		return
+	}
+	terms, _ := pageTerms(page.Page)
+	for _, term := range terms {
+		delete(idx.postings[term], url)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.pages, url)
+	idx.totalTerms -= page.Terms
+	idx.words.removePage(page.Page)
+}
+
+// page returns the indexed page with the given URL.
+func (idx *invertedIndex) page(url string) (Page, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	page, ok := idx.pages[url]
+	if !ok {
+		return Page{}, false
+	}
+	return page.Page, true
+}
+
+// len returns the number of indexed pages.
+func (idx *invertedIndex) len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.pages)
+}
+
+// titlesWithPrefix returns up to n distinct titles starting with prefix, ignoring case, in order.
+func (idx *invertedIndex) titlesWithPrefix(prefix string, n int) []string {
+	prefix = strings.ToLower(prefix)
+
+	idx.mu.RLock()
+	seen := make(map[string]bool)
+	var titles []string
+	for _, page := range idx.pages {
+		if !seen[page.Title] && strings.HasPrefix(strings.ToLower(page.Title), prefix) {
+			seen[page.Title] = true
+			titles = append(titles, page.Title)
+		}
+	}
+	idx.mu.RUnlock()
+
+	sort.Strings(titles)
+	if len(titles) > n {
+		titles = titles[:n]
+	}
+	return titles
+}
+
+// corrections returns a correction for every misspelled word in words that has one.
+func (idx *invertedIndex) corrections(words []string) map[string]string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.words.corrections(words)
+}
+
+// search returns the pages matching a parsed query, best first. Pages are scored
+// with BM25 on the query's positive words and phrases.
+func (idx *invertedIndex) search(query queryNode) []scoredPage {
+	texts := positiveText(query)
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var matches []scoredPage
+	for _, lang := range stemLanguages {
+		var stems []string
+		for _, text := range texts {
+			stems = append(stems, stemAll(tokenize(text.Text), lang)...)
+		}
+
+		for url := range idx.candidatesLocked(query, stems, lang) {
+			page := idx.pages[url]
+			if idx.matchesLocked(query, page, lang) {
+				matches = append(matches, scoredPage{page: page, score: idx.scoreLocked(page, stems)})
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].page.Title < matches[j].page.Title
+	})
+	return matches
+}
+
+// candidatesLocked returns the URLs of the pages in lang that can match the query: those
+// containing any of its stems or, if the query can match pages without them, all pages.
+func (idx *invertedIndex) candidatesLocked(query queryNode, stems []string, lang string) map[string]bool {
+	candidates := make(map[string]bool)
+	if !requiresText(query) {
+		for url, page := range idx.pages {
+			if stemLanguage(page.Language) == lang {
+				candidates[url] = true
+			}
+		}
+		return candidates
+	}
+
+	for _, stem := range stems {
+		for url := range idx.postings[stem] {
+			if stemLanguage(idx.pages[url].Language) == lang {
+				candidates[url] = true
+			}
+		}
+	}
+	return candidates
+}
+
+// matchesLocked reports whether a page in lang matches the query. A word that
+// tokenizes into several terms, like "e-mail", matches as a phrase.
+func (idx *invertedIndex) matchesLocked(node queryNode, page *indexedPage, lang string) bool {
+	switch n := node.(type) {
+	case queryAnd:
+		for _, clause := range n.Clauses {
+			if !idx.matchesLocked(clause, page, lang) {
+				return false
+			}
+		}
+		return true
+	case queryOr:
+		for _, clause := range n.Clauses {
+			if idx.matchesLocked(clause, page, lang) {
+				return true
+			}
+		}
+		return false
+	case queryNot:
+		return !idx.matchesLocked(n.Clause, page, lang)
+	case queryText:
+		stems := stemAll(tokenize(n.Text), lang)
+		return len(stems) > 0 && idx.containsPhraseLocked(page.URL, stems)
+	case querySite:
+		return pageHost(page.URL) == n.Host
+	case queryLanguage:
+		return page.Language == n.Language
+	case queryDate:
+		return page.LastUpdated.Before(n.Date) == n.Before
+	}
+	return false
+}
+
+// containsPhraseLocked reports whether the page contains the stems as consecutive terms.
+func (idx *invertedIndex) containsPhraseLocked(url string, phrase []string) bool {
+	first := idx.postings[phrase[0]][url]
+	for _, start := range first {
+		found := true
+		for i, stem := range phrase[1:] {
+			positions := idx.postings[stem][url]
+			j := sort.SearchInts(positions, start+i+1)
+			if j == len(positions) || positions[j] != start+i+1 {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// scoreLocked is the BM25 score of a page for the stems, with title terms weighted by titleWeight.
+func (idx *invertedIndex) scoreLocked(page *indexedPage, stems []string) float64 {
+	n := float64(len(idx.pages))
+	avgTerms := float64(idx.totalTerms) / n
+	if avgTerms == 0 {
+		avgTerms = 1
+	}
+	norm := bm25K1 * (1 - bm25B + bm25B*float64(page.Terms)/avgTerms)
+
+	var score float64
+	for _, stem := range stems {
+		positions := idx.postings[stem][page.URL]
+		if len(positions) == 0 {
+			continue
+		}
+		// Positions are sorted, so the title positions come first.
+		titleCount := sort.SearchInts(positions, page.TitleTerms)
+		tf := float64(titleWeight*titleCount + len(positions) - titleCount)
+
+		df := float64(len(idx.postings[stem]))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		score += idf * tf * (bm25K1 + 1) / (tf + norm)
+	}
+	return score
+}
+
+// save writes the index to path, replacing the file atomically.
+func (idx *invertedIndex) save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	idx.mu.RLock()
+	err = gob.NewEncoder(tmp).Encode(invertedIndexFile{
+		Version:  invertedIndexVersion,
+		Pages:    idx.pages,
+		Postings: idx.postings,
+		Words:    idx.words,
+	})
+	idx.mu.RUnlock()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing search index: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadInvertedIndex reads an index written by save.
+func loadInvertedIndex(path string) (*invertedIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var file invertedIndexFile
+	if err := gob.NewDecoder(f).Decode(&file); err != nil {
+		return nil, fmt.Errorf("error reading search index: %v", err)
+	}
+	if file.Version != invertedIndexVersion {
+		return nil, fmt.Errorf("search index version %d, expected %d", file.Version, invertedIndexVersion)
+	}
+
+	idx := newInvertedIndex()
+	for url, page := range file.Pages {
+		idx.pages[url] = page
+		idx.totalTerms += page.Terms
+	}
+	for term, postings := range file.Postings {
+		idx.postings[term] = postings
+	}
+	for word, count := range file.Words {
+		idx.words[word] = count
+	}
+	return idx, nil
+}
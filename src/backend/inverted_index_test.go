@@ -0,0 +1,201 @@
+// Unit tests for the embedded inverted index and its stemmers
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStemWord(t *testing.T) {
+	tests := []struct {
+		word     string
+		lang     string
+		expected string
+	}{
+		{"running", "en", "run"},
+		{"hopping", "en", "hop"},
+		{"hoping", "en", "hope"},
+		{"ponies", "en", "poni"},
+		{"ties", "en", "tie"},
+		{"caresses", "en", "caress"},
+		{"generously", "en", "generous"},
+		{"connection", "en", "connect"},
+		{"relational", "en", "relat"},
+		{"programming", "en", "program"},
+		{"cry", "en", "cri"},
+		{"go", "en", "go"},
+		{"bilerne", "da", "bil"},
+		{"huset", "da", "hus"},
+		{"husene", "da", "hus"},
+		{"hestene", "da", "hest"},
+		{"sprogene", "da", "sprog"},
+		{"hurtigst", "da", "hurt"},
+		{"undersøgelser", "da", "undersøg"},
+		{"kærlighed", "da", "kær"},
+		{"running", "de", "running"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lang+"/"+tt.word, func(t *testing.T) {
+			assert.Equal(t, tt.expected, stemWord(tt.word, tt.lang))
+		})
+	}
+}
+
+func testInvertedIndex() *invertedIndex {
+	idx := newInvertedIndex()
+	idx.add(Page{Title: "Go", URL: "https://en.wikipedia.org/wiki/Go", Language: "en",
+		Content: "Go is a programming language with goroutines and channels for concurrent programming."})
+	idx.add(Page{Title: "Rust", URL: "https://en.wikipedia.org/wiki/Rust", Language: "en",
+		Content: "Rust is a systems programming language. Programs are checked for memory safety."})
+	idx.add(Page{Title: "Concurrency", URL: "https://en.wikipedia.org/wiki/Concurrency", Language: "en",
+		Content: "Concurrent tasks run several computations during overlapping time periods."})
+	idx.add(Page{Title: "Programmering", URL: "https://da.wikipedia.org/wiki/Programmering", Language: "da",
+		LastUpdated: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		Content:     "Programmering er at skrive programmer til computere. Sprogene er mange."})
+	return idx
+}
+
+// searchIndex parses query and searches idx with it.
+func searchIndex(t *testing.T, idx *invertedIndex, query string) []scoredPage {
+	t.Helper()
+	parsed, err := parseQuery(query)
+	require.NoError(t, err)
+	return idx.search(parsed)
+}
+
+func matchedURLs(matches []scoredPage) []string {
+	var urls []string
+	for _, match := range matches {
+		urls = append(urls, match.page.URL)
+	}
+	return urls
+}
+
+func TestInvertedIndexSearch(t *testing.T) {
+	idx := testInvertedIndex()
+
+	t.Run("Stemmed words match any form", func(t *testing.T) {
+		matches := searchIndex(t, idx, "programmed")
+		assert.ElementsMatch(t, []string{"https://en.wikipedia.org/wiki/Go", "https://en.wikipedia.org/wiki/Rust"}, matchedURLs(matches))
+	})
+
+	t.Run("Title matches rank first", func(t *testing.T) {
+		matches := searchIndex(t, idx, "concurrency")
+		require.NotEmpty(t, matches)
+		assert.Equal(t, "https://en.wikipedia.org/wiki/Concurrency", matches[0].page.URL)
+		assert.Contains(t, matchedURLs(matches), "https://en.wikipedia.org/wiki/Go")
+	})
+
+	t.Run("Scores decrease", func(t *testing.T) {
+		matches := searchIndex(t, idx, "programming OR safety")
+		require.Len(t, matches, 2)
+		assert.Equal(t, "https://en.wikipedia.org/wiki/Rust", matches[0].page.URL)
+		assert.Greater(t, matches[0].score, matches[1].score)
+	})
+
+	t.Run("Phrases must match in order", func(t *testing.T) {
+		assert.Equal(t, []string{"https://en.wikipedia.org/wiki/Go"}, matchedURLs(searchIndex(t, idx, `"concurrent programming"`)))
+		assert.Empty(t, searchIndex(t, idx, `"programming concurrent"`))
+		assert.Equal(t, []string{"https://en.wikipedia.org/wiki/Rust"}, matchedURLs(searchIndex(t, idx, `rust "programming language"`)))
+	})
+
+	t.Run("Phrases do not span title and content", func(t *testing.T) {
+		assert.Empty(t, searchIndex(t, idx, `"rust rust"`))
+	})
+
+	t.Run("Danish pages are stemmed in Danish", func(t *testing.T) {
+		assert.Equal(t, []string{"https://da.wikipedia.org/wiki/Programmering"}, matchedURLs(searchIndex(t, idx, "sprog")))
+	})
+
+	t.Run("No match", func(t *testing.T) {
+		assert.Empty(t, searchIndex(t, idx, "haskell"))
+		assert.Empty(t, searchIndex(t, idx, "go haskell"), "all words must match")
+	})
+
+	t.Run("Exclusions", func(t *testing.T) {
+		assert.Equal(t, []string{"https://en.wikipedia.org/wiki/Rust"}, matchedURLs(searchIndex(t, idx, "programming -goroutines")))
+		assert.Equal(t, []string{"https://en.wikipedia.org/wiki/Go"}, matchedURLs(searchIndex(t, idx, `programming -"memory safety"`)))
+	})
+
+	t.Run("OR", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{"https://en.wikipedia.org/wiki/Go", "https://en.wikipedia.org/wiki/Concurrency"},
+			matchedURLs(searchIndex(t, idx, "goroutines OR periods")))
+	})
+
+	t.Run("Operators", func(t *testing.T) {
+		assert.Equal(t, []string{"https://da.wikipedia.org/wiki/Programmering"}, matchedURLs(searchIndex(t, idx, "site:da.wikipedia.org")))
+		assert.Len(t, searchIndex(t, idx, "-site:da.wikipedia.org"), 3)
+		assert.Len(t, searchIndex(t, idx, "lang:en"), 3)
+		assert.Empty(t, searchIndex(t, idx, "programming lang:da"))
+		assert.Len(t, searchIndex(t, idx, "after:2024-01-01"), 1)
+		assert.Len(t, searchIndex(t, idx, "before:2024-01-01"), 3)
+	})
+}
+
+func TestInvertedIndexTitlesWithPrefix(t *testing.T) {
+	idx := testInvertedIndex()
+	idx.add(Page{Title: "Go", URL: "https://da.wikipedia.org/wiki/Go", Language: "da"})
+
+	assert.Equal(t, []string{"Programmering"}, idx.titlesWithPrefix("PROG", 5))
+	assert.Equal(t, []string{"Concurrency", "Go"}, idx.titlesWithPrefix("", 2))
+	assert.Equal(t, []string{"Go"}, idx.titlesWithPrefix("g", 5), "duplicate titles are returned once")
+	assert.Empty(t, idx.titlesWithPrefix("haskell", 5))
+}
+
+func TestInvertedIndexCorrections(t *testing.T) {
+	idx := testInvertedIndex()
+
+	assert.Equal(t, map[string]string{"goroutnes": "goroutines", "sprogne": "sprogene"},
+		idx.corrections([]string{"goroutnes", "sprogne", "rust"}), "words are corrected unstemmed")
+
+	idx.remove("https://en.wikipedia.org/wiki/Go")
+	assert.Empty(t, idx.corrections([]string{"goroutnes"}))
+}
+
+func TestInvertedIndexUpdate(t *testing.T) {
+	idx := testInvertedIndex()
+
+	idx.add(Page{Title: "Go", URL: "https://en.wikipedia.org/wiki/Go", Language: "en", Content: "Go is a board game."})
+	assert.Equal(t, 4, idx.len())
+	assert.Equal(t, []string{"https://en.wikipedia.org/wiki/Go"}, matchedURLs(searchIndex(t, idx, "board")))
+	assert.Empty(t, searchIndex(t, idx, "goroutines"))
+
+	idx.remove("https://en.wikipedia.org/wiki/Go")
+	idx.remove("https://en.wikipedia.org/wiki/Missing")
+	assert.Equal(t, 3, idx.len())
+	assert.Empty(t, searchIndex(t, idx, "board"))
+	assert.NotContains(t, idx.postings, "board")
+}
+
+func TestInvertedIndexSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.gob")
+	idx := testInvertedIndex()
+	lastUpdated := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	idx.add(Page{Title: "Gopher", URL: "https://en.wikipedia.org/wiki/Gopher", Language: "en", LastUpdated: lastUpdated, Content: "A rodent."})
+
+	require.NoError(t, idx.save(path))
+	loaded, err := loadInvertedIndex(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, idx.len(), loaded.len())
+	assert.Equal(t, idx.totalTerms, loaded.totalTerms)
+	assert.Equal(t, idx.words, loaded.words)
+	assert.Equal(t, searchIndex(t, idx, "programming concurrency"), searchIndex(t, loaded, "programming concurrency"))
+	page, ok := loaded.page("https://en.wikipedia.org/wiki/Gopher")
+	require.True(t, ok)
+	assert.True(t, lastUpdated.Equal(page.LastUpdated))
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files are cleaned up")
+
+	require.NoError(t, os.WriteFile(path, []byte("not an index"), 0644))
+	_, err = loadInvertedIndex(path)
+	assert.Error(t, err)
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -34,6 +38,14 @@ func main() {
 		}
 	}
 
+	// Maintenance commands, e.g. `gosearch reindex`, run instead of the server.
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	err := setupPasswordResetTable()
 	if err != nil {
 		log.Printf("Warning: Password reset setup had errors: %v", err)
@@ -51,12 +63,45 @@ func main() {
 	}*/
 
 	//Initialize Elasticsearch
-	initElasticsearch()
+	if searchBackendName == elasticsearchBackendName {
+		// With a fallback, searches are answered while Elasticsearch is down, and the
+		// scraper cron job syncs the pages once it is up.
+		hasFallback := searchFallbackBackendName != "" && searchFallbackBackendName != noSearchBackendName
+		if err := initElasticsearch(); err != nil {
+			if !hasFallback || esClient == nil {
+				log.Fatalf("Failed to set up Elasticsearch: %v", err)
+			}
+			log.Printf("Elasticsearch is down, searches fall back to %s: %v", searchFallbackBackendName, err)
+		} else if err := syncPagesToElasticsearch(); err != nil {
+			if !hasFallback {
+				log.Fatalf("Failed to sync pages: %v", err)
+			}
+			log.Printf("Failed to sync pages, searches may fall back to %s: %v", searchFallbackBackendName, err)
+		}
+	}
 
-	if err := syncPagesToElasticsearch(); err != nil {
-		log.Fatalf("Failed to sync pages: %v", err)
+	searchBackend, err = newSearchBackendWithFallback(searchBackendName, searchFallbackBackendName)
+	if err != nil {
+		log.Fatalf("Failed to set up search backend: %v", err)
+	}
+	log.Printf("Using %s search backend (fallback: %s)", searchBackendName, searchFallbackBackendName)
+	if searchBackendName == postgresBackendName || searchBackendName == sqliteBackendName {
+		// Build the spelling vocabulary before the first search that finds nothing needs it.
+		pagesVocabulary.refresh()
+	}
+
+	searchCache, err = newSearchCache(searchCacheName)
+	if err != nil {
+		log.Fatalf("Failed to set up search cache: %v", err)
+	}
+	if searchCache != nil {
+		searchBackend = &cachingBackend{SearchBackend: searchBackend}
+		log.Printf("Caching search results for %s", searchCacheTTL)
 	}
 
+	// Apply changes to the pages table, however they are made, to the search backend.
+	startPagesOutboxConsumer(context.Background(), searchBackend)
+
 	logPath := os.Getenv("SEARCH_LOG_PATH")
 	if logPath == "" {
 		logPath = "search.log" // Default for Docker
@@ -71,6 +116,9 @@ func main() {
 	searchLogger = log.New(f, "SEARCH: ", log.LstdFlags)
 	defer func() { _ = f.Close() }()
 }
+if err := popularQueries.loadSearchLog(logPath); err != nil && !os.IsNotExist(err) {
+	log.Printf("Warning: could not read search log for suggestions: %v", err)
+}
 
 // Run checkTables once at startup, then start the cron scheduler for periodic checks
 checkTables()
@@ -112,11 +160,22 @@ err = db.Ping()
 	// Definerer api-erne
 	appRouter.HandleFunc("/api/login", apiLogin).Methods("POST")
 	appRouter.HandleFunc("/api/logout", logoutHandler).Methods("GET")
-	appRouter.HandleFunc("/api/search", searchHandler).Methods("GET")
-	appRouter.HandleFunc("/api/search", searchHandler).Methods("POST") // API-ruten for søgninger.
+	appRouter.HandleFunc("/api/search", apiSearchHandler).Methods("GET", "POST") // API-ruten for søgninger.
+	appRouter.HandleFunc("/api/"+searchAPIVersion+"/search", apiSearchHandler).Methods("GET", "POST")
+	appRouter.HandleFunc("/api/suggest", apiSuggestHandler).Methods("GET") // Autocomplete til søgefeltet.
+	appRouter.HandleFunc("/api/"+searchAPIVersion+"/suggest", apiSuggestHandler).Methods("GET")
 	appRouter.HandleFunc("/api/register", apiRegisterHandler).Methods("POST")
 	appRouter.HandleFunc("/api/weather", weatherHandler).Methods("GET") //weather-side
 	appRouter.HandleFunc("/api/reset-password", apiResetPasswordHandler).Methods("POST")
+	appRouter.HandleFunc("/admin/index-failures", requireAdmin(indexFailuresHandler)).Methods("GET") // Sider der ikke kunne indekseres.
+	appRouter.HandleFunc("/api/admin/index-failures", requireAdmin(apiIndexFailuresHandler)).Methods("GET")
+	appRouter.HandleFunc("/api/admin/index-failures/replay", requireAdmin(apiReplayIndexFailuresHandler)).Methods("POST")
+	appRouter.HandleFunc("/admin/reindex", requireAdmin(reindexPageHandler)).Methods("GET") // Genopbyg Elasticsearch-indekset.
+	appRouter.HandleFunc("/api/admin/reindex", requireAdmin(apiStartReindexHandler)).Methods("POST")
+	appRouter.HandleFunc("/api/admin/reindex/{id}", requireAdmin(apiReindexJobHandler)).Methods("GET")
+	appRouter.HandleFunc("/api/admin/reindex/{id}", requireAdmin(apiCancelReindexHandler)).Methods("DELETE")
+	appRouter.HandleFunc("/api/admin/reindex/{id}/events", requireAdmin(apiReindexEventsHandler)).Methods("GET") // Server-Sent Events med fremdrift.
+	appRouter.HandleFunc("/api/admin/reconcile", requireAdmin(apiReconcileHandler)).Methods("GET", "POST") // Drift mellem pages-tabellen og Elasticsearch.
 
 	// sørger for at vi kan bruge de statiske filer som ligger i static-mappen. ex: css.
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(staticPath))))
@@ -125,7 +184,35 @@ err = db.Ping()
 	r.Handle("/metrics", promhttp.Handler())
 
 	fmt.Println("Server running on http://localhost:8080")
-	//Starter serveren.
-	log.Fatal(http.ListenAndServe(":8080", r))
+	//Starter serveren, og lukker den pænt ned ved SIGINT/SIGTERM.
+	server := &http.Server{Addr: ":8080", Handler: r}
+	stopped, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-stopped.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down server: %v", err)
+		}
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	runShutdownHooks()
+
+}
+
+// shutdownHooks run, in order, when the server shuts down.
+var shutdownHooks []func()
 
+// onShutdown registers hook to run when the server shuts down.
+func onShutdown(hook func()) {
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+func runShutdownHooks() {
+	for _, hook := range shutdownHooks {
+		hook()
+	}
 }
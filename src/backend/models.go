@@ -28,6 +28,38 @@ type Page struct {
 	LastUpdated time.Time `json:"last_updated"`
 }
 
+// SearchRequest describes which page of results a search should return.
+// An empty Language searches all languages.
+type SearchRequest struct {
+	Query    string
+	From     int
+	Size     int
+	Language string
+}
+
+// SearchHit is a single page matched by a search together with its relevance score.
+// Snippet and HighlightedTitle mark query terms with highlightPreTag/highlightPostTag.
+type SearchHit struct {
+	Page
+	Score            float64
+	Snippet          string
+	HighlightedTitle string
+}
+
+// LanguageFacet is the number of pages in one language that match a query.
+type LanguageFacet struct {
+	Language string
+	Count    int64
+}
+
+// SearchResults holds the hits of one search and the total number of matching pages.
+// LanguageFacets are counted before the language filter is applied.
+type SearchResults struct {
+	Hits           []SearchHit
+	Total          int64
+	LanguageFacets []LanguageFacet
+}
+
 type WeatherResponse struct {
 	Name string `json:"name"`
 	Main struct {
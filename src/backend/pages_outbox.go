@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Triggers on the pages table record every insert, update and delete, whoever
+// makes it, in the pages_outbox table and notify pagesOutboxChannel. The consumer
+// applies them to the search backend and only then deletes them, so each change is
+// applied at least once, even across restarts.
+
+const (
+	// pagesOutboxChannel is the channel the pages triggers NOTIFY.
+	pagesOutboxChannel = "pages_outbox"
+	// pagesOutboxBatchSize is the number of events applied per transaction.
+	pagesOutboxBatchSize = 100
+	// pagesOutboxPollInterval is how often the outbox is read without being notified.
+	// It picks up events whose notification was lost while the listener reconnected,
+	// and retries events that failed to apply.
+	pagesOutboxPollInterval = 30 * time.Second
+	// pagesOutboxLockKey is the Postgres advisory lock consumers share while they
+	// apply a batch and pausePagesOutbox holds exclusively.
+	pagesOutboxLockKey int64 = 0x676f736561726368
+)
+
+// pagesOutboxEvent is a row of the pages_outbox table. Operation is "upsert" or "delete".
+type pagesOutboxEvent struct {
+	ID        int64
+	Operation string
+	URL       string
+}
+
+// startPagesOutboxConsumer applies the changes to the pages table to backend as
+// they are made, until ctx is done. If listening fails the outbox is only polled.
+func startPagesOutboxConsumer(ctx context.Context, backend SearchBackend) {
+	listener := pq.NewListener(CONN_STR, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Pages outbox listener: %v", err)
+		}
+	})
+	if err := listener.Listen(pagesOutboxChannel); err != nil {
+		log.Printf("Error listening on %s, polling every %s instead: %v", pagesOutboxChannel, pagesOutboxPollInterval, err)
+	}
+
+	go func() {
+		defer func() { _ = listener.Close() }()
+		consumePagesOutbox(ctx, backend, listener.Notify)
+	}()
+}
+
+// consumePagesOutbox drains the outbox whenever a notification arrives and every
+// pagesOutboxPollInterval.
+func consumePagesOutbox(ctx context.Context, backend SearchBackend, notifications <-chan *pq.Notification) {
+	ticker := time.NewTicker(pagesOutboxPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := processPagesOutbox(ctx, backend)
+			if err != nil {
+				log.Printf("Error applying page changes: %v", err)
+			}
+			if n < pagesOutboxBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-notifications:
+		case <-ticker.C:
+		}
+	}
+}
+
+// processPagesOutbox applies the oldest batch of events to backend and deletes
+// them from the outbox, returning how many it consumed. Events are applied by
+// reading the page's current row, so the order in which they are applied doesn't
+// matter and several consumers can share the outbox. Pages that fail are recorded
+// in index_failures, to be retried from there by retryIndexFailures, and their
+// events consumed, so a page the backend keeps rejecting doesn't hold back the
+// changes after it. Events of pages whose failure can't be recorded stay in the
+// outbox to be retried. The search cache is invalidated once per batch.
+func processPagesOutbox(ctx context.Context, backend SearchBackend) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var running bool
+	if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock_shared($1)", pagesOutboxLockKey).Scan(&running); err != nil {
+		return 0, fmt.Errorf("error locking pages outbox: %w", err)
+	}
+	if !running {
+		// Paused, the events are applied once pausePagesOutbox resumes.
+		return 0, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, operation, url FROM pages_outbox ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED", pagesOutboxBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("error reading pages outbox: %w", err)
+	}
+	var events []pagesOutboxEvent
+	for rows.Next() {
+		var e pagesOutboxEvent
+		if err := rows.Scan(&e.ID, &e.Operation, &e.URL); err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("error scanning pages outbox: %w", err)
+		}
+		events = append(events, e)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error reading pages outbox: %w", err)
+	}
+
+	// A page changed several times in the batch only needs its current row applied
+	// once, and a page that failed is recorded once.
+	done := make(map[string]bool)
+	skipped := make(map[string]bool)
+	var consumed []int64
+	var applyErrs []error
+	applied := 0
+	for _, e := range events {
+		if skipped[e.URL] {
+			continue
+		}
+		if !done[e.URL] {
+			if err := applyPagesOutboxEvent(ctx, tx, backend, e); err != nil {
+				pagesOutboxEventsTotal.WithLabelValues(e.Operation, "failed").Inc()
+				applyErrs = append(applyErrs, fmt.Errorf("error applying %s of %s: %w", e.Operation, e.URL, err))
+				if err := recordIndexFailure(ctx, e.URL, err); err != nil {
+					applyErrs = append(applyErrs, err)
+					skipped[e.URL] = true
+					continue
+				}
+				done[e.URL] = true
+				consumed = append(consumed, e.ID)
+				continue
+			}
+			done[e.URL] = true
+			applied++
+		}
+		pagesOutboxEventsTotal.WithLabelValues(e.Operation, "applied").Inc()
+		consumed = append(consumed, e.ID)
+	}
+	if applied > 0 {
+		invalidateSearchCache(ctx)
+	}
+	applyErr := errors.Join(applyErrs...)
+	if len(consumed) == 0 {
+		return 0, applyErr
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM pages_outbox WHERE id = ANY($1)", pq.Array(consumed)); err != nil {
+		return 0, fmt.Errorf("error deleting applied events: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing applied events: %w", err)
+	}
+	return len(consumed), applyErr
+}
+
+// pausePagesOutbox stops every consumer of the outbox, in this process or another,
+// from applying events until resume is called, once the batches being applied are
+// done. Events are still recorded meanwhile and applied after resuming.
+func pausePagesOutbox(ctx context.Context) (resume func(), err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to DB: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", pagesOutboxLockKey); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("error pausing pages outbox: %w", err)
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", pagesOutboxLockKey); err != nil {
+			log.Printf("Error resuming pages outbox: %v", err)
+			// The lock belongs to the connection, so closing it resumes the outbox.
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		_ = conn.Close()
+	}, nil
+}
+
+// applyPagesOutboxEvent indexes the current row of the event's page, or deletes the
+// page from backend if it has no row anymore.
+func applyPagesOutboxEvent(ctx context.Context, tx *sql.Tx, backend SearchBackend, e pagesOutboxEvent) error {
+	rows, err := tx.QueryContext(ctx, "SELECT title, url, language, last_updated, content FROM pages WHERE url = $1", e.URL)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return backend.Delete(ctx, e.URL)
+	}
+	page, err := scanPage(rows)
+	if err != nil {
+		return err
+	}
+	return backend.Index(ctx, page)
+}
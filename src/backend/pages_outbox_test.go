@@ -0,0 +1,179 @@
+// Unit tests for the pages outbox consumer
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	selectOutboxQuery = "SELECT id, operation, url FROM pages_outbox ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED"
+	selectPageQuery   = "SELECT title, url, language, last_updated, content FROM pages WHERE url = $1"
+)
+
+var pageColumns = []string{"title", "url", "language", "last_updated", "content"}
+
+// expectPagesOutboxLock expects a batch to start and try the outbox lock, which
+// it gets unless the outbox is paused.
+func expectPagesOutboxLock(mock sqlmock.Sqlmock, running bool) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_xact_lock_shared($1)")).
+		WithArgs(pagesOutboxLockKey).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock_shared"}).AddRow(running))
+}
+
+func TestProcessPagesOutbox(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	backend := &stubBackend{}
+	lastUpdated := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	useSearchCache(t, newLRUCache(10, time.Minute))
+	invalidations := testutil.ToFloat64(searchCacheInvalidationsTotal)
+
+	expectPagesOutboxLock(mock, true)
+	mock.ExpectQuery(regexp.QuoteMeta(selectOutboxQuery)).
+		WithArgs(pagesOutboxBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "operation", "url"}).
+			AddRow(1, "upsert", "https://en.wikipedia.org/wiki/Go").
+			AddRow(2, "upsert", "https://en.wikipedia.org/wiki/Go").
+			AddRow(3, "delete", "https://en.wikipedia.org/wiki/Rust"))
+	mock.ExpectQuery(regexp.QuoteMeta(selectPageQuery)).
+		WithArgs("https://en.wikipedia.org/wiki/Go").
+		WillReturnRows(sqlmock.NewRows(pageColumns).
+			AddRow("Go", "https://en.wikipedia.org/wiki/Go", "en", lastUpdated, "Go is a language"))
+	mock.ExpectQuery(regexp.QuoteMeta(selectPageQuery)).
+		WithArgs("https://en.wikipedia.org/wiki/Rust").
+		WillReturnRows(sqlmock.NewRows(pageColumns))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM pages_outbox WHERE id = ANY($1)")).
+		WithArgs(pq.Array([]int64{1, 2, 3})).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	n, err := processPagesOutbox(context.Background(), backend)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	require.Len(t, backend.indexed, 1, "a page changed twice is indexed once")
+	assert.Equal(t, "en", backend.indexed[0].Language)
+	assert.True(t, lastUpdated.Equal(backend.indexed[0].LastUpdated))
+	assert.Equal(t, []string{"https://en.wikipedia.org/wiki/Rust"}, backend.deleted, "pages without a row are deleted")
+	assert.Equal(t, invalidations+1, testutil.ToFloat64(searchCacheInvalidationsTotal), "the search cache is invalidated once per batch")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessPagesOutboxFailure(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	backend := &stubBackend{failURLs: map[string]bool{"https://en.wikipedia.org/wiki/Rust": true}}
+	pageRow := func(title string) *sqlmock.Rows {
+		return sqlmock.NewRows(pageColumns).AddRow(title, "https://en.wikipedia.org/wiki/"+title, "en", time.Now(), title+" is a language")
+	}
+	recordFailure := regexp.QuoteMeta("INSERT INTO index_failures")
+
+	// A page that fails is recorded in index_failures and its events consumed, so
+	// the events after it still apply.
+	expectPagesOutboxLock(mock, true)
+	mock.ExpectQuery(regexp.QuoteMeta(selectOutboxQuery)).
+		WithArgs(pagesOutboxBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "operation", "url"}).
+			AddRow(7, "upsert", "https://en.wikipedia.org/wiki/Rust").
+			AddRow(8, "upsert", "https://en.wikipedia.org/wiki/Go").
+			AddRow(9, "upsert", "https://en.wikipedia.org/wiki/Rust"))
+	mock.ExpectQuery(regexp.QuoteMeta(selectPageQuery)).
+		WithArgs("https://en.wikipedia.org/wiki/Rust").
+		WillReturnRows(pageRow("Rust"))
+	mock.ExpectExec(recordFailure).
+		WithArgs("https://en.wikipedia.org/wiki/Rust", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(selectPageQuery)).
+		WithArgs("https://en.wikipedia.org/wiki/Go").
+		WillReturnRows(pageRow("Go"))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM pages_outbox WHERE id = ANY($1)")).
+		WithArgs(pq.Array([]int64{7, 8, 9})).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	n, err := processPagesOutbox(context.Background(), backend)
+	assert.ErrorContains(t, err, "error applying upsert of https://en.wikipedia.org/wiki/Rust")
+	assert.Equal(t, 3, n)
+	require.Len(t, backend.indexed, 1)
+	assert.Equal(t, "https://en.wikipedia.org/wiki/Go", backend.indexed[0].URL)
+
+	// A failure that can't be recorded leaves the page's events in the outbox.
+	expectPagesOutboxLock(mock, true)
+	mock.ExpectQuery(regexp.QuoteMeta(selectOutboxQuery)).
+		WithArgs(pagesOutboxBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "operation", "url"}).
+			AddRow(10, "upsert", "https://en.wikipedia.org/wiki/Rust").
+			AddRow(11, "delete", "https://en.wikipedia.org/wiki/Zig").
+			AddRow(12, "upsert", "https://en.wikipedia.org/wiki/Rust"))
+	mock.ExpectQuery(regexp.QuoteMeta(selectPageQuery)).
+		WithArgs("https://en.wikipedia.org/wiki/Rust").
+		WillReturnRows(pageRow("Rust"))
+	mock.ExpectExec(recordFailure).
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectQuery(regexp.QuoteMeta(selectPageQuery)).
+		WithArgs("https://en.wikipedia.org/wiki/Zig").
+		WillReturnRows(sqlmock.NewRows(pageColumns))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM pages_outbox WHERE id = ANY($1)")).
+		WithArgs(pq.Array([]int64{11})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	n, err = processPagesOutbox(context.Background(), backend)
+	assert.ErrorContains(t, err, "connection reset")
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"https://en.wikipedia.org/wiki/Zig"}, backend.deleted)
+
+	// When nothing is consumed, the transaction is rolled back.
+	expectPagesOutboxLock(mock, true)
+	mock.ExpectQuery(regexp.QuoteMeta(selectOutboxQuery)).
+		WithArgs(pagesOutboxBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "operation", "url"}).
+			AddRow(10, "upsert", "https://en.wikipedia.org/wiki/Rust"))
+	mock.ExpectQuery(regexp.QuoteMeta(selectPageQuery)).
+		WithArgs("https://en.wikipedia.org/wiki/Rust").
+		WillReturnRows(pageRow("Rust"))
+	mock.ExpectExec(recordFailure).
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	n, err = processPagesOutbox(context.Background(), backend)
+	assert.ErrorContains(t, err, "mapper_parsing_exception")
+	assert.Equal(t, 0, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessPagesOutboxPaused(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	backend := &stubBackend{}
+
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).
+		WithArgs(pagesOutboxLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	resume, err := pausePagesOutbox(context.Background())
+	require.NoError(t, err)
+
+	// While paused, batches leave the outbox alone.
+	expectPagesOutboxLock(mock, false)
+	mock.ExpectRollback()
+	n, err := processPagesOutbox(context.Background(), backend)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Empty(t, backend.indexed)
+
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).
+		WithArgs(pagesOutboxLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	resume()
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly"
+	"github.com/temoto/robotstxt"
+)
+
+// Every request the scraper and the crawler send goes through scraperPoliteness,
+// which is shared by all of them, so hosts see one well-behaved client however many
+// scrape jobs run: requests identify themselves with SCRAPER_USER_AGENT, paths
+// robots.txt disallows are never fetched, and requests to a host are spaced by
+// SCRAPER_HOST_DELAY or the host's Crawl-delay, whichever is longer.
+
+const (
+	// robotsCacheTTL is how long a host's robots.txt is used before it is fetched again.
+	robotsCacheTTL = 24 * time.Hour
+	// robotsErrorTTL is how long a host whose robots.txt couldn't be fetched is left
+	// alone before trying again.
+	robotsErrorTTL = 10 * time.Minute
+	// robotsMaxSize is the most of a robots.txt that is read.
+	robotsMaxSize = 512 * 1024
+	// robotsMaxCrawlDelay caps the Crawl-delay a host may ask for.
+	robotsMaxCrawlDelay = time.Minute
+	// robotsRequestTimeout bounds fetching a robots.txt.
+	robotsRequestTimeout = 10 * time.Second
+)
+
+// errDisallowedByRobots is returned for requests a host's robots.txt disallows.
+var errDisallowedByRobots = errors.New("disallowed by robots.txt")
+
+// scraperPoliteness is the politeness shared by every scraper and crawler request,
+// configured in init.
+var scraperPoliteness *politeness
+
+// politeness decides when requests to a host may be sent, see scraperPoliteness.
+type politeness struct {
+	userAgent string
+	// minDelay is the least time between two requests to the same host.
+	minDelay time.Duration
+	// client fetches robots.txt files.
+	client *http.Client
+
+	mu sync.Mutex
+	// robots caches robots.txt by scheme and host.
+	robots map[string]*robotsEntry
+	// nextRequest is the earliest time the next request to each host may be sent.
+	nextRequest map[string]time.Time
+}
+
+type robotsEntry struct {
+	// ready is closed once data is set.
+	ready chan struct{}
+	data  *robotstxt.RobotsData
+	// expires is guarded by politeness.mu.
+	expires time.Time
+}
+
+func newPoliteness(userAgent string, minDelay time.Duration) *politeness {
+	return &politeness{
+		userAgent:   userAgent,
+		minDelay:    minDelay,
+		client:      &http.Client{Timeout: robotsRequestTimeout},
+		robots:      make(map[string]*robotsEntry),
+		nextRequest: make(map[string]time.Time),
+	}
+}
+
+// newPoliteCollector returns a colly collector whose requests, including those
+// it follows redirects to, go through scraperPoliteness. Each request may take up
+// to timeout once its host may be sent it.
+func newPoliteCollector(timeout time.Duration, options ...func(*colly.Collector)) *colly.Collector {
+	collector := colly.NewCollector(append([]func(*colly.Collector){colly.UserAgent(scraperUserAgent)}, options...)...)
+	collector.WithTransport(&politeTransport{politeness: scraperPoliteness, next: http.DefaultTransport, timeout: timeout})
+	// The transport times requests, as a client timeout would also count the wait.
+	collector.SetRequestTimeout(0)
+	return collector
+}
+
+// newPoliteClient returns an http.Client whose requests go through
+// scraperPoliteness, for fetches that don't need a collector. Each request may
+// take up to timeout once its host may be sent it. Callers set the User-Agent
+// header of their requests to scraperUserAgent.
+func newPoliteClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &politeTransport{politeness: scraperPoliteness, next: http.DefaultTransport, timeout: timeout},
+	}
+}
+
+// politeTransport holds each request back until its host may be sent it, and
+// fails requests robots.txt disallows. Requests time out after timeout, counted
+// from when they are sent, until their response body is closed.
+type politeTransport struct {
+	politeness *politeness
+	next       http.RoundTripper
+	timeout    time.Duration
+}
+
+func (t *politeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.politeness.wait(req.Context(), req.URL); err != nil {
+		return nil, err
+	}
+	if t.timeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	res, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelOnClose is a response body that releases its request's timeout when closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// wait returns once a request for u may be sent, or errDisallowedByRobots if it
+// may not be sent at all.
+func (p *politeness) wait(ctx context.Context, u *url.URL) error {
+	robots := p.robotsFor(ctx, u)
+	if !robots.TestAgent(u.RequestURI(), p.userAgent) {
+		scraperRobotsDisallowedTotal.Inc()
+		return fmt.Errorf("%w: %s", errDisallowedByRobots, u)
+	}
+
+	delay := p.minDelay
+	if crawlDelay := min(robots.FindGroup(p.userAgent).CrawlDelay, robotsMaxCrawlDelay); crawlDelay > delay {
+		delay = crawlDelay
+	}
+
+	// Each request reserves the next free slot of its host, so concurrent requests
+	// to a host go one delay apart.
+	host := strings.ToLower(u.Host)
+	p.mu.Lock()
+	now := time.Now()
+	slot := p.nextRequest[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	p.nextRequest[host] = slot.Add(delay)
+	p.mu.Unlock()
+
+	wait := time.Until(slot)
+	scraperPolitenessWait.Observe(max(wait, 0).Seconds())
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// robotsFor returns the robots.txt of u's host, fetching it if it isn't cached.
+// Concurrent requests to a host wait for the same fetch.
+func (p *politeness) robotsFor(ctx context.Context, u *url.URL) *robotstxt.RobotsData {
+	key := strings.ToLower(u.Scheme + "://" + u.Host)
+	p.mu.Lock()
+	entry, ok := p.robots[key]
+	if ok && time.Now().Before(entry.expires) {
+		p.mu.Unlock()
+		<-entry.ready
+		return entry.data
+	}
+	entry = &robotsEntry{ready: make(chan struct{}), expires: time.Now().Add(robotsCacheTTL)}
+	p.robots[key] = entry
+	p.mu.Unlock()
+
+	data, err := p.fetchRobots(ctx, key+"/robots.txt")
+	if err != nil {
+		// Hosts whose robots.txt can't be read are left alone for a while, as
+		// Google does when robots.txt fails with a server error.
+		log.Printf("Error fetching %s/robots.txt, not crawling it for %s: %v", key, robotsErrorTTL, err)
+		data, _ = robotstxt.FromStatusAndBytes(http.StatusServiceUnavailable, nil)
+		p.mu.Lock()
+		entry.expires = time.Now().Add(robotsErrorTTL)
+		p.mu.Unlock()
+	}
+	entry.data = data
+	close(entry.ready)
+	return data
+}
+
+func (p *politeness) fetchRobots(ctx context.Context, robotsURL string) (*robotstxt.RobotsData, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", p.userAgent)
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, robotsMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	return robotstxt.FromStatusAndBytes(res.StatusCode, body)
+}
@@ -0,0 +1,202 @@
+// Unit tests for robots.txt handling and per-host rate limits of the scraper
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gocolly/colly"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// usePoliteness makes scrapers and crawlers use a politeness with the given
+// delay between requests to a host.
+func usePoliteness(t *testing.T, delay time.Duration) *politeness {
+	previous := scraperPoliteness
+	scraperPoliteness = newPoliteness("GoSearchBot/1.0", delay)
+	t.Cleanup(func() { scraperPoliteness = previous })
+	return scraperPoliteness
+}
+
+// robotsServer serves robots and counts the requests for it. Other paths answer
+// with a small page, and /redirect redirects to /nobots/page.
+func robotsServer(t *testing.T, robots string) (*httptest.Server, *atomic.Int32, *sync.Map) {
+	var robotsFetches atomic.Int32
+	var userAgents sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents.Store(r.URL.Path, r.UserAgent())
+		switch r.URL.Path {
+		case "/robots.txt":
+			robotsFetches.Add(1)
+			_, _ = fmt.Fprint(w, robots)
+		case "/redirect":
+			http.Redirect(w, r, "/nobots/page", http.StatusFound)
+		default:
+			_, _ = fmt.Fprint(w, "<html><head><title>Page</title></head><body><p>Text</p></body></html>")
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &robotsFetches, &userAgents
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u
+}
+
+func TestPolitenessRobots(t *testing.T) {
+	server, robotsFetches, userAgents := robotsServer(t, `
+User-agent: *
+Disallow: /
+
+User-agent: GoSearchBot
+Disallow: /nobots
+Allow: /nobots/welcome
+`)
+	p := newPoliteness("GoSearchBot/1.0", 0)
+	ctx := context.Background()
+
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{"/", true},
+		{"/private", true},
+		{"/nobots", false},
+		{"/nobots/page?id=1", false},
+		{"/nobots/welcome", true},
+	}
+	for _, tt := range tests {
+		err := p.wait(ctx, mustParseURL(t, server.URL+tt.path))
+		if tt.allowed {
+			assert.NoError(t, err, tt.path)
+		} else {
+			assert.ErrorIs(t, err, errDisallowedByRobots, tt.path)
+		}
+	}
+	assert.Equal(t, int32(1), robotsFetches.Load(), "robots.txt is cached")
+	userAgent, _ := userAgents.Load("/robots.txt")
+	assert.Equal(t, "GoSearchBot/1.0", userAgent)
+
+	// Other crawlers follow the * group.
+	other := newPoliteness("OtherBot/2.0", 0)
+	assert.ErrorIs(t, other.wait(ctx, mustParseURL(t, server.URL+"/")), errDisallowedByRobots)
+}
+
+func TestPolitenessUnreadableRobots(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	p := newPoliteness("GoSearchBot/1.0", 0)
+	ctx := context.Background()
+	assert.ErrorIs(t, p.wait(ctx, mustParseURL(t, failing.URL+"/")), errDisallowedByRobots, "server errors disallow everything")
+	assert.ErrorIs(t, p.wait(ctx, mustParseURL(t, gone.URL+"/")), errDisallowedByRobots, "unreachable hosts are left alone")
+	assert.NoError(t, p.wait(ctx, mustParseURL(t, missing.URL+"/")), "a missing robots.txt allows everything")
+}
+
+func TestPolitenessRateLimit(t *testing.T) {
+	server, _, _ := robotsServer(t, "User-agent: *\nCrawl-delay: 0.2\n")
+	other, _, _ := robotsServer(t, "")
+	p := newPoliteness("GoSearchBot/1.0", 50*time.Millisecond)
+	ctx := context.Background()
+
+	// Concurrent requests to a host are spaced by its Crawl-delay, longer than the
+	// minimum delay, while another host is only held to the minimum.
+	start := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var waited []time.Duration
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, p.wait(ctx, mustParseURL(t, server.URL+"/")))
+			mu.Lock()
+			waited = append(waited, time.Since(start))
+			mu.Unlock()
+		}()
+	}
+	require.NoError(t, p.wait(ctx, mustParseURL(t, other.URL+"/")))
+	require.NoError(t, p.wait(ctx, mustParseURL(t, other.URL+"/")))
+	otherWaited := time.Since(start)
+	wg.Wait()
+
+	assert.Less(t, otherWaited, 200*time.Millisecond)
+	assert.GreaterOrEqual(t, max(waited[0], waited[1], waited[2]), 400*time.Millisecond)
+
+	// A cancelled request stops waiting.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.NoError(t, p.wait(ctx, mustParseURL(t, server.URL+"/")))
+	assert.ErrorIs(t, p.wait(cancelled, mustParseURL(t, server.URL+"/")), context.Canceled)
+}
+
+func TestPoliteTimeout(t *testing.T) {
+	usePoliteness(t, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			_, _ = fmt.Fprint(w, "User-agent: *\nCrawl-delay: 0.3\n")
+		case "/slow":
+			time.Sleep(300 * time.Millisecond)
+		default:
+			_, _ = fmt.Fprint(w, "<html><head><title>Page</title></head><body><p>Text</p></body></html>")
+		}
+	}))
+	defer server.Close()
+
+	// Requests wait out a Crawl-delay longer than their timeout before it starts.
+	client := newPoliteClient(100 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		res, err := client.Get(server.URL + "/page")
+		require.NoError(t, err)
+		_ = res.Body.Close()
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 600*time.Millisecond)
+
+	visits := 0
+	collector := newPoliteCollector(100*time.Millisecond, colly.AllowURLRevisit())
+	collector.OnResponse(func(r *colly.Response) { visits++ })
+	require.NoError(t, collector.Visit(server.URL+"/page"))
+	require.NoError(t, collector.Visit(server.URL+"/page"))
+	assert.Equal(t, 2, visits)
+
+	// Slow responses still time out.
+	_, err := client.Get(server.URL + "/slow")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestPoliteCollector(t *testing.T) {
+	usePoliteness(t, 0)
+	server, _, userAgents := robotsServer(t, "User-agent: *\nDisallow: /nobots\n")
+
+	page, err := fetchCrawledPage(server.URL + "/allowed")
+	require.NoError(t, err)
+	assert.Equal(t, "Page", page.Title)
+	userAgent, _ := userAgents.Load("/allowed")
+	assert.Equal(t, scraperUserAgent, userAgent)
+
+	_, err = fetchCrawledPage(server.URL + "/nobots/page")
+	assert.True(t, errors.Is(err, errDisallowedByRobots), "got %v", err)
+	_, err = fetchCrawledPage(server.URL + "/redirect")
+	assert.True(t, errors.Is(err, errDisallowedByRobots), "redirects are checked too, got %v", err)
+	_, fetched := userAgents.Load("/nobots/page")
+	assert.False(t, fetched)
+}
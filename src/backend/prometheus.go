@@ -86,6 +86,129 @@ var (
 		},
 		[]string{"auth_status"},
 	)
+
+	searchBackendFallbacksTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "search_backend_fallbacks_total",
+			Help: "Total number of searches answered by the fallback backend because the primary backend failed",
+		},
+		[]string{"primary", "fallback"},
+	)
+
+	searchCacheHitsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "search_cache_hits_total",
+			Help: "Total number of searches answered from the search cache",
+		},
+	)
+
+	searchCacheMissesTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "search_cache_misses_total",
+			Help: "Total number of searches not found in the search cache",
+		},
+	)
+
+	searchCacheInvalidationsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "search_cache_invalidations_total",
+			Help: "Total number of times the search cache was emptied because the index changed",
+		},
+	)
+
+	pagesOutboxEventsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pages_outbox_events_total",
+			Help: "Total number of page changes from the pages outbox applied to the search backend or failed, by operation",
+		},
+		[]string{"operation", "result"},
+	)
+
+	indexFailuresTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "index_failures_total",
+			Help: "Total number of pages recorded in or resolved from the index_failures dead-letter queue",
+		},
+		[]string{"result"},
+	)
+
+	scraperRobotsDisallowedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "scraper_robots_disallowed_total",
+			Help: "Total number of scraper and crawler requests not sent because robots.txt disallows them",
+		},
+	)
+
+	scraperPolitenessWait = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "scraper_politeness_wait_seconds",
+			Help:    "Time scraper and crawler requests waited for their host's rate limit",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+		},
+	)
+
+	crawlerPagesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "crawler_pages_total",
+			Help: "Total number of pages fetched by the crawler, by whether they were saved, skipped or failed",
+		},
+		[]string{"result"},
+	)
+
+	sitemapURLsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sitemap_urls_total",
+			Help: "Total number of pages listed in sitemaps, by whether they were queued for crawling or unchanged since they were saved",
+		},
+		[]string{"result"},
+	)
+
+	recrawlPagesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "recrawl_pages_total",
+			Help: "Total number of pages recrawled, by whether they had changed, were unchanged, were missing, were gone or failed",
+		},
+		[]string{"result"},
+	)
+
+	esIndexDriftDocuments = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "search_index_drift_documents",
+			Help: "Number of pages missing from, stale in or orphaned in the Elasticsearch pages index at the last reconciliation",
+		},
+		[]string{"kind"},
+	)
+
+	esIndexReconciledTimestamp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "search_index_reconciled_timestamp_seconds",
+			Help: "Unix time of the last reconciliation of the Elasticsearch pages index with the pages table",
+		},
+	)
+
+	esBulkBatchDocuments = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "elasticsearch_bulk_batch_documents",
+			Help:    "Number of documents indexed or failed per Elasticsearch bulk batch",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 7),
+		},
+		[]string{"result"},
+	)
+
+	esBulkBatchDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "elasticsearch_bulk_batch_duration_seconds",
+			Help:    "Duration of Elasticsearch bulk batches in seconds, including retries",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	esBulkRetriesTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "elasticsearch_bulk_retries_total",
+			Help: "Total number of documents sent again because Elasticsearch rejected them with 429 Too Many Requests",
+		},
+	)
 )
 
 type statusRecorder struct {
@@ -98,6 +221,13 @@ func (rec *statusRecorder) WriteHeader(statusCode int) {
 	rec.ResponseWriter.WriteHeader(statusCode)
 }
 
+// Flush lets handlers stream responses, such as Server-Sent Events, through the recorder.
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func metricsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Custom response writer to track status
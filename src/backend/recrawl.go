@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Saved pages are recrawled so they don't go stale once their search term is
+// processed. Each page has a recrawl interval in the page_recrawls table: it is
+// halved when a recrawl finds the page changed and doubled when it finds it
+// unchanged, so pages that change often are checked often and pages that rarely
+// change back off to recrawlMaxInterval. Pages are recrawled with conditional
+// requests carrying the ETag and Last-Modified of their last response, so servers
+// can answer 304 Not Modified instead of sending the page again; for servers that
+// don't, a page whose title and text are the same is unchanged too. Pages that are
+// gone (404 or 410) are deleted once they have answered so recrawlGoneAttempts
+// times in a row, so a page missing for a while, e.g. during a botched deploy,
+// isn't lost.
+
+const (
+	// recrawlInitialInterval is how long after it was last updated a page is first
+	// recrawled, and its first interval.
+	recrawlInitialInterval = 24 * time.Hour
+	recrawlMinInterval     = 6 * time.Hour
+	recrawlMaxInterval     = 30 * 24 * time.Hour
+	// recrawlRetryDelay is the wait before recrawling a page whose recrawl failed.
+	recrawlRetryDelay = time.Hour
+	// recrawlGoneAttempts is how many recrawls in a row must find a page gone
+	// before it is deleted, and recrawlGoneDelay the wait between them.
+	recrawlGoneAttempts = 3
+	recrawlGoneDelay    = 12 * time.Hour
+)
+
+// errRecrawlRunning is returned by recrawlStalePages while another run is going.
+var errRecrawlRunning = errors.New("a recrawl is already running")
+
+// recrawlMu makes recrawl runs take turns, as a run may outlast the cron interval.
+var recrawlMu sync.Mutex
+
+// RecrawlStats counts what a recrawl did.
+type RecrawlStats struct {
+	Changed   int
+	Unchanged int
+	// Missing counts the pages found gone too few times in a row to be deleted.
+	Missing int
+	// Gone counts the pages deleted because they no longer exist.
+	Gone   int
+	Failed int
+}
+
+// stalePage is a page due for recrawling and its recrawl state.
+type stalePage struct {
+	Page
+	ETag         string
+	LastModified string
+	Interval     time.Duration
+	// GoneCount is how many recrawls in a row have found the page gone.
+	GoneCount int
+}
+
+// recrawlStalePages recrawls up to limit pages that are due, those due longest
+// first. Pages never recrawled are due recrawlInitialInterval after they were last
+// updated.
+func recrawlStalePages(ctx context.Context, limit int) (RecrawlStats, error) {
+	var stats RecrawlStats
+	if !recrawlMu.TryLock() {
+		return stats, errRecrawlRunning
+	}
+	defer recrawlMu.Unlock()
+
+	pages, err := stalePages(ctx, limit)
+	if err != nil {
+		return stats, err
+	}
+	for _, page := range pages {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		result, err := recrawlPage(ctx, page)
+		if err != nil {
+			log.Printf("Error recrawling %s: %v", page.URL, err)
+			result = "failed"
+		}
+		switch result {
+		case "changed":
+			stats.Changed++
+		case "unchanged":
+			stats.Unchanged++
+		case "missing":
+			stats.Missing++
+		case "gone":
+			stats.Gone++
+		default:
+			stats.Failed++
+		}
+		recrawlPagesTotal.WithLabelValues(result).Inc()
+	}
+
+	if len(pages) > 0 {
+		log.Printf("Recrawled %d pages: %d changed, %d unchanged, %d missing, %d gone, %d failed",
+			len(pages), stats.Changed, stats.Unchanged, stats.Missing, stats.Gone, stats.Failed)
+	}
+	return stats, nil
+}
+
+func stalePages(ctx context.Context, limit int) ([]stalePage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.title, p.url, p.language, p.content, r.etag, r.last_modified, r.interval_seconds, COALESCE(r.gone_count, 0)
+		FROM pages p
+		LEFT JOIN page_recrawls r ON r.url = p.url
+		WHERE COALESCE(r.next_crawl_at, p.last_updated + make_interval(secs => $1), TIMESTAMP 'epoch') <= CURRENT_TIMESTAMP
+		ORDER BY COALESCE(r.next_crawl_at, p.last_updated + make_interval(secs => $1), TIMESTAMP 'epoch')
+		LIMIT $2`, recrawlInitialInterval.Seconds(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting pages to recrawl: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var pages []stalePage
+	for rows.Next() {
+		var page stalePage
+		var etag, lastModified sql.NullString
+		var interval sql.NullFloat64
+		if err := rows.Scan(&page.Title, &page.URL, &page.Language, &page.Content, &etag, &lastModified, &interval, &page.GoneCount); err != nil {
+			return nil, err
+		}
+		page.ETag, page.LastModified = etag.String, lastModified.String
+		page.Interval = recrawlInitialInterval
+		if interval.Valid {
+			page.Interval = time.Duration(interval.Float64 * float64(time.Second))
+		}
+		pages = append(pages, page)
+	}
+	return pages, rows.Err()
+}
+
+// recrawlPage recrawls a page, saving it if it has changed and scheduling its next
+// recrawl, and returns whether it changed, was unchanged, is missing, is gone or failed.
+func recrawlPage(ctx context.Context, stale stalePage) (string, error) {
+	header := http.Header{}
+	if stale.ETag != "" {
+		header.Set("If-None-Match", stale.ETag)
+	}
+	if stale.LastModified != "" {
+		header.Set("If-Modified-Since", stale.LastModified)
+	}
+	page, err := fetchPage(stale.URL, header)
+
+	switch {
+	case (page.StatusCode == http.StatusNotFound || page.StatusCode == http.StatusGone) && stale.GoneCount+1 < recrawlGoneAttempts:
+		// The page is kept as it was until it has been gone for a while.
+		return "missing", scheduleRecrawl(ctx, stale.URL, stale.ETag, stale.LastModified, stale.Interval, recrawlGoneDelay, stale.GoneCount+1, nil)
+	case page.StatusCode == http.StatusNotFound || page.StatusCode == http.StatusGone:
+		// The outbox removes the page from the search backend too.
+		if _, err := db.ExecContext(ctx, "DELETE FROM pages WHERE url = $1", stale.URL); err != nil {
+			return "failed", fmt.Errorf("error deleting gone page: %w", err)
+		}
+		return "gone", nil
+	case err != nil:
+		// The validators are kept, as the page wasn't fetched, and so is its count
+		// of gone responses, as a failure doesn't say whether it exists.
+		return "failed", scheduleRecrawl(ctx, stale.URL, stale.ETag, stale.LastModified, stale.Interval, recrawlRetryDelay, stale.GoneCount, err)
+	case page.StatusCode == http.StatusNotModified:
+		// A 304 may leave out validators that haven't changed.
+		etag, lastModified := page.ETag, page.LastModified
+		if etag == "" {
+			etag = stale.ETag
+		}
+		if lastModified == "" {
+			lastModified = stale.LastModified
+		}
+		interval := backOffRecrawl(stale.Interval)
+		return "unchanged", scheduleRecrawl(ctx, stale.URL, etag, lastModified, interval, interval, 0, nil)
+	case page.Title == "" || page.Content == "":
+		err := fmt.Errorf("no title or content found")
+		return "failed", scheduleRecrawl(ctx, stale.URL, stale.ETag, stale.LastModified, stale.Interval, recrawlRetryDelay, 0, err)
+	case page.Title == stale.Title && page.Content == stale.Content && page.Language == stale.Language:
+		interval := backOffRecrawl(stale.Interval)
+		return "unchanged", scheduleRecrawl(ctx, stale.URL, page.ETag, page.LastModified, interval, interval, 0, nil)
+	}
+
+	// The page is saved under the URL it was recrawled at, even if it redirected.
+	page.URL = stale.URL
+	if err := savePageToDBWithLang(page.Page, page.Language); err != nil {
+		return "failed", scheduleRecrawl(ctx, stale.URL, stale.ETag, stale.LastModified, stale.Interval, recrawlRetryDelay, 0, err)
+	}
+	interval := max(stale.Interval/2, recrawlMinInterval)
+	return "changed", scheduleRecrawl(ctx, stale.URL, page.ETag, page.LastModified, interval, interval, 0, nil)
+}
+
+// backOffRecrawl returns the interval of a page found unchanged.
+func backOffRecrawl(interval time.Duration) time.Duration {
+	return min(interval*2, recrawlMaxInterval)
+}
+
+// scheduleRecrawl records the validators, interval and count of gone responses of
+// a page and when it is due again, returning cause, the error the recrawl failed
+// with if any, or the error recording it.
+func scheduleRecrawl(ctx context.Context, url, etag, lastModified string, interval, next time.Duration, goneCount int, cause error) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO page_recrawls (url, etag, last_modified, interval_seconds, last_crawled_at, next_crawl_at, gone_count)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP + make_interval(secs => $5), $6)
+		ON CONFLICT (url) DO UPDATE
+		SET etag = EXCLUDED.etag,
+		    last_modified = EXCLUDED.last_modified,
+		    interval_seconds = EXCLUDED.interval_seconds,
+		    last_crawled_at = EXCLUDED.last_crawled_at,
+		    next_crawl_at = EXCLUDED.next_crawl_at,
+		    gone_count = EXCLUDED.gone_count
+	`, url, etag, lastModified, interval.Seconds(), next.Seconds(), goneCount)
+	if err != nil {
+		err = fmt.Errorf("error scheduling recrawl: %w", err)
+	}
+	return errors.Join(cause, err)
+}
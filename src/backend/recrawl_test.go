@@ -0,0 +1,162 @@
+// Unit tests for recrawling stale pages
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const scheduleRecrawlQuery = "INSERT INTO page_recrawls"
+
+// newRecrawlSite serves pages answering conditional requests: /etag and /lastmod
+// haven't changed, /changed and /same answer unconditionally, /gone and /removed
+// are gone and /broken fails.
+func newRecrawlSite(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	page := func(w http.ResponseWriter, title, content string) {
+		_, _ = fmt.Fprintf(w, "<html><head><title>%s</title></head><body><p>%s</p></body></html>", title, content)
+	}
+	mux.HandleFunc("/etag", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		page(w, "Etag", "Text")
+	})
+	mux.HandleFunc("/lastmod", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		page(w, "Lastmod", "Text")
+	})
+	mux.HandleFunc("/changed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v2"`)
+		page(w, "Changed", "New text")
+	})
+	mux.HandleFunc("/same", func(w http.ResponseWriter, r *http.Request) {
+		page(w, "Same", "Same text")
+	})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/removed", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRecrawlStalePages(t *testing.T) {
+	usePoliteness(t, 0)
+	site := newRecrawlSite(t)
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+
+	day := (24 * time.Hour).Seconds()
+	lastModified := "Wed, 01 Oct 2025 00:00:00 GMT"
+	mock.ExpectQuery(regexp.QuoteMeta("LEFT JOIN page_recrawls r ON r.url = p.url")).
+		WithArgs(day, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"title", "url", "language", "content", "etag", "last_modified", "interval_seconds", "gone_count"}).
+			AddRow("Etag", site.URL+"/etag", "en", "Text", `"v1"`, nil, day, 0).
+			AddRow("Lastmod", site.URL+"/lastmod", "en", "Text", nil, lastModified, nil, 0).
+			AddRow("Changed", site.URL+"/changed", "en", "Old text", `"v1"`, nil, (8*time.Hour).Seconds(), 0).
+			AddRow("Same", site.URL+"/same", "en", "Same text", nil, nil, 30*day, 0).
+			AddRow("Gone", site.URL+"/gone", "en", "Text", nil, nil, day, 0).
+			AddRow("Removed", site.URL+"/removed", "en", "Text", nil, nil, day, recrawlGoneAttempts-1).
+			AddRow("Broken", site.URL+"/broken", "en", "Text", `"v1"`, nil, day, 1))
+
+	// Unchanged pages back off, changed ones are saved and recrawled sooner, gone
+	// ones are deleted once they have been gone often enough, and failed ones are
+	// retried within the hour.
+	mock.ExpectExec(scheduleRecrawlQuery).
+		WithArgs(site.URL+"/etag", `"v1"`, "", 2*day, 2*day, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(scheduleRecrawlQuery).
+		WithArgs(site.URL+"/lastmod", "", lastModified, 2*day, 2*day, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO pages").
+		WithArgs(site.URL+"/changed", "Changed", "New text", "en").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(scheduleRecrawlQuery).
+		WithArgs(site.URL+"/changed", `"v2"`, "", recrawlMinInterval.Seconds(), recrawlMinInterval.Seconds(), 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(scheduleRecrawlQuery).
+		WithArgs(site.URL+"/same", "", "", 30*day, 30*day, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(scheduleRecrawlQuery).
+		WithArgs(site.URL+"/gone", "", "", day, recrawlGoneDelay.Seconds(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM pages WHERE url = $1")).
+		WithArgs(site.URL + "/removed").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(scheduleRecrawlQuery).
+		WithArgs(site.URL+"/broken", `"v1"`, "", day, recrawlRetryDelay.Seconds(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stats, err := recrawlStalePages(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Equal(t, RecrawlStats{Changed: 1, Unchanged: 3, Missing: 1, Gone: 1, Failed: 1}, stats)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Runs take turns.
+	recrawlMu.Lock()
+	_, err = recrawlStalePages(context.Background(), 10)
+	recrawlMu.Unlock()
+	assert.ErrorIs(t, err, errRecrawlRunning)
+}
+
+func TestRecrawlPageFoundAgain(t *testing.T) {
+	usePoliteness(t, 0)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/page" || requests.Add(1) == 1 {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = fmt.Fprint(w, "<html><head><title>Page</title></head><body><p>Text</p></body></html>")
+	}))
+	defer server.Close()
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+
+	// A page that is missing once is kept, and found again its count of gone
+	// responses starts over.
+	day := recrawlInitialInterval.Seconds()
+	stale := stalePage{Page: Page{Title: "Page", URL: server.URL + "/page", Language: "en", Content: "Text"}, Interval: recrawlInitialInterval}
+	mock.ExpectExec(scheduleRecrawlQuery).
+		WithArgs(stale.URL, "", "", day, recrawlGoneDelay.Seconds(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	result, err := recrawlPage(context.Background(), stale)
+	require.NoError(t, err)
+	assert.Equal(t, "missing", result)
+
+	stale.GoneCount = 1
+	mock.ExpectExec(scheduleRecrawlQuery).
+		WithArgs(stale.URL, "", "", 2*day, 2*day, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	result, err = recrawlPage(context.Background(), stale)
+	require.NoError(t, err)
+	assert.Equal(t, "unchanged", result)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBackOffRecrawl(t *testing.T) {
+	assert.Equal(t, 2*recrawlInitialInterval, backOffRecrawl(recrawlInitialInterval))
+	assert.Equal(t, recrawlMaxInterval, backOffRecrawl(recrawlMaxInterval-time.Hour))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisTimeout bounds every Redis command without a shorter context deadline.
+	redisTimeout = 500 * time.Millisecond
+	// redisMaxIdleConns is the number of connections kept open between commands.
+	redisMaxIdleConns = 4
+	// redisKeyPrefix namespaces the search cache's keys.
+	redisKeyPrefix = "gosearch:search:"
+)
+
+// newRedisClient returns a client for the Redis server at addr. It works with any
+// Redis-compatible server, e.g. Valkey or KeyDB.
+func newRedisClient(addr, password string) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:                  addr,
+		Password:              password,
+		DialTimeout:           redisTimeout,
+		ReadTimeout:           redisTimeout,
+		WriteTimeout:          redisTimeout,
+		ContextTimeoutEnabled: true,
+		MaxIdleConns:          redisMaxIdleConns,
+	})
+}
+
+// redisCache is a SearchCache in Redis, shared by every GoSearch instance using it.
+// Keys include a generation number, so Invalidate only has to increment it; results
+// under older generations are never read again and expire by themselves.
+type redisCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisCache(client *redis.Client, ttl time.Duration) *redisCache {
+	return &redisCache{client: client, ttl: ttl}
+}
+
+func (c *redisCache) Generation(ctx context.Context) (int64, error) {
+	generation, err := c.client.Get(ctx, redisKeyPrefix+"generation").Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return generation, err
+}
+
+// key returns the Redis key of a cache key in a generation.
+func (c *redisCache) key(generation int64, key string) string {
+	return redisKeyPrefix + strconv.FormatInt(generation, 10) + ":" + key
+}
+
+func (c *redisCache) Get(ctx context.Context, generation int64, key string) (SearchResults, bool, error) {
+	var results SearchResults
+	b, err := c.client.Get(ctx, c.key(generation, key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return results, false, nil
+	}
+	if err != nil {
+		return results, false, err
+	}
+	if err := json.Unmarshal(b, &results); err != nil {
+		return results, false, err
+	}
+	return results, true, nil
+}
+
+// Set stores results under key in generation. Results stored under a generation
+// the cache was invalidated since are never read and expire by themselves.
+func (c *redisCache) Set(ctx context.Context, generation int64, key string, results SearchResults) error {
+	b, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(ctx, c.key(generation, key), b, c.ttl).Err()
+}
+
+func (c *redisCache) Invalidate(ctx context.Context) error {
+	return c.client.Incr(ctx, redisKeyPrefix+"generation").Err()
+}
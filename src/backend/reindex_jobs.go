@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Admins start reindexes from /admin/reindex instead of restarting the server.
+// Each one runs as a ReindexJob in the background; its status is served as JSON
+// and streamed as Server-Sent Events while it runs, and it can be cancelled.
+
+// reindexEventInterval is the least time between two progress events of a job.
+const reindexEventInterval = 500 * time.Millisecond
+
+// States of a reindex job.
+const (
+	reindexRunning   = "running"
+	reindexSucceeded = "succeeded"
+	reindexFailed    = "failed"
+	reindexCancelled = "cancelled"
+)
+
+// errReindexRunning is returned when a reindex job is started while one runs.
+var errReindexRunning = errors.New("a reindex is already running")
+
+// ReindexJob is a reindex of the Elasticsearch pages index started by an admin.
+type ReindexJob struct {
+	id     string
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	state      string
+	progress   ReindexProgress
+	startedAt  time.Time
+	finishedAt time.Time
+	err        error
+	// changed is closed and replaced whenever the job changes.
+	changed chan struct{}
+}
+
+// ReindexJobStatus is a snapshot of a ReindexJob.
+type ReindexJobStatus struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	ReindexProgress
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// ETA estimates when the pages are indexed from the rate so far.
+	ETA   *time.Time `json:"eta,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+var (
+	// reindexJobs holds every reindex job started since the server started, by ID.
+	reindexJobs      = make(map[string]*ReindexJob)
+	reindexJobsMu    sync.Mutex
+	lastReindexJobID int
+	// runReindex is the reindex the jobs run, replaced in tests.
+	runReindex = reindexElasticsearch
+)
+
+// startReindexJob starts a reindex in the background, unless one is running.
+func startReindexJob() (*ReindexJob, error) {
+	reindexJobsMu.Lock()
+	defer reindexJobsMu.Unlock()
+	if runningReindexJobLocked() != nil {
+		return nil, errReindexRunning
+	}
+
+	lastReindexJobID++
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &ReindexJob{
+		id:        strconv.Itoa(lastReindexJobID),
+		cancel:    cancel,
+		state:     reindexRunning,
+		startedAt: time.Now(),
+		changed:   make(chan struct{}),
+	}
+	reindexJobs[job.id] = job
+
+	go func() {
+		defer cancel()
+		err := runReindex(ctx, job.setProgress)
+		job.finish(err, err != nil && ctx.Err() != nil)
+	}()
+	log.Printf("Started reindex job %s", job.id)
+	return job, nil
+}
+
+// runningReindexJob returns the job that is running, or nil if none is.
+func runningReindexJob() *ReindexJob {
+	reindexJobsMu.Lock()
+	defer reindexJobsMu.Unlock()
+	return runningReindexJobLocked()
+}
+
+func runningReindexJobLocked() *ReindexJob {
+	for _, job := range reindexJobs {
+		if job.status().State == reindexRunning {
+			return job
+		}
+	}
+	return nil
+}
+
+// findReindexJob returns the job with the given ID, or nil if there is none.
+func findReindexJob(id string) *ReindexJob {
+	reindexJobsMu.Lock()
+	defer reindexJobsMu.Unlock()
+	return reindexJobs[id]
+}
+
+func (j *ReindexJob) setProgress(progress ReindexProgress) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.progress = progress
+	j.notify()
+}
+
+func (j *ReindexJob) finish(err error, cancelled bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finishedAt = time.Now()
+	j.err = err
+	switch {
+	case cancelled:
+		j.state = reindexCancelled
+	case err != nil:
+		j.state = reindexFailed
+	default:
+		j.state = reindexSucceeded
+	}
+	j.notify()
+	log.Printf("Reindex job %s %s: %d of %d pages processed, %d failed (%v)",
+		j.id, j.state, j.progress.Processed, j.progress.Total, j.progress.Failed, err)
+}
+
+// notify wakes up whoever watches the job. j.mu must be held.
+func (j *ReindexJob) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// watch returns the status of the job and a channel closed when it next changes.
+func (j *ReindexJob) watch() (ReindexJobStatus, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.statusLocked(), j.changed
+}
+
+func (j *ReindexJob) status() ReindexJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.statusLocked()
+}
+
+func (j *ReindexJob) statusLocked() ReindexJobStatus {
+	status := ReindexJobStatus{
+		ID:              j.id,
+		State:           j.state,
+		ReindexProgress: j.progress,
+		StartedAt:       j.startedAt,
+	}
+	if j.state != reindexRunning {
+		finishedAt := j.finishedAt
+		status.FinishedAt = &finishedAt
+	}
+	if j.err != nil {
+		status.Error = j.err.Error()
+	}
+	if j.state == reindexRunning && j.progress.Processed > 0 && j.progress.Total > j.progress.Processed {
+		elapsed := time.Since(j.startedAt)
+		left := time.Duration(float64(elapsed) / float64(j.progress.Processed) * float64(j.progress.Total-j.progress.Processed))
+		eta := time.Now().Add(left)
+		status.ETA = &eta
+	}
+	return status
+}
+
+// reindexPageHandler serves the admin page that starts reindexes and follows their progress.
+func reindexPageHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := loadTemplates("layout.html", "reindex.html")
+	if err != nil {
+		log.Printf("Error parsing templates: %v", err)
+		http.Error(w, "Error loading templates", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]interface{}{
+		"Title":        "Reindex",
+		"UserLoggedIn": true,
+	}
+	// Reloading the page keeps following a running reindex.
+	if job := runningReindexJob(); job != nil {
+		data["RunningJobURL"] = "/api/admin/reindex/" + job.id
+	}
+	if err := tmpl.ExecuteTemplate(w, "layout.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
+
+// apiStartReindexHandler starts a reindex job and returns its status.
+func apiStartReindexHandler(w http.ResponseWriter, r *http.Request) {
+	if esClient == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "Elasticsearch is not in use")
+		return
+	}
+	job, err := startReindexJob()
+	if errors.Is(err, errReindexRunning) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "could not start reindex")
+		return
+	}
+	w.Header().Set("Location", "/api/admin/reindex/"+job.id)
+	writeJSON(w, http.StatusAccepted, job.status())
+}
+
+// apiReindexJobHandler returns the status of a reindex job.
+func apiReindexJobHandler(w http.ResponseWriter, r *http.Request) {
+	job := findReindexJob(mux.Vars(r)["id"])
+	if job == nil {
+		writeJSONError(w, http.StatusNotFound, "no such reindex job")
+		return
+	}
+	writeJSON(w, http.StatusOK, job.status())
+}
+
+// apiCancelReindexHandler cancels a reindex job. The job stops soon after, deleting
+// the index it was building, and its status turns cancelled.
+func apiCancelReindexHandler(w http.ResponseWriter, r *http.Request) {
+	job := findReindexJob(mux.Vars(r)["id"])
+	if job == nil {
+		writeJSONError(w, http.StatusNotFound, "no such reindex job")
+		return
+	}
+	job.cancel()
+	writeJSON(w, http.StatusAccepted, job.status())
+}
+
+// apiReindexEventsHandler streams the status of a reindex job as Server-Sent
+// Events: a progress event whenever it changes, at most every reindexEventInterval,
+// and a done event once it has finished.
+func apiReindexEventsHandler(w http.ResponseWriter, r *http.Request) {
+	job := findReindexJob(mux.Vars(r)["id"])
+	if job == nil {
+		writeJSONError(w, http.StatusNotFound, "no such reindex job")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		status, changed := job.watch()
+		event := "progress"
+		if status.State != reindexRunning {
+			event = "done"
+		}
+		if err := writeServerSentEvent(w, event, status); err != nil {
+			log.Printf("Error writing reindex event: %v", err)
+			return
+		}
+		flusher.Flush()
+		if event == "done" {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		select {
+		case <-time.After(reindexEventInterval):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeServerSentEvent writes one event with data encoded as JSON.
+func writeServerSentEvent(w http.ResponseWriter, event string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded)
+	return err
+}
@@ -0,0 +1,162 @@
+// Unit tests for admin reindex jobs and their progress events
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useFakeReindex makes reindex jobs run reindex and forgets the jobs started
+// before the test.
+func useFakeReindex(t *testing.T, reindex func(ctx context.Context, progress func(ReindexProgress)) error) {
+	previousRun, previousJobs := runReindex, reindexJobs
+	runReindex = reindex
+	reindexJobs = make(map[string]*ReindexJob)
+	t.Cleanup(func() {
+		runReindex = previousRun
+		reindexJobs = previousJobs
+	})
+}
+
+// waitForReindexJob waits until the job has finished and returns its status.
+func waitForReindexJob(t *testing.T, job *ReindexJob) ReindexJobStatus {
+	for {
+		status, changed := job.watch()
+		if status.State != reindexRunning {
+			return status
+		}
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("reindex job did not finish")
+		}
+	}
+}
+
+func TestReindexJob(t *testing.T) {
+	release := make(chan struct{})
+	useFakeReindex(t, func(ctx context.Context, progress func(ReindexProgress)) error {
+		progress(ReindexProgress{Total: 2})
+		progress(ReindexProgress{Total: 2, Processed: 1})
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		progress(ReindexProgress{Total: 2, Processed: 2})
+		return nil
+	})
+
+	job, err := startReindexJob()
+	require.NoError(t, err)
+	_, err = startReindexJob()
+	assert.ErrorIs(t, err, errReindexRunning, "only one reindex runs at a time")
+	assert.Same(t, job, runningReindexJob())
+
+	close(release)
+	status := waitForReindexJob(t, job)
+	assert.Equal(t, reindexSucceeded, status.State)
+	assert.Equal(t, ReindexProgress{Total: 2, Processed: 2}, status.ReindexProgress)
+	assert.NotNil(t, status.FinishedAt)
+	assert.Nil(t, status.ETA)
+	assert.Nil(t, runningReindexJob())
+
+	// Cancelling stops the reindex.
+	release = make(chan struct{})
+	job, err = startReindexJob()
+	require.NoError(t, err)
+	job.cancel()
+	status = waitForReindexJob(t, job)
+	assert.Equal(t, reindexCancelled, status.State)
+	assert.Equal(t, "context canceled", status.Error)
+}
+
+func TestReindexJobETA(t *testing.T) {
+	job := &ReindexJob{
+		state:     reindexRunning,
+		startedAt: time.Now().Add(-10 * time.Second),
+		progress:  ReindexProgress{Total: 30, Processed: 10},
+		changed:   make(chan struct{}),
+	}
+	status := job.status()
+	require.NotNil(t, status.ETA)
+	assert.WithinDuration(t, time.Now().Add(20*time.Second), *status.ETA, time.Second)
+
+	job.progress.Processed = 0
+	assert.Nil(t, job.status().ETA, "there is no rate to estimate from yet")
+}
+
+func TestReindexHandlers(t *testing.T) {
+	useFakeElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {})
+	release := make(chan struct{})
+	useFakeReindex(t, func(ctx context.Context, progress func(ReindexProgress)) error {
+		progress(ReindexProgress{Total: 1})
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		progress(ReindexProgress{Total: 1, Processed: 1})
+		return nil
+	})
+	router := mux.NewRouter()
+	router.HandleFunc("/api/admin/reindex", apiStartReindexHandler).Methods("POST")
+	router.HandleFunc("/api/admin/reindex/{id}", apiReindexJobHandler).Methods("GET")
+	router.HandleFunc("/api/admin/reindex/{id}", apiCancelReindexHandler).Methods("DELETE")
+	router.HandleFunc("/api/admin/reindex/{id}/events", apiReindexEventsHandler).Methods("GET")
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	w := serve(http.MethodPost, "/api/admin/reindex")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	location := w.Header().Get("Location")
+	var status ReindexJobStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(t, "/api/admin/reindex/"+status.ID, location)
+	assert.Equal(t, http.StatusConflict, serve(http.MethodPost, "/api/admin/reindex").Code)
+
+	w = serve(http.MethodGet, location)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"state":"running"`)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/api/admin/reindex/404").Code)
+
+	// The events stream until the job is done.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	w = serve(http.MethodGet, location+"/events")
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	require.GreaterOrEqual(t, len(events), 2)
+	assert.True(t, strings.HasPrefix(events[0], "event: progress\ndata: {"))
+	last := events[len(events)-1]
+	assert.True(t, strings.HasPrefix(last, "event: done\ndata: {"))
+	assert.Contains(t, last, `"state":"succeeded"`)
+	assert.Contains(t, last, `"processed":1`)
+
+	// Cancelling a running job.
+	release = make(chan struct{})
+	w = serve(http.MethodPost, "/api/admin/reindex")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	location = w.Header().Get("Location")
+	page := httptest.NewRecorder()
+	reindexPageHandler(page, httptest.NewRequest(http.MethodGet, "/admin/reindex", nil))
+	assert.Equal(t, http.StatusOK, page.Code)
+	assert.Contains(t, page.Body.String(), `follow("`+location+`")`, "the page follows the running job")
+	assert.Equal(t, http.StatusAccepted, serve(http.MethodDelete, location).Code)
+	w = serve(http.MethodGet, location+"/events")
+	assert.Contains(t, w.Body.String(), `"state":"cancelled"`)
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/gocolly/colly"
 	"golang.org/x/text/cases"
@@ -107,28 +108,29 @@ func buildWikipediaURL(term, lang string) string {
 	return fmt.Sprintf("https://%s.wikipedia.org/wiki/%s", lang, c.String(term))
 }
 
+// wikipediaRequestTimeout bounds each Wikipedia article fetch.
+const wikipediaRequestTimeout = 10 * time.Second
+
+// scrapeWikipedia scrapes a Wikipedia article as its site profile says.
 func scrapeWikipedia(url string, lang string) (Page, error) {
-	c := colly.NewCollector(
+	page := Page{URL: url, Language: lang}
+	profile := siteProfileFor(url)
+	if profile == nil {
+		return page, fmt.Errorf("no site profile matches %s", url)
+	}
+
+	c := newPoliteCollector(wikipediaRequestTimeout,
 		colly.AllowedDomains(fmt.Sprintf("%s.wikipedia.org", lang)),
 	)
 
-	page := Page{URL: url, Language: lang}
 	var statusCode int
 
 	c.OnResponse(func(r *colly.Response) {
 		statusCode = r.StatusCode
 	})
 
-	c.OnHTML("#firstHeading", func(e *colly.HTMLElement) {
-		page.Title = e.Text
-	})
-
-	c.OnHTML("div.mw-parser-output", func(e *colly.HTMLElement) {
-		text := ""
-		e.ForEach("p", func(_ int, el *colly.HTMLElement) {
-			text += el.Text + "\n"
-		})
-		page.Content = text
+	c.OnHTML("html", func(e *colly.HTMLElement) {
+		page.Title, page.Content, page.Language = profile.extract(e)
 	})
 
 	err := c.Visit(url)
@@ -161,6 +163,7 @@ func savePageToDBWithLang(page Page, lang string) error {
 		return fmt.Errorf("error inserting or updating page: %v", err)
 	}
 
+	// The pages outbox consumer indexes the saved page, see startPagesOutboxConsumer.
 	log.Printf("Saved page to DB [%s]: %s", lang, page.Title)
 	return nil
 }
@@ -222,3 +222,22 @@ func TestMarkAsProcessed(t *testing.T) {
 		})
 	}
 }
+
+func TestSavePageToDBWithLang(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+
+	backend := &stubBackend{}
+	useSearchBackend(t, backend)
+
+	page := Page{Title: "Go", URL: "https://da.wikipedia.org/wiki/Go", Content: "Go er et programmeringssprog"}
+	mock.ExpectExec("INSERT INTO pages").
+		WithArgs(page.URL, page.Title, page.Content, "da").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	assert.NoError(t, savePageToDBWithLang(page, "da"))
+	assert.Empty(t, backend.indexed, "the pages outbox indexes saved pages")
+
+	assert.Error(t, savePageToDBWithLang(Page{URL: page.URL}, "da"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,243 +1,124 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
-	"fmt"
+	"bytes"
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
-	"strings"
-	"time"
 )
 
 func searchHandler(w http.ResponseWriter, r *http.Request) {
 	//Henter search-query fra URL-parameteren.
 	log.Println("Search handler called")
 
-	queryParam := strings.TrimSpace(r.URL.Query().Get("q"))
+	searchReq, err := parseSearchRequest(r)
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		// Show syntax errors on the results page, so the query can be corrected.
+		renderSearchPage(w, http.StatusBadRequest, map[string]interface{}{
+			"Query": searchQueryFromRequest(r),
+			"Error": queryErr.Error(),
+		})
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	queryParam := searchReq.Query
 	if queryParam == "" {
 		http.Error(w, "No search query provided", http.StatusBadRequest)
 		return
 	}
-	//TO LOG THE QUERY//
-	log.Printf("Search query: %q from %s", queryParam, r.RemoteAddr)
-	searchLogger.Printf("query=%q from=%s", queryParam, r.RemoteAddr)
+	logSearchQuery(queryParam, r)
 
-	//Nuild search against Elasticsearch
-	pages, err := searchPagesInEs(queryParam)
+	//Nuild search against the configured search backend
+	results, err := searchBackend.Search(r.Context(), searchReq)
 	if err != nil {
-		log.Printf("Error searching Elasticsearch: %v", err)
+		log.Printf("Error searching: %v", err)
 		http.Error(w, "Error during search", http.StatusInternalServerError)
 		return
 	}
 
-	// Build search results from Elasticsearch response
-	var searchResults []map[string]string
-	for _, page := range pages {
-		searchResults = append(searchResults, map[string]string{
-			"title":       page.Title,
-			"url":         page.URL,
-			"description": page.Content,
+	// Build search results from the backend response
+	var searchResults []map[string]interface{}
+	for _, hit := range results.Hits {
+		searchResults = append(searchResults, map[string]interface{}{
+			"title":       highlightHTML(hit.HighlightedTitle),
+			"url":         hit.URL,
+			"description": highlightHTML(hit.Snippet),
 		})
 	}
 
-	tmpl, err := template.ParseFiles(templatePath+"layout.html", templatePath+"search.html")
-	if err != nil {
-		log.Printf("Error parsing search templates: %v", err)
-		http.Error(w, "Error loading search template", http.StatusInternalServerError)
-		return
-	}
-
 	data := map[string]interface{}{
 		"Query":   queryParam,
 		"Results": searchResults,
+		"Total":   results.Total,
+		"Page":    searchReq.Page(),
 	}
-
-	if err := tmpl.ExecuteTemplate(w, "layout.html", data); err != nil {
-		log.Printf("Error executing search template: %v", err)
-		http.Error(w, "Error rendering search results", http.StatusInternalServerError)
+	if corrected := didYouMean(r.Context(), queryParam, results); corrected != "" {
+		data["DidYouMean"] = corrected
+		data["DidYouMeanURL"] = pageURL(r.URL.Path, SearchRequest{Query: corrected, Size: searchReq.Size, Language: searchReq.Language}, 0)
 	}
-}
-
-func searchPagesInEs(query string) ([]Page, error) {
-	///// TESTS FALLBACK ///////////
-	if esClient == nil {
-		// Simple DB search for test mode
-		var pages []Page
-		sqlStmt := "SELECT title, url, content FROM pages WHERE content LIKE ?"
-		likeQ := "%" + query + "%"
-		rows, err := db.Query(sqlStmt, likeQ)
-		if err != nil {
-			return nil, err
-		}
-		defer func() { _ = rows.Close() }()
-
-		for rows.Next() {
-			var p Page
-			if err := rows.Scan(&p.Title, &p.URL, &p.Content); err != nil {
-				continue
-			}
-			pages = append(pages, p)
-		}
-		return pages, nil
+	if len(results.LanguageFacets) > 0 {
+		data["LanguageFacets"] = languageFacetLinks(r.URL.Path, searchReq, results.LanguageFacets)
+		data["AllLanguagesURL"] = pageURL(r.URL.Path, SearchRequest{Query: searchReq.Query, Size: searchReq.Size}, 0)
+		data["Language"] = searchReq.Language
 	}
-	/////// PRODUCTION: real Elasticsearch search ───────────────────────────
-	var pages []Page
-
-	searchBody := strings.NewReader(fmt.Sprintf(`{
-		"query": {
-			"multi_match": {
-				"query": "%s",
-				"fields": ["title^3", "url^2", "content"]
-			}
-		}
-	}`, query))
-
-	res, err := esClient.Search(
-		esClient.Search.WithContext(context.Background()),
-		esClient.Search.WithIndex("pages"),
-		esClient.Search.WithBody(searchBody),
-		esClient.Search.WithTrackTotalHits(true),
-	)
-	if err != nil {
-		return pages, err
+	if searchReq.HasPrevious() {
+		data["PrevURL"] = pageURL(r.URL.Path, searchReq, searchReq.From-searchReq.Size)
 	}
-	defer func() { _ = res.Body.Close() }()
-
-	var r struct {
-		Hits struct {
-			Hits []struct {
-				Source Page `json:"_source"`
-			} `json:"hits"`
-		} `json:"hits"`
+	if searchReq.HasNext(results.Total) {
+		data["NextURL"] = pageURL(r.URL.Path, searchReq, searchReq.From+searchReq.Size)
 	}
 
-	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-		return pages, err
-	}
-
-	for _, hit := range r.Hits.Hits {
-		pages = append(pages, hit.Source)
-	}
-
-	return pages, nil
+	renderSearchPage(w, http.StatusOK, data)
 }
 
-func syncPagesToElasticsearch() error {
-	// Først, slet indekset hvis det eksisterer
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	existsRes, err := esClient.Indices.Exists(
-		[]string{"pages"},
-		esClient.Indices.Exists.WithContext(ctx),
-	)
-	cancel()
-
-	if err != nil {
-		return fmt.Errorf("error checking if index exists: %w", err)
-	}
-
-	if existsRes.StatusCode == 200 {
-		log.Println("Index 'pages' already exists - removing and rebuilding")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		deleteRes, err := esClient.Indices.Delete(
-			[]string{"pages"},
-			esClient.Indices.Delete.WithContext(ctx),
-		)
-		cancel()
-
-		if err != nil {
-			return fmt.Errorf("error deleting index: %w", err)
-		}
-
-		if deleteRes.IsError() {
-			return fmt.Errorf("error response when deleting index: %s", deleteRes.String())
-		}
-	}
-
-	// Opret indekset med korrekte mappings
-	mappings := `{
-        "mappings": {
-            "properties": {
-                "title": { "type": "text" },
-                "url": { "type": "keyword" },
-                "content": { "type": "text" },
-                "language": { "type": "keyword" },
-                "last_updated": { "type": "date" }
-            }
-        }
-    }`
-
-	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-	createRes, err := esClient.Indices.Create(
-		"pages",
-		esClient.Indices.Create.WithBody(strings.NewReader(mappings)),
-		esClient.Indices.Create.WithContext(ctx),
-	)
-	cancel()
-
+// renderSearchPage renders the search results template with the given status.
+func renderSearchPage(w http.ResponseWriter, status int, data map[string]interface{}) {
+	tmpl, err := template.ParseFiles(templatePath+"layout.html", templatePath+"search.html")
 	if err != nil {
-		return fmt.Errorf("error creating index: %w", err)
-	}
-
-	if createRes.IsError() {
-		return fmt.Errorf("error response when creating index: %s", createRes.String())
+		log.Printf("Error parsing search templates: %v", err)
+		http.Error(w, "Error loading search template", http.StatusInternalServerError)
+		return
 	}
 
-	// Hent og indekser alle sider fra databasen
-	rows, err := db.Query("SELECT title, url, content FROM pages")
-	if err != nil {
-		return fmt.Errorf("error querying pages from DB: %w", err)
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "layout.html", data); err != nil {
+		log.Printf("Error executing search template: %v", err)
+		http.Error(w, "Error rendering search results", http.StatusInternalServerError)
+		return
 	}
-	defer func() { _ = rows.Close() }()
-
-	count := 0
-	for rows.Next() {
-		var title, url, content string
-		if err := rows.Scan(&title, &url, &content); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-
-		// Opret dokument med de rigtige feltnavne
-		docMap := map[string]interface{}{
-			"title":        title,
-			"url":          url,
-			"content":      content,
-			"language":     "",
-			"last_updated": time.Now().Format(time.RFC3339),
-		}
-
-		doc, err := json.Marshal(docMap)
-		if err != nil {
-			log.Printf("Error marshaling page: %v", err)
-			continue
-		}
-
-		// Indekser dokumentet med eget generert id.
-		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
-		indexRes, err := esClient.Index(
-			"pages",
-			strings.NewReader(string(doc)),
-			esClient.Index.WithRefresh("true"),
-			esClient.Index.WithContext(ctx),
-		)
-		cancel()
-
-		if err != nil {
-			log.Printf("Error indexing %s: %v", url, err)
-			continue
-		}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = buf.WriteTo(w)
+}
 
-		if indexRes.IsError() {
-			log.Printf("Error response when indexing %s: %s", url, indexRes.String())
+// languageFacetLinks turns language counts into links that restrict the search to that language.
+func languageFacetLinks(path string, searchReq SearchRequest, facets []LanguageFacet) []map[string]interface{} {
+	var links []map[string]interface{}
+	for _, facet := range facets {
+		if facet.Language == "" {
 			continue
 		}
-
-		log.Printf("Indexed page: %s", url)
-		count++
+		facetReq := searchReq
+		facetReq.Language = facet.Language
+		links = append(links, map[string]interface{}{
+			"Language": facet.Language,
+			"Count":    facet.Count,
+			"URL":      pageURL(path, facetReq, 0),
+			"Active":   facet.Language == searchReq.Language,
+		})
 	}
+	return links
+}
 
-	log.Printf("Synced %d pages to Elasticsearch", count)
-	return nil
+// logSearchQuery writes the query to the search log, which the scraper later reads search terms from.
+func logSearchQuery(query string, r *http.Request) {
+	//TO LOG THE QUERY//
+	log.Printf("Search query: %q from %s", query, r.RemoteAddr)
+	searchLogger.Printf("query=%q from=%s", query, r.RemoteAddr)
+	popularQueries.add(query)
 }
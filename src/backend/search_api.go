@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchAPIVersion is the version of the JSON contract served by /api/search.
+// Bump it (and add a new /api/vN/search route) on breaking changes to SearchResponse.
+const searchAPIVersion = "v1"
+
+// SearchResponse is the JSON document returned by /api/search.
+type SearchResponse struct {
+	APIVersion string         `json:"api_version"`
+	Query      string         `json:"query"`
+	Total      int64          `json:"total"`
+	Page       int            `json:"page"`
+	Size       int            `json:"size"`
+	From       int            `json:"from"`
+	Language   string         `json:"language"`
+	TookMs     int64          `json:"took_ms"`
+	Results    []SearchResult `json:"results"`
+	Facets     SearchFacets   `json:"facets"`
+	// DidYouMean is a respelling of a query that found nothing, if one is known.
+	DidYouMean string `json:"did_you_mean,omitempty"`
+}
+
+// SearchFacets holds per-value counts of matching pages, ignoring the filters of the request.
+type SearchFacets struct {
+	Language []FacetCount `json:"language"`
+}
+
+// FacetCount is the number of matching pages with a given field value.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// SearchResult is a single hit in a SearchResponse. Snippet and HighlightedTitle
+// are HTML-escaped, with matched query terms wrapped in <mark> elements.
+type SearchResult struct {
+	Title            string     `json:"title"`
+	HighlightedTitle string     `json:"highlighted_title"`
+	URL              string     `json:"url"`
+	Language         string     `json:"language"`
+	LastUpdated      *time.Time `json:"last_updated"`
+	Score            float64    `json:"score"`
+	Snippet          string     `json:"snippet"`
+}
+
+// APIError describes why an API request failed.
+type APIError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// ErrorResponse is the JSON body returned by the API on errors.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// apiSearchHandler serves /api/search. Clients that prefer HTML (browsers
+// submitting the search form) get the regular search page, everyone else gets JSON.
+func apiSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if prefersHTML(r) {
+		searchHandler(w, r)
+		return
+	}
+
+	start := time.Now()
+
+	searchReq, err := parseSearchRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if searchReq.Query == "" {
+		writeJSONError(w, http.StatusBadRequest, "No search query provided")
+		return
+	}
+	logSearchQuery(searchReq.Query, r)
+
+	results, err := searchBackend.Search(r.Context(), searchReq)
+	if err != nil {
+		log.Printf("Error searching: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error during search")
+		return
+	}
+
+	response := newSearchResponse(searchReq, results, time.Since(start))
+	response.DidYouMean = didYouMean(r.Context(), searchReq.Query, results)
+	writeJSON(w, http.StatusOK, response)
+}
+
+// newSearchResponse converts search results into the JSON contract.
+func newSearchResponse(searchReq SearchRequest, results SearchResults, took time.Duration) SearchResponse {
+	response := SearchResponse{
+		APIVersion: searchAPIVersion,
+		Query:      searchReq.Query,
+		Total:      results.Total,
+		Page:       searchReq.Page(),
+		Size:       searchReq.Size,
+		From:       searchReq.From,
+		Language:   languageValue(searchReq.Language),
+		TookMs:     took.Milliseconds(),
+		Results:    make([]SearchResult, 0, len(results.Hits)),
+		Facets:     SearchFacets{Language: make([]FacetCount, 0, len(results.LanguageFacets))},
+	}
+
+	for _, facet := range results.LanguageFacets {
+		response.Facets.Language = append(response.Facets.Language, FacetCount{Value: facet.Language, Count: facet.Count})
+	}
+
+	for _, hit := range results.Hits {
+		result := SearchResult{
+			Title:            hit.Title,
+			HighlightedTitle: string(highlightHTML(hit.HighlightedTitle)),
+			URL:              hit.URL,
+			Language:         hit.Language,
+			Score:            hit.Score,
+			Snippet:          string(highlightHTML(hit.Snippet)),
+		}
+		if !hit.LastUpdated.IsZero() {
+			lastUpdated := hit.LastUpdated
+			result.LastUpdated = &lastUpdated
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	return response
+}
+
+// prefersHTML reports whether the Accept header ranks text/html above application/json.
+func prefersHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return acceptQuality(accept, "text/html") > acceptQuality(accept, "application/json")
+}
+
+// acceptQuality returns the q-value the Accept header assigns to mediaType,
+// using the most specific matching media range. It returns 0 if nothing matches.
+func acceptQuality(accept, mediaType string) float64 {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+
+	bestQuality := 0.0
+	bestSpecificity := -1
+	for _, part := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		specificity := -1
+		switch {
+		case rangeType == mediaType:
+			specificity = 2
+		case rangeType == mainType+"/*":
+			specificity = 1
+		case rangeType == "*/*":
+			specificity = 0
+		}
+		if specificity <= bestSpecificity {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+		bestQuality = quality
+		bestSpecificity = specificity
+	}
+
+	return bestQuality
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{Error: APIError{Status: status, Message: message}})
+}
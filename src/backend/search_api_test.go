@@ -0,0 +1,281 @@
+// Unit tests for the JSON search API
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	fallbackFacetQuery  = `SELECT language, COUNT(*) FROM pages WHERE content LIKE ? ESCAPE '\' GROUP BY language ORDER BY COUNT(*) DESC`
+	fallbackCountQuery  = `SELECT COUNT(*) FROM pages WHERE content LIKE ? ESCAPE '\'`
+	fallbackSearchQuery = `SELECT title, url, language, last_updated, content FROM pages WHERE content LIKE ? ESCAPE '\' ORDER BY title LIMIT ? OFFSET ?`
+)
+
+// useSearchBackend makes handlers search with backend for the rest of the test.
+func useSearchBackend(t *testing.T, backend SearchBackend) {
+	t.Helper()
+	previous := searchBackend
+	searchBackend = backend
+	t.Cleanup(func() { searchBackend = previous })
+}
+
+// expectFallbackSearch sets up the facet, count and page queries of the SQLite backend
+// for a search across all languages.
+func expectFallbackSearch(mock sqlmock.Sqlmock, like string, total, size, from int, rows *sqlmock.Rows) {
+	mock.ExpectQuery(regexp.QuoteMeta(fallbackFacetQuery)).
+		WithArgs(like).
+		WillReturnRows(sqlmock.NewRows([]string{"language", "count"}).AddRow("en", total))
+	mock.ExpectQuery(regexp.QuoteMeta(fallbackCountQuery)).
+		WithArgs(like).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(total))
+	mock.ExpectQuery(regexp.QuoteMeta(fallbackSearchQuery)).
+		WithArgs(like, size, from).
+		WillReturnRows(rows)
+}
+
+func TestAcceptQuality(t *testing.T) {
+	tests := []struct {
+		name     string
+		accept   string
+		expected bool
+	}{
+		{name: "Browser", accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", expected: true},
+		{name: "JSON client", accept: "application/json", expected: false},
+		{name: "Wildcard", accept: "*/*", expected: false},
+		{name: "No header", accept: "", expected: false},
+		{name: "JSON preferred", accept: "text/html;q=0.5, application/json", expected: false},
+		{name: "HTML preferred", accept: "application/json;q=0.4, text/*", expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/search?q=go", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			assert.Equal(t, tt.expected, prefersHTML(req))
+		})
+	}
+}
+
+func TestAPISearchReturnsJSON(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	useSearchBackend(t, sqliteBackend{})
+
+	lastUpdated := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	expectFallbackSearch(mock, "%golang%", 1, defaultSearchSize, 0,
+		sqlmock.NewRows([]string{"title", "url", "language", "last_updated", "content"}).
+			AddRow("Go", "https://en.wikipedia.org/wiki/Go", "en", lastUpdated, "golang is a language"))
+
+	req := httptest.NewRequest("GET", "/api/search?q=golang", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+
+	apiSearchHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+
+	var response SearchResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, searchAPIVersion, response.APIVersion)
+	assert.Equal(t, "golang", response.Query)
+	assert.Equal(t, int64(1), response.Total)
+	if assert.Len(t, response.Results, 1) {
+		assert.Equal(t, "Go", response.Results[0].Title)
+		assert.Equal(t, "en", response.Results[0].Language)
+		assert.True(t, lastUpdated.Equal(*response.Results[0].LastUpdated))
+		assert.Equal(t, "<mark>golang</mark> is a language", response.Results[0].Snippet)
+	}
+	assert.Equal(t, allLanguages, response.Language)
+	assert.Equal(t, []FacetCount{{Value: "en", Count: 1}}, response.Facets.Language)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAPISearchPostJSONBody(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	useSearchBackend(t, sqliteBackend{})
+
+	expectFallbackSearch(mock, "%python%", 0, 5, 10,
+		sqlmock.NewRows([]string{"title", "url", "language", "last_updated", "content"}))
+
+	req := httptest.NewRequest("POST", "/api/search", strings.NewReader(`{"q": "python", "page": 3, "size": 5}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	apiSearchHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"results":[]`)
+	response := decodeSearchResponse(t, w)
+	assert.Equal(t, "python", response.Query)
+	assert.Equal(t, 3, response.Page)
+	assert.Equal(t, 10, response.From)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAPISearchErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		target         string
+		body           string
+		expectedStatus int
+	}{
+		{name: "Missing query", method: "GET", target: "/api/search", expectedStatus: http.StatusBadRequest},
+		{name: "Blank query", method: "GET", target: "/api/search?q=%20%20", expectedStatus: http.StatusBadRequest},
+		{name: "Invalid JSON", method: "POST", target: "/api/search", body: `{"q":`, expectedStatus: http.StatusBadRequest},
+		{name: "Negative from in JSON", method: "POST", target: "/api/search", body: `{"q":"go","from":-1}`, expectedStatus: http.StatusBadRequest},
+		{name: "Invalid page", method: "GET", target: "/api/search?q=go&page=abc", expectedStatus: http.StatusBadRequest},
+		{name: "Size too large", method: "GET", target: "/api/search?q=go&size=1000", expectedStatus: http.StatusBadRequest},
+		{name: "Unsupported language", method: "GET", target: "/api/search?q=go&lang=fr", expectedStatus: http.StatusBadRequest},
+		{name: "Invalid query syntax", method: "GET", target: "/api/search?q=%22go+routines", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			w := httptest.NewRecorder()
+
+			apiSearchHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			var response ErrorResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tt.expectedStatus, response.Error.Status)
+			assert.NotEmpty(t, response.Error.Message)
+		})
+	}
+}
+
+func TestAPISearchRendersHTMLForBrowsers(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	useSearchBackend(t, sqliteBackend{})
+
+	expectFallbackSearch(mock, "%golang%", 3, 1, 1,
+		sqlmock.NewRows([]string{"title", "url", "language", "last_updated", "content"}).
+			AddRow("Go", "https://en.wikipedia.org/wiki/Go", "en", nil, "golang is a language"))
+
+	req := httptest.NewRequest("GET", "/api/search?q=golang&page=2&size=1", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	w := httptest.NewRecorder()
+
+	apiSearchHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, w.Body.String(), "Search Results for")
+	assert.Contains(t, w.Body.String(), "<mark>golang</mark> is a language")
+	assert.Contains(t, w.Body.String(), `href="/api/search?lang=all&amp;page=1&amp;q=golang&amp;size=1"`)
+	assert.Contains(t, w.Body.String(), `href="/api/search?lang=all&amp;page=3&amp;q=golang&amp;size=1"`)
+}
+
+func TestSearchShowsQueryErrors(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/search?q=go+site%3A", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+
+	apiSearchHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, w.Body.String(), `Search Results for "go site:"`)
+	assert.Contains(t, w.Body.String(), "invalid search query: site: needs a value")
+	assert.NotContains(t, w.Body.String(), "No results found")
+}
+
+func TestParseSearchRequest(t *testing.T) {
+	tests := []struct {
+		name           string
+		target         string
+		acceptLanguage string
+		expected       SearchRequest
+		expectedErr    bool
+	}{
+		{name: "Defaults", target: "/search?q=go", expected: SearchRequest{Query: "go", From: 0, Size: defaultSearchSize}},
+		{name: "Page and size", target: "/search?q=go&page=3&size=20", expected: SearchRequest{Query: "go", From: 40, Size: 20}},
+		{name: "From overrides page", target: "/search?q=go&page=3&from=7", expected: SearchRequest{Query: "go", From: 7, Size: defaultSearchSize}},
+		{name: "Page zero", target: "/search?q=go&page=0", expectedErr: true},
+		{name: "Negative from", target: "/search?q=go&from=-1", expectedErr: true},
+		{name: "Beyond result window", target: "/search?q=go&from=9995&size=10", expectedErr: true},
+		{name: "Last page of result window", target: "/search?q=go&page=1000&size=10", expected: SearchRequest{Query: "go", From: 9990, Size: 10}},
+		{name: "Page beyond result window", target: "/search?q=go&page=1001&size=10", expectedErr: true},
+		{name: "Page overflowing from", target: "/search?q=go&page=9223372036854775807&size=100", expectedErr: true},
+		{name: "From overflowing the result window", target: "/search?q=go&from=9223372036854775807", expectedErr: true},
+		{name: "Language filter", target: "/search?q=go&lang=DA", expected: SearchRequest{Query: "go", Size: defaultSearchSize, Language: "da"}},
+		{name: "Legacy language parameter", target: "/search?q=go&language=en", expected: SearchRequest{Query: "go", Size: defaultSearchSize, Language: "en"}},
+		{name: "Language from Accept-Language", target: "/search?q=go", acceptLanguage: "fr-FR, da-DK;q=0.8, en;q=0.5", expected: SearchRequest{Query: "go", Size: defaultSearchSize, Language: "da"}},
+		{name: "All languages overrides Accept-Language", target: "/search?q=go&lang=all", acceptLanguage: "da", expected: SearchRequest{Query: "go", Size: defaultSearchSize}},
+		{name: "Unsupported Accept-Language", target: "/search?q=go", acceptLanguage: "de-DE", expected: SearchRequest{Query: "go", Size: defaultSearchSize}},
+		{name: "Unsupported language", target: "/search?q=go&lang=sv", expectedErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			searchReq, err := parseSearchRequest(req)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, searchReq)
+		})
+	}
+}
+
+func decodeSearchResponse(t *testing.T, w *httptest.ResponseRecorder) SearchResponse {
+	t.Helper()
+	var response SearchResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response
+}
+
+func TestAPISearchLanguageFilter(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	useSearchBackend(t, sqliteBackend{})
+
+	mock.ExpectQuery(regexp.QuoteMeta(fallbackFacetQuery)).
+		WithArgs("%go%").
+		WillReturnRows(sqlmock.NewRows([]string{"language", "count"}).AddRow("en", 4).AddRow("da", 2))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM pages WHERE content LIKE ? ESCAPE '\' AND language = ?`)).
+		WithArgs("%go%", "da").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT title, url, language, last_updated, content FROM pages WHERE content LIKE ? ESCAPE '\' AND language = ? ORDER BY title LIMIT ? OFFSET ?`)).
+		WithArgs("%go%", "da", defaultSearchSize, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"title", "url", "language", "last_updated", "content"}).
+			AddRow("Go", "https://da.wikipedia.org/wiki/Go", "da", nil, "go er et sprog"))
+
+	req := httptest.NewRequest("GET", "/api/search?q=go", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Accept-Language", "da-DK,da;q=0.9,en;q=0.8")
+	w := httptest.NewRecorder()
+
+	apiSearchHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	response := decodeSearchResponse(t, w)
+	assert.Equal(t, "da", response.Language)
+	assert.Equal(t, int64(2), response.Total)
+	assert.Equal(t, []FacetCount{{Value: "en", Count: 4}, {Value: "da", Count: 2}}, response.Facets.Language)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
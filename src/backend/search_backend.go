@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SearchBackend finds pages for a search request. The pages table is always the
+// source of truth: backends that keep their own copy of it (Elasticsearch) are
+// updated through Index and Delete, backends that query the table directly ignore them.
+type SearchBackend interface {
+	Search(ctx context.Context, req SearchRequest) (SearchResults, error)
+	// Suggest returns up to size page titles starting with prefix, ignoring case.
+	Suggest(ctx context.Context, prefix string, size int) ([]string, error)
+	// Correct returns better spellings of the lower-case words it thinks are misspelled.
+	Correct(ctx context.Context, words []string) (map[string]string, error)
+	Index(ctx context.Context, page Page) error
+	Delete(ctx context.Context, url string) error
+	Stats(ctx context.Context) (SearchBackendStats, error)
+}
+
+// SearchBackendStats describes the state of a search backend.
+type SearchBackendStats struct {
+	Backend   string `json:"backend"`
+	Documents int64  `json:"documents"`
+}
+
+// Names accepted by the SEARCH_BACKEND and SEARCH_FALLBACK_BACKEND environment variables.
+const (
+	elasticsearchBackendName = "elasticsearch"
+	postgresBackendName      = "postgres"
+	sqliteBackendName        = "sqlite"
+	embeddedBackendName      = "embedded"
+	noSearchBackendName      = "none"
+)
+
+// searchBackend serves all searches. It is chosen by newSearchBackendWithFallback at startup.
+var searchBackend SearchBackend
+
+// newSearchBackend returns the backend with the given name. The Elasticsearch
+// backend expects initElasticsearch to have been called, the embedded backend
+// loads its index from searchIndexPath.
+func newSearchBackend(name string) (SearchBackend, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", elasticsearchBackendName:
+		return newElasticsearchBackend(), nil
+	case postgresBackendName:
+		return postgresBackend{}, nil
+	case sqliteBackendName:
+		return sqliteBackend{}, nil
+	case embeddedBackendName:
+		return newEmbeddedBackend(context.Background(), searchIndexPath)
+	default:
+		return nil, fmt.Errorf("unknown search backend %q (expected %s, %s, %s or %s)",
+			name, elasticsearchBackendName, postgresBackendName, sqliteBackendName, embeddedBackendName)
+	}
+}
+
+// countPages returns the number of rows in the pages table.
+func countPages(ctx context.Context) (int64, error) {
+	var count int64
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pages").Scan(&count)
+	return count, err
+}
+
+// likePrefixPattern returns a LIKE pattern, with '\' as escape character, matching
+// lower-case text starting with prefix.
+func likePrefixPattern(prefix string) string {
+	return escapeLike(strings.ToLower(prefix)) + "%"
+}
+
+// escapeLike escapes the wildcards in text, and '\' itself, for a LIKE pattern with
+// '\' as escape character.
+func escapeLike(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text)
+}
+
+// queryTitles reads the titles returned by a single-column query.
+func queryTitles(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var titles []string
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			return nil, err
+		}
+		titles = append(titles, title)
+	}
+	return titles, rows.Err()
+}
+
+// scanLanguageFacets reads (language, count) rows.
+func scanLanguageFacets(rows *sql.Rows) ([]LanguageFacet, error) {
+	defer func() { _ = rows.Close() }()
+
+	var facets []LanguageFacet
+	for rows.Next() {
+		var language sql.NullString
+		var facet LanguageFacet
+		if err := rows.Scan(&language, &facet.Count); err != nil {
+			return nil, err
+		}
+		facet.Language = language.String
+		facets = append(facets, facet)
+	}
+	return facets, rows.Err()
+}
+
+// scanPage reads a (title, url, language, last_updated, content) row, followed by any extra columns.
+func scanPage(rows *sql.Rows, extra ...interface{}) (Page, error) {
+	var p Page
+	var language sql.NullString
+	var lastUpdated sql.NullTime
+
+	dest := append([]interface{}{&p.Title, &p.URL, &language, &lastUpdated, &p.Content}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return p, err
+	}
+	p.Language = language.String
+	p.LastUpdated = lastUpdated.Time
+	return p, nil
+}
@@ -0,0 +1,436 @@
+// Unit tests for the search backends
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSearchBackend(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected SearchBackend
+	}{
+		{name: "", expected: newElasticsearchBackend()},
+		{name: "elasticsearch", expected: newElasticsearchBackend()},
+		{name: "Postgres", expected: postgresBackend{}},
+		{name: " sqlite ", expected: sqliteBackend{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, err := newSearchBackend(tt.name)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, backend)
+		})
+	}
+
+	_, err := newSearchBackend("solr")
+	assert.Error(t, err)
+}
+
+func TestPostgresBackendSearch(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+
+	mock.ExpectQuery(`SELECT language, COUNT\(\*\) FROM pages WHERE \(\(language = 'da' AND .*websearch_to_tsquery\('danish', \$1\)\) OR .*websearch_to_tsquery\('english', \$1\)\)\) AND NOT \(.*websearch_to_tsquery\('english', \$2\).*\) GROUP BY language`).
+		WithArgs(`"go routines"`, "java").
+		WillReturnRows(sqlmock.NewRows([]string{"language", "count"}).AddRow("en", 3).AddRow("da", 1))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM pages WHERE .*websearch_to_tsquery.* AND language = \$3`).
+		WithArgs(`"go routines"`, "java", "en").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(`SELECT title, url, language, last_updated, score,\s+ts_headline\(.*\$5\) AS snippet,\s+ts_headline\(.*\$6\) AS highlighted_title.*ts_rank_cd\('\{0.1, 0.2, 0.4, 1.0\}', pages_search_vector\(language, title, content\), websearch_to_tsquery\(pages_search_config\(language\), \$4\), 1\) AS score.* AND language = \$3\s+ORDER BY score DESC, title LIMIT \$7 OFFSET \$8`).
+		WithArgs(`"go routines"`, "java", "en", `"go routines"`, postgresSnippetOptions, postgresTitleOptions, 10, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"title", "url", "language", "last_updated", "score", "snippet", "highlighted_title"}).
+			AddRow("Goroutine", "https://en.wikipedia.org/wiki/Goroutine", "en", time.Now(), 0.8,
+				"Go "+highlightPreTag+"routines"+highlightPostTag+" are cheap", highlightPreTag+"Goroutine"+highlightPostTag))
+
+	results, err := postgresBackend{}.Search(context.Background(), SearchRequest{Query: `"go routines" -java`, Size: 10, Language: "en"})
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), results.Total)
+	assert.Equal(t, []LanguageFacet{{Language: "en", Count: 3}, {Language: "da", Count: 1}}, results.LanguageFacets)
+	if assert.Len(t, results.Hits, 1) {
+		assert.Equal(t, "Goroutine", results.Hits[0].Title)
+		assert.Equal(t, "en", results.Hits[0].Language)
+		assert.Equal(t, 0.8, results.Hits[0].Score)
+		assert.Contains(t, results.Hits[0].Snippet, highlightPreTag+"routines"+highlightPostTag)
+		assert.Equal(t, highlightPreTag+"Goroutine"+highlightPostTag, results.Hits[0].HighlightedTitle)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// stubBackend is a SearchBackend that returns fixed results and records indexed pages.
+type stubBackend struct {
+	SearchBackend
+	results     SearchResults
+	suggestions []string
+	corrections map[string]string
+	err         error
+	calls       int
+	indexed     []Page
+	deleted     []string
+	// indexErr is returned by Index and Delete.
+	indexErr error
+	// failURLs are the URLs of pages that fail to index.
+	failURLs map[string]bool
+}
+
+func (b *stubBackend) Search(ctx context.Context, searchReq SearchRequest) (SearchResults, error) {
+	b.calls++
+	return b.results, b.err
+}
+
+func (b *stubBackend) Suggest(ctx context.Context, prefix string, size int) ([]string, error) {
+	b.calls++
+	return b.suggestions, b.err
+}
+
+func (b *stubBackend) Correct(ctx context.Context, words []string) (map[string]string, error) {
+	b.calls++
+	return b.corrections, b.err
+}
+
+func (b *stubBackend) Index(ctx context.Context, page Page) error {
+	if b.indexErr != nil {
+		return b.indexErr
+	}
+	if b.failURLs[page.URL] {
+		return errors.New("mapper_parsing_exception")
+	}
+	b.indexed = append(b.indexed, page)
+	return nil
+}
+
+func (b *stubBackend) Delete(ctx context.Context, url string) error {
+	if b.indexErr != nil {
+		return b.indexErr
+	}
+	b.deleted = append(b.deleted, url)
+	return nil
+}
+
+func TestFallbackBackendSearch(t *testing.T) {
+	fallbackResults := SearchResults{Total: 1, Hits: []SearchHit{{Page: Page{Title: "Go"}}}}
+
+	t.Run("primary succeeds", func(t *testing.T) {
+		primary := &stubBackend{results: SearchResults{Total: 2}}
+		fallback := &stubBackend{results: fallbackResults}
+		backend := &fallbackBackend{SearchBackend: primary, primaryName: "elasticsearch", fallback: fallback, fallbackName: "postgres"}
+
+		results, err := backend.Search(context.Background(), SearchRequest{Query: "go"})
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), results.Total)
+		assert.Equal(t, 0, fallback.calls)
+	})
+
+	t.Run("primary fails", func(t *testing.T) {
+		primary := &stubBackend{err: errors.New("connection refused")}
+		fallback := &stubBackend{results: fallbackResults}
+		backend := &fallbackBackend{SearchBackend: primary, primaryName: "elasticsearch", fallback: fallback, fallbackName: "postgres"}
+		before := testutil.ToFloat64(searchBackendFallbacksTotal.WithLabelValues("elasticsearch", "postgres"))
+
+		results, err := backend.Search(context.Background(), SearchRequest{Query: "go"})
+		require.NoError(t, err)
+		assert.Equal(t, fallbackResults, results)
+		assert.Equal(t, 1, fallback.calls)
+		assert.Equal(t, before+1, testutil.ToFloat64(searchBackendFallbacksTotal.WithLabelValues("elasticsearch", "postgres")))
+	})
+
+	t.Run("request cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		primary := &stubBackend{err: context.Canceled}
+		fallback := &stubBackend{results: fallbackResults}
+		backend := &fallbackBackend{SearchBackend: primary, primaryName: "elasticsearch", fallback: fallback, fallbackName: "postgres"}
+
+		_, err := backend.Search(ctx, SearchRequest{Query: "go"})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 0, fallback.calls)
+	})
+}
+
+func TestFallbackBackendSuggest(t *testing.T) {
+	primary := &stubBackend{err: errors.New("connection refused")}
+	fallback := &stubBackend{suggestions: []string{"Go"}}
+	backend := &fallbackBackend{SearchBackend: primary, primaryName: "elasticsearch", fallback: fallback, fallbackName: "postgres"}
+
+	titles, err := backend.Suggest(context.Background(), "g", 5)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Go"}, titles)
+	assert.Equal(t, 1, fallback.calls)
+}
+
+func TestNewSearchBackendWithFallback(t *testing.T) {
+	backend, err := newSearchBackendWithFallback("elasticsearch", "postgres")
+	require.NoError(t, err)
+	if assert.IsType(t, &fallbackBackend{}, backend) {
+		assert.Equal(t, postgresBackend{}, backend.(*fallbackBackend).fallback)
+	}
+
+	for _, fallbackName := range []string{"", "none", "postgres"} {
+		backend, err := newSearchBackendWithFallback("postgres", fallbackName)
+		require.NoError(t, err)
+		assert.Equal(t, postgresBackend{}, backend, "fallback %q", fallbackName)
+	}
+
+	_, err = newSearchBackendWithFallback("elasticsearch", "solr")
+	assert.Error(t, err)
+}
+
+func TestEmbeddedBackend(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+
+	path := filepath.Join(t.TempDir(), "index.gob")
+	updated := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	pageColumns := []string{"title", "url", "language", "last_updated", "content"}
+
+	// The first start builds the index from the pages table.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT url, last_updated FROM pages")).
+		WillReturnRows(sqlmock.NewRows([]string{"url", "last_updated"}).
+			AddRow("https://en.wikipedia.org/wiki/Go", updated).
+			AddRow("https://da.wikipedia.org/wiki/Go", updated))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT title, url, language, last_updated, content FROM pages")).
+		WillReturnRows(sqlmock.NewRows(pageColumns).
+			AddRow("Go", "https://en.wikipedia.org/wiki/Go", "en", updated, "Go is a programming language").
+			AddRow("Go", "https://da.wikipedia.org/wiki/Go", "da", updated, "Go er et programmeringssprog"))
+
+	backend, err := newEmbeddedBackend(context.Background(), path)
+	require.NoError(t, err)
+
+	results, err := backend.Search(context.Background(), SearchRequest{Query: "go", Size: 1, Language: "en"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), results.Total)
+	assert.Equal(t, []LanguageFacet{{Language: "da", Count: 1}, {Language: "en", Count: 1}}, results.LanguageFacets)
+	if assert.Len(t, results.Hits, 1) {
+		assert.Equal(t, "https://en.wikipedia.org/wiki/Go", results.Hits[0].URL)
+		assert.Equal(t, highlightPreTag+"Go"+highlightPostTag, results.Hits[0].HighlightedTitle)
+		assert.Greater(t, results.Hits[0].Score, 0.0)
+	}
+
+	results, err = backend.Search(context.Background(), SearchRequest{Query: "go", From: 5, Size: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), results.Total)
+	assert.Empty(t, results.Hits)
+
+	require.NoError(t, backend.Index(context.Background(), Page{Title: "Gopher", URL: "https://en.wikipedia.org/wiki/Gopher", Language: "en", Content: "A rodent"}))
+	stats, err := backend.Stats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, SearchBackendStats{Backend: embeddedBackendName, Documents: 3}, stats)
+
+	// Changes are saved periodically and when the backend is closed, not on every change.
+	saved, err := loadInvertedIndex(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, saved.len())
+	require.NoError(t, backend.Close())
+	saved, err = loadInvertedIndex(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, saved.len())
+
+	// A restart loads the saved index and only reads changed pages.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT url, last_updated FROM pages")).
+		WillReturnRows(sqlmock.NewRows([]string{"url", "last_updated"}).
+			AddRow("https://en.wikipedia.org/wiki/Go", updated.Add(time.Hour)).
+			AddRow("https://da.wikipedia.org/wiki/Go", updated))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT title, url, language, last_updated, content FROM pages")).
+		WillReturnRows(sqlmock.NewRows(pageColumns).
+			AddRow("Go", "https://en.wikipedia.org/wiki/Go", "en", updated.Add(time.Hour), "Go is a board game").
+			AddRow("Go", "https://da.wikipedia.org/wiki/Go", "da", updated, "Go er et programmeringssprog"))
+
+	backend, err = newEmbeddedBackend(context.Background(), path)
+	require.NoError(t, err)
+	defer func() { _ = backend.Close() }()
+
+	stats, err = backend.Stats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Documents, "pages deleted from the table are removed")
+	results, err = backend.Search(context.Background(), SearchRequest{Query: "board", Size: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), results.Total)
+
+	// Nothing changed, so nothing is read.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT url, last_updated FROM pages")).
+		WillReturnRows(sqlmock.NewRows([]string{"url", "last_updated"}).
+			AddRow("https://en.wikipedia.org/wiki/Go", updated.Add(time.Hour)).
+			AddRow("https://da.wikipedia.org/wiki/Go", updated))
+
+	unchanged, err := newEmbeddedBackend(context.Background(), path)
+	require.NoError(t, err)
+	assert.NoError(t, unchanged.Close())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLBackendStats(t *testing.T) {
+	for _, backend := range []SearchBackend{postgresBackend{}, sqliteBackend{}} {
+		mockDB, mock := setupMockDB()
+
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM pages")).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(42))
+
+		stats, err := backend.Stats(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, int64(42), stats.Documents)
+		assert.NoError(t, backend.Index(context.Background(), Page{URL: "https://example.com"}))
+		assert.NoError(t, backend.Delete(context.Background(), "https://example.com"))
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		_ = mockDB.Close()
+	}
+}
+
+func TestSQLBackendSuggest(t *testing.T) {
+	tests := []struct {
+		backend SearchBackend
+		query   string
+	}{
+		{backend: postgresBackend{}, query: `SELECT DISTINCT title FROM pages WHERE lower(title) LIKE $1 ESCAPE '\' ORDER BY title LIMIT $2`},
+		{backend: sqliteBackend{}, query: `SELECT DISTINCT title FROM pages WHERE LOWER(title) LIKE ? ESCAPE '\' ORDER BY title LIMIT ?`},
+	}
+
+	for _, tt := range tests {
+		mockDB, mock := setupMockDB()
+
+		mock.ExpectQuery(regexp.QuoteMeta(tt.query)).
+			WithArgs(`go\_rou%`, 5).
+			WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Go_routine"))
+
+		titles, err := tt.backend.Suggest(context.Background(), "Go_Rou", 5)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Go_routine"}, titles)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		_ = mockDB.Close()
+	}
+}
+
+func TestLikePrefixPattern(t *testing.T) {
+	assert.Equal(t, "go%", likePrefixPattern("Go"))
+	assert.Equal(t, `100\% \_ c:\\%`, likePrefixPattern(`100% _ C:\`))
+}
+
+func TestElasticsearchBackendDocuments(t *testing.T) {
+	type request struct {
+		method string
+		path   string
+		body   string
+	}
+	var requests []request
+
+	useFakeElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, request{method: r.Method, path: r.URL.Path, body: string(body)})
+
+		switch {
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"result":"not_found"}`)
+		case r.URL.Path == "/pages/_count":
+			_, _ = io.WriteString(w, `{"count":7}`)
+		default:
+			_, _ = io.WriteString(w, `{"result":"created"}`)
+		}
+	})
+
+	backend := newElasticsearchBackend()
+	page := Page{
+		Title:       "Go",
+		URL:         "https://en.wikipedia.org/wiki/Go",
+		Content:     "Go is a language",
+		Language:    "en",
+		LastUpdated: time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	require.NoError(t, backend.Index(context.Background(), page))
+	require.NoError(t, backend.Delete(context.Background(), page.URL), "deleting a missing document is not an error")
+	stats, err := backend.Stats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, SearchBackendStats{Backend: elasticsearchBackendName, Documents: 7}, stats)
+
+	id := pageDocumentID(page.URL)
+	require.Len(t, requests, 3)
+	assert.Equal(t, http.MethodPut, requests[0].method)
+	assert.Equal(t, "/pages/_doc/"+id, requests[0].path)
+	var doc esPageDocument
+	require.NoError(t, json.Unmarshal([]byte(requests[0].body), &doc))
+	assert.Equal(t, "en", doc.Language)
+	assert.Equal(t, "2025-05-01T12:00:00Z", doc.LastUpdated)
+	assert.Equal(t, "Go", doc.TitleSuggest)
+	assert.Equal(t, "/pages/_doc/"+id, requests[1].path)
+	assert.Equal(t, http.MethodDelete, requests[1].method)
+}
+
+func TestElasticsearchBackendSuggest(t *testing.T) {
+	var body string
+	useFakeElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		_, _ = io.WriteString(w, `{"suggest": {"titles": [{"text": "go", "options": [{"text": "Go"}, {"text": "Goroutine"}]}]}}`)
+	})
+
+	titles, err := newElasticsearchBackend().Suggest(context.Background(), "go", 5)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Go", "Goroutine"}, titles)
+	assert.JSONEq(t, `{
+		"size": 0,
+		"_source": false,
+		"suggest": {"titles": {"prefix": "go", "completion": {"field": "title_suggest", "size": 5, "skip_duplicates": true}}}
+	}`, body)
+}
+
+func TestElasticsearchBackendCorrect(t *testing.T) {
+	var body string
+	response := `{"suggest": {"spelling": [{"text": "golnag programing", "options": [{"text": "golang programming", "score": 0.2}]}]}}`
+	useFakeElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		_, _ = io.WriteString(w, response)
+	})
+
+	corrections, err := newElasticsearchBackend().Correct(context.Background(), []string{"golnag", "programing"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"golnag": "golang", "programing": "programming"}, corrections)
+	assert.JSONEq(t, `{
+		"size": 0,
+		"_source": false,
+		"suggest": {"spelling": {"text": "golnag programing", "phrase": {
+			"field": "content", "size": 1, "max_errors": 2,
+			"direct_generator": [{"field": "content", "suggest_mode": "always"}, {"field": "title", "suggest_mode": "always"}]
+		}}}
+	}`, body)
+
+	// A suggestion that joins words can't be paired with them.
+	response = `{"suggest": {"spelling": [{"text": "go lang", "options": [{"text": "golang", "score": 0.2}]}]}}`
+	corrections, err = newElasticsearchBackend().Correct(context.Background(), []string{"go", "lang"})
+	require.NoError(t, err)
+	assert.Empty(t, corrections)
+}
+
+func TestPageDocumentID(t *testing.T) {
+	assert.Equal(t, pageDocumentID("https://da.wikipedia.org/wiki/Go"), pageDocumentID("https://da.wikipedia.org/wiki/Go"))
+	assert.NotEqual(t, pageDocumentID("https://da.wikipedia.org/wiki/Go"), pageDocumentID("https://en.wikipedia.org/wiki/Go"))
+	assert.Len(t, pageDocumentID(string(make([]byte, 4096))), 64)
+}
+
+func TestSQLiteSearchEscapesWildcards(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+
+	expectFallbackSearch(mock, `%100\%\_done\\%`, 0, 10, 0,
+		sqlmock.NewRows([]string{"title", "url", "language", "last_updated", "content"}))
+	_, err := sqliteBackend{}.Search(context.Background(), SearchRequest{Query: `100%_done\`, Size: 10})
+	require.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SearchCache stores search results for a while, so repeated searches don't reach
+// the search backend. Invalidate drops everything, e.g. after the index changed,
+// and starts a new generation. Results are stored with the generation read before
+// they were searched for, so results found while the cache was invalidated are
+// never read.
+type SearchCache interface {
+	Generation(ctx context.Context) (int64, error)
+	Get(ctx context.Context, generation int64, key string) (SearchResults, bool, error)
+	Set(ctx context.Context, generation int64, key string, results SearchResults) error
+	Invalidate(ctx context.Context) error
+}
+
+// Names accepted by the SEARCH_CACHE environment variable.
+const (
+	memorySearchCacheName = "memory"
+	redisSearchCacheName  = "redis"
+	noSearchCacheName     = "none"
+)
+
+// searchCache caches the results of searchBackend. It is nil when caching is turned off.
+var searchCache SearchCache
+
+// newSearchCache returns the cache with the given name, or nil for "none".
+func newSearchCache(name string) (SearchCache, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", memorySearchCacheName:
+		return newLRUCache(searchCacheSize, searchCacheTTL), nil
+	case redisSearchCacheName:
+		return newRedisCache(newRedisClient(searchCacheRedisAddr, searchCacheRedisPassword), searchCacheTTL), nil
+	case noSearchCacheName:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown search cache %q (expected %s, %s or %s)",
+			name, memorySearchCacheName, redisSearchCacheName, noSearchCacheName)
+	}
+}
+
+// invalidateSearchCache drops all cached results. It is called whenever pages are
+// indexed or deleted and after the Elasticsearch index is rebuilt.
+func invalidateSearchCache(ctx context.Context) {
+	if searchCache == nil {
+		return
+	}
+	if err := searchCache.Invalidate(ctx); err != nil {
+		log.Printf("Error invalidating search cache: %v", err)
+		return
+	}
+	searchCacheInvalidationsTotal.Inc()
+}
+
+// searchCacheKey identifies a search request. Queries differing only in whitespace share a key.
+func searchCacheKey(searchReq SearchRequest) string {
+	query := strings.Join(strings.Fields(searchReq.Query), " ")
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%d", query, searchReq.Language, searchReq.From, searchReq.Size)))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachingBackend answers searches from searchCache when it can. The pages outbox
+// invalidates the cache once per batch of changes it applies.
+type cachingBackend struct {
+	SearchBackend
+}
+
+func (b *cachingBackend) Search(ctx context.Context, searchReq SearchRequest) (SearchResults, error) {
+	if searchCache == nil {
+		return b.SearchBackend.Search(ctx, searchReq)
+	}
+
+	generation, err := searchCache.Generation(ctx)
+	if err != nil {
+		log.Printf("Error reading search cache: %v", err)
+		return b.SearchBackend.Search(ctx, searchReq)
+	}
+	key := searchCacheKey(searchReq)
+	results, ok, err := searchCache.Get(ctx, generation, key)
+	if err != nil {
+		log.Printf("Error reading search cache: %v", err)
+	} else if ok {
+		searchCacheHitsTotal.Inc()
+		return results, nil
+	}
+	searchCacheMissesTotal.Inc()
+
+	results, err = b.SearchBackend.Search(ctx, searchReq)
+	if err != nil {
+		return results, err
+	}
+	if err := searchCache.Set(ctx, generation, key, results); err != nil {
+		log.Printf("Error writing search cache: %v", err)
+	}
+	return results, nil
+}
+
+// lruCache is an in-process SearchCache holding up to size results for ttl each,
+// evicting the least recently used results first.
+type lruCache struct {
+	mu         sync.Mutex
+	size       int
+	ttl        time.Duration
+	generation int64
+	entries    map[string]*list.Element
+	// order holds the entries, most recently used first.
+	order *list.List
+	now   func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	results SearchResults
+	expires time.Time
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+func (c *lruCache) Generation(ctx context.Context) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation, nil
+}
+
+// Get returns the results stored under key. Only results of the current generation
+// are held, so generation doesn't matter.
+func (c *lruCache) Get(ctx context.Context, generation int64, key string) (SearchResults, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return SearchResults{}, false, nil
+	}
+	entry := element.Value.(*lruEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return SearchResults{}, false, nil
+	}
+	c.order.MoveToFront(element)
+	return entry.results, true, nil
+}
+
+// Set stores results under key, unless the cache was invalidated since generation.
+func (c *lruCache) Set(ctx context.Context, generation int64, key string, results SearchResults) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return nil
+	}
+
+	expires := c.now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		element.Value = &lruEntry{key: key, results: results, expires: expires}
+		c.order.MoveToFront(element)
+		return nil
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, results: results, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+	return nil
+}
+
+func (c *lruCache) Invalidate(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	return nil
+}
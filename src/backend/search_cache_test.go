@@ -0,0 +1,176 @@
+// Unit tests for the search result caches
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useSearchCache makes searches use cache for the rest of the test.
+func useSearchCache(t *testing.T, cache SearchCache) {
+	t.Helper()
+	previous := searchCache
+	searchCache = cache
+	t.Cleanup(func() { searchCache = previous })
+}
+
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	cache := newLRUCache(2, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	require.NoError(t, cache.Set(ctx, 0, "go", SearchResults{Total: 1}))
+	require.NoError(t, cache.Set(ctx, 0, "rust", SearchResults{Total: 2}))
+	results, ok, err := cache.Get(ctx, 0, "go")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), results.Total)
+
+	// "rust" is now the least recently used.
+	require.NoError(t, cache.Set(ctx, 0, "java", SearchResults{Total: 3}))
+	_, ok, _ = cache.Get(ctx, 0, "rust")
+	assert.False(t, ok, "the least recently used result is evicted")
+	_, ok, _ = cache.Get(ctx, 0, "go")
+	assert.True(t, ok)
+
+	now = now.Add(time.Minute)
+	_, ok, _ = cache.Get(ctx, 0, "go")
+	assert.False(t, ok, "results expire after the ttl")
+	assert.Equal(t, 1, cache.order.Len())
+
+	require.NoError(t, cache.Set(ctx, 0, "go", SearchResults{Total: 1}))
+	require.NoError(t, cache.Invalidate(ctx))
+	_, ok, _ = cache.Get(ctx, 0, "go")
+	assert.False(t, ok)
+	assert.Empty(t, cache.entries)
+
+	generation, err := cache.Generation(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), generation)
+	require.NoError(t, cache.Set(ctx, 0, "go", SearchResults{Total: 1}))
+	assert.Empty(t, cache.entries, "results of an older generation are not stored")
+}
+
+func TestSearchCacheKey(t *testing.T) {
+	key := searchCacheKey(SearchRequest{Query: "go  routines", Size: 10, Language: "en"})
+	assert.Equal(t, key, searchCacheKey(SearchRequest{Query: " go routines ", Size: 10, Language: "en"}))
+	assert.NotEqual(t, key, searchCacheKey(SearchRequest{Query: "go routines", Size: 10}))
+	assert.NotEqual(t, key, searchCacheKey(SearchRequest{Query: "go routines", Size: 10, From: 10, Language: "en"}))
+	assert.NotEqual(t, searchCacheKey(SearchRequest{Query: "go OR rust"}), searchCacheKey(SearchRequest{Query: "go or rust"}))
+}
+
+func TestCachingBackend(t *testing.T) {
+	ctx := context.Background()
+	useSearchCache(t, newLRUCache(10, time.Minute))
+	primary := &stubBackend{results: SearchResults{Total: 1}}
+	backend := &cachingBackend{SearchBackend: primary}
+	hits := testutil.ToFloat64(searchCacheHitsTotal)
+	misses := testutil.ToFloat64(searchCacheMissesTotal)
+
+	for i := 0; i < 3; i++ {
+		results, err := backend.Search(ctx, SearchRequest{Query: "go", Size: 10})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), results.Total)
+	}
+	assert.Equal(t, 1, primary.calls)
+	assert.Equal(t, hits+2, testutil.ToFloat64(searchCacheHitsTotal))
+	assert.Equal(t, misses+1, testutil.ToFloat64(searchCacheMissesTotal))
+
+	invalidateSearchCache(ctx)
+	_, err := backend.Search(ctx, SearchRequest{Query: "go", Size: 10})
+	require.NoError(t, err)
+	assert.Equal(t, 2, primary.calls)
+
+	primary.err = errors.New("connection refused")
+	_, err = backend.Search(ctx, SearchRequest{Query: "rust", Size: 10})
+	assert.Error(t, err)
+	primary.err = nil
+	_, err = backend.Search(ctx, SearchRequest{Query: "rust", Size: 10})
+	require.NoError(t, err)
+	assert.Equal(t, 4, primary.calls, "errors are not cached")
+
+	// Results found while the cache was invalidated may predate the change and aren't cached.
+	racing := &cachingBackend{SearchBackend: &invalidatingBackend{primary}}
+	for i := 0; i < 2; i++ {
+		_, err = racing.Search(ctx, SearchRequest{Query: "zig", Size: 10})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 6, primary.calls)
+}
+
+// invalidatingBackend invalidates the search cache during every search.
+type invalidatingBackend struct {
+	*stubBackend
+}
+
+func (b *invalidatingBackend) Search(ctx context.Context, searchReq SearchRequest) (SearchResults, error) {
+	invalidateSearchCache(ctx)
+	return b.stubBackend.Search(ctx, searchReq)
+}
+
+func TestNewSearchCache(t *testing.T) {
+	cache, err := newSearchCache("")
+	require.NoError(t, err)
+	assert.IsType(t, &lruCache{}, cache)
+
+	cache, err = newSearchCache(" Redis ")
+	require.NoError(t, err)
+	assert.IsType(t, &redisCache{}, cache)
+
+	cache, err = newSearchCache("none")
+	require.NoError(t, err)
+	assert.Nil(t, cache)
+
+	_, err = newSearchCache("memcached")
+	assert.Error(t, err)
+}
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	cache := newRedisCache(newRedisClient(server.Addr(), "secret"), time.Minute)
+
+	generation, err := cache.Generation(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), generation)
+	_, ok, err := cache.Get(ctx, generation, "go")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	lastUpdated := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	results := SearchResults{
+		Total:          1,
+		Hits:           []SearchHit{{Page: Page{Title: "Go", URL: "https://en.wikipedia.org/wiki/Go", LastUpdated: lastUpdated}, Score: 1.5}},
+		LanguageFacets: []LanguageFacet{{Language: "en", Count: 1}},
+	}
+	require.NoError(t, cache.Set(ctx, generation, "go", results))
+	cached, ok, err := cache.Get(ctx, generation, "go")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, results, cached)
+	assert.True(t, server.Exists(redisKeyPrefix+"0:go"))
+	assert.Equal(t, time.Minute, server.TTL(redisKeyPrefix+"0:go"))
+
+	require.NoError(t, cache.Invalidate(ctx))
+	generation, err = cache.Generation(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), generation)
+	_, ok, err = cache.Get(ctx, generation, "go")
+	require.NoError(t, err)
+	assert.False(t, ok, "results from older generations are not read")
+
+	server.FastForward(time.Minute)
+	assert.False(t, server.Exists(redisKeyPrefix+"0:go"), "results from older generations expire")
+
+	_, err = newRedisCache(newRedisClient(server.Addr(), "wrong"), time.Minute).Generation(ctx)
+	assert.ErrorContains(t, err, "WRONGPASS")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// elasticsearchBackend searches a copy of the pages table kept in an Elasticsearch index.
+type elasticsearchBackend struct {
+	index string
+}
+
+func newElasticsearchBackend() *elasticsearchBackend {
+	return &elasticsearchBackend{index: esPagesIndex}
+}
+
+// pageDocumentID is the Elasticsearch document ID of the page with the given URL.
+// URLs can be longer than the 512 bytes Elasticsearch allows in an ID, so they are hashed.
+func pageDocumentID(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *elasticsearchBackend) Search(ctx context.Context, searchReq SearchRequest) (SearchResults, error) {
+	var results SearchResults
+
+	body, err := newPagesSearchBody(searchReq)
+	if err != nil {
+		return results, err
+	}
+	searchBody, err := esJSONBody(body)
+	if err != nil {
+		return results, err
+	}
+
+	res, err := esClient.Search(
+		esClient.Search.WithContext(ctx),
+		esClient.Search.WithIndex(b.index),
+		esClient.Search.WithBody(searchBody),
+		esClient.Search.WithTrackTotalHits(true),
+	)
+	if err != nil {
+		return results, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return results, fmt.Errorf("error response from Elasticsearch: %s", res.String())
+	}
+
+	var r struct {
+		Aggregations struct {
+			Languages struct {
+				Buckets []struct {
+					Key      string `json:"key"`
+					DocCount int64  `json:"doc_count"`
+				} `json:"buckets"`
+			} `json:"languages"`
+		} `json:"aggregations"`
+		Hits struct {
+			Total struct {
+				Value int64 `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				Score     float64             `json:"_score"`
+				Source    Page                `json:"_source"`
+				Highlight map[string][]string `json:"highlight"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return results, err
+	}
+
+	results.Total = r.Hits.Total.Value
+	for _, bucket := range r.Aggregations.Languages.Buckets {
+		results.LanguageFacets = append(results.LanguageFacets, LanguageFacet{Language: bucket.Key, Count: bucket.DocCount})
+	}
+	for _, hit := range r.Hits.Hits {
+		searchHit := SearchHit{Page: hit.Source, Score: hit.Score, HighlightedTitle: hit.Source.Title}
+		if titles := hit.Highlight["title"]; len(titles) > 0 {
+			searchHit.HighlightedTitle = titles[0]
+		}
+		if fragments := hit.Highlight["content"]; len(fragments) > 0 {
+			searchHit.Snippet = strings.Join(fragments, " … ")
+		}
+		results.Hits = append(results.Hits, searchHit)
+	}
+
+	return results, nil
+}
+
+func (b *elasticsearchBackend) Suggest(ctx context.Context, prefix string, size int) ([]string, error) {
+	suggestions, err := b.suggest(ctx, newTitleSuggestBody(prefix, size))
+	if err != nil {
+		return nil, err
+	}
+
+	var titles []string
+	for _, entry := range suggestions["titles"] {
+		for _, option := range entry.Options {
+			titles = append(titles, option.Text)
+		}
+	}
+	return titles, nil
+}
+
+// Correct pairs the words with those of the best phrase suggestion. Suggestions that
+// split or join words can't be paired, and give no corrections.
+func (b *elasticsearchBackend) Correct(ctx context.Context, words []string) (map[string]string, error) {
+	suggestions, err := b.suggest(ctx, newSpellingSuggestBody(words))
+	if err != nil {
+		return nil, err
+	}
+
+	corrections := make(map[string]string)
+	for _, entry := range suggestions["spelling"] {
+		if len(entry.Options) == 0 {
+			continue
+		}
+		suggested := tokenize(entry.Options[0].Text)
+		if len(suggested) != len(words) {
+			continue
+		}
+		for i, word := range words {
+			if suggested[i] != word {
+				corrections[word] = suggested[i]
+			}
+		}
+	}
+	return corrections, nil
+}
+
+// esSuggestion is an entry of a suggester's response: a piece of the suggested text and its options.
+type esSuggestion struct {
+	Options []struct {
+		Text string `json:"text"`
+	} `json:"options"`
+}
+
+// suggest runs the suggesters of body and returns their entries by suggester name.
+func (b *elasticsearchBackend) suggest(ctx context.Context, body esSuggestBody) (map[string][]esSuggestion, error) {
+	reader, err := esJSONBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := esClient.Search(
+		esClient.Search.WithContext(ctx),
+		esClient.Search.WithIndex(b.index),
+		esClient.Search.WithBody(reader),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error response from Elasticsearch: %s", res.String())
+	}
+
+	var r struct {
+		Suggest map[string][]esSuggestion `json:"suggest"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	return r.Suggest, nil
+}
+
+func (b *elasticsearchBackend) Index(ctx context.Context, page Page) error {
+	doc, err := esJSONBody(newESPageDocument(page))
+	if err != nil {
+		return err
+	}
+
+	res, err := esClient.Index(
+		b.index,
+		doc,
+		esClient.Index.WithDocumentID(pageDocumentID(page.URL)),
+		esClient.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("error indexing %s: %w", page.URL, err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return fmt.Errorf("error response when indexing %s: %s", page.URL, res.String())
+	}
+	return nil
+}
+
+func (b *elasticsearchBackend) Delete(ctx context.Context, url string) error {
+	return b.deleteDocument(ctx, pageDocumentID(url), url)
+}
+
+// deleteDocument deletes the document with the given ID, calling it what in errors.
+func (b *elasticsearchBackend) deleteDocument(ctx context.Context, id, what string) error {
+	res, err := esClient.Delete(
+		b.index,
+		id,
+		esClient.Delete.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("error deleting %s: %w", what, err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	// Deleting a document that isn't indexed is not an error.
+	if res.IsError() && res.StatusCode != 404 {
+		return fmt.Errorf("error response when deleting %s: %s", what, res.String())
+	}
+	return nil
+}
+
+func (b *elasticsearchBackend) Stats(ctx context.Context) (SearchBackendStats, error) {
+	stats := SearchBackendStats{Backend: elasticsearchBackendName}
+
+	res, err := esClient.Count(
+		esClient.Count.WithIndex(b.index),
+		esClient.Count.WithContext(ctx),
+	)
+	if err != nil {
+		return stats, fmt.Errorf("error counting documents: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return stats, fmt.Errorf("error response when counting documents: %s", res.String())
+	}
+
+	var r struct {
+		Count int64 `json:"count"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return stats, err
+	}
+	stats.Documents = r.Count
+	return stats, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// embeddedSaveInterval is how often changes to the embedded index are saved. Changes
+// lost in a crash are picked up from the pages table when the index is loaded.
+const embeddedSaveInterval = 10 * time.Second
+
+// embeddedBackend searches an in-process inverted index of the pages table, so GoSearch
+// can run without Elasticsearch. Changes are saved to disk every embeddedSaveInterval
+// and when the server shuts down, and the index is brought up to date with the pages
+// table when it is loaded.
+type embeddedBackend struct {
+	index *invertedIndex
+	path  string
+	// saveMu serialises writes to path.
+	saveMu sync.Mutex
+	// dirty is set when the index has changes that aren't saved yet.
+	dirty atomic.Bool
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newEmbeddedBackend loads the index saved at path, or builds a new one, and
+// indexes every page that was added, changed or deleted since it was saved.
+func newEmbeddedBackend(ctx context.Context, path string) (*embeddedBackend, error) {
+	index, err := loadInvertedIndex(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Rebuilding search index %s: %v", path, err)
+		}
+		index = newInvertedIndex()
+	}
+
+	b := &embeddedBackend{index: index, path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := b.sync(ctx); err != nil {
+		return nil, err
+	}
+	go b.saveChanges()
+	onShutdown(func() {
+		if err := b.Close(); err != nil {
+			log.Printf("Error saving search index %s: %v", path, err)
+		}
+	})
+	return b, nil
+}
+
+// saveChanges saves the index every embeddedSaveInterval if it has changed, until
+// the backend is closed.
+func (b *embeddedBackend) saveChanges() {
+	defer close(b.done)
+	ticker := time.NewTicker(embeddedSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.flush(); err != nil {
+				log.Printf("Error saving search index %s: %v", b.path, err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// flush saves the index if it has changed since it was last saved.
+func (b *embeddedBackend) flush() error {
+	if !b.dirty.Swap(false) {
+		return nil
+	}
+	if err := b.save(); err != nil {
+		b.dirty.Store(true)
+		return err
+	}
+	return nil
+}
+
+// Close stops saving the index periodically and saves any unsaved changes.
+func (b *embeddedBackend) Close() error {
+	select {
+	case <-b.stop:
+	default:
+		close(b.stop)
+	}
+	<-b.done
+	return b.flush()
+}
+
+// sync brings the index up to date with the pages table and saves it if anything changed.
+func (b *embeddedBackend) sync(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "SELECT url, last_updated FROM pages")
+	if err != nil {
+		return err
+	}
+	current := make(map[string]time.Time)
+	stale := make(map[string]bool)
+	for rows.Next() {
+		var url string
+		var lastUpdated sql.NullTime
+		if err := rows.Scan(&url, &lastUpdated); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		current[url] = lastUpdated.Time
+		if page, ok := b.index.page(url); !ok || !page.LastUpdated.Equal(lastUpdated.Time) {
+			stale[url] = true
+		}
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var deleted []string
+	b.index.mu.RLock()
+	for url := range b.index.pages {
+		if _, ok := current[url]; !ok {
+			deleted = append(deleted, url)
+		}
+	}
+	b.index.mu.RUnlock()
+	for _, url := range deleted {
+		b.index.remove(url)
+	}
+
+	if len(stale) > 0 {
+		rows, err := db.QueryContext(ctx, "SELECT title, url, language, last_updated, content FROM pages")
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rows.Close() }()
+
+		for rows.Next() {
+			page, err := scanPage(rows)
+			if err != nil {
+				return err
+			}
+			if stale[page.URL] {
+				b.index.add(page)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Search index has %d pages (%d indexed, %d removed)", b.index.len(), len(stale), len(deleted))
+	if len(stale) == 0 && len(deleted) == 0 {
+		return nil
+	}
+	return b.save()
+}
+
+func (b *embeddedBackend) save() error {
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+	return b.index.save(b.path)
+}
+
+func (b *embeddedBackend) Search(ctx context.Context, searchReq SearchRequest) (SearchResults, error) {
+	var results SearchResults
+
+	parsed, err := parseQuery(searchReq.Query)
+	if err != nil {
+		return results, err
+	}
+	matches := b.index.search(parsed)
+
+	counts := make(map[string]int64)
+	var filtered []scoredPage
+	for _, match := range matches {
+		counts[match.page.Language]++
+		if searchReq.Language == "" || match.page.Language == searchReq.Language {
+			filtered = append(filtered, match)
+		}
+	}
+	for lang, count := range counts {
+		results.LanguageFacets = append(results.LanguageFacets, LanguageFacet{Language: lang, Count: count})
+	}
+	sort.Slice(results.LanguageFacets, func(i, j int) bool {
+		if results.LanguageFacets[i].Count != results.LanguageFacets[j].Count {
+			return results.LanguageFacets[i].Count > results.LanguageFacets[j].Count
+		}
+		return results.LanguageFacets[i].Language < results.LanguageFacets[j].Language
+	})
+
+	highlight := highlightText(parsed)
+	results.Total = int64(len(filtered))
+	start := min(searchReq.From, len(filtered))
+	end := min(start+searchReq.Size, len(filtered))
+	for _, match := range filtered[start:end] {
+		results.Hits = append(results.Hits, SearchHit{
+			Page:             match.page.Page,
+			Score:            match.score,
+			Snippet:          buildSnippet(match.page.Content, highlight),
+			HighlightedTitle: highlightTerms(match.page.Title, highlight),
+		})
+	}
+	return results, nil
+}
+
+func (b *embeddedBackend) Suggest(ctx context.Context, prefix string, size int) ([]string, error) {
+	return b.index.titlesWithPrefix(prefix, size), nil
+}
+
+func (b *embeddedBackend) Correct(ctx context.Context, words []string) (map[string]string, error) {
+	return b.index.corrections(words), nil
+}
+
+func (b *embeddedBackend) Index(ctx context.Context, page Page) error {
+	b.index.add(page)
+	b.dirty.Store(true)
+	return nil
+}
+
+func (b *embeddedBackend) Delete(ctx context.Context, url string) error {
+	b.index.remove(url)
+	b.dirty.Store(true)
+	return nil
+}
+
+func (b *embeddedBackend) Stats(ctx context.Context) (SearchBackendStats, error) {
+	return SearchBackendStats{Backend: embeddedBackendName, Documents: int64(b.index.len())}, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// fallbackBackend answers searches from primary, and from fallback whenever primary
+// fails (e.g. Elasticsearch is down). Suggestions and spelling corrections fall back the
+// same way. Index, Delete and Stats always go to primary.
+type fallbackBackend struct {
+	SearchBackend
+	primaryName  string
+	fallback     SearchBackend
+	fallbackName string
+}
+
+func (b *fallbackBackend) Search(ctx context.Context, searchReq SearchRequest) (SearchResults, error) {
+	results, err := b.SearchBackend.Search(ctx, searchReq)
+	if err == nil || ctx.Err() != nil {
+		return results, err
+	}
+
+	log.Printf("Error searching %s, falling back to %s: %v", b.primaryName, b.fallbackName, err)
+	searchBackendFallbacksTotal.WithLabelValues(b.primaryName, b.fallbackName).Inc()
+	return b.fallback.Search(ctx, searchReq)
+}
+
+func (b *fallbackBackend) Suggest(ctx context.Context, prefix string, size int) ([]string, error) {
+	titles, err := b.SearchBackend.Suggest(ctx, prefix, size)
+	if err == nil || ctx.Err() != nil {
+		return titles, err
+	}
+
+	log.Printf("Error getting suggestions from %s, falling back to %s: %v", b.primaryName, b.fallbackName, err)
+	searchBackendFallbacksTotal.WithLabelValues(b.primaryName, b.fallbackName).Inc()
+	return b.fallback.Suggest(ctx, prefix, size)
+}
+
+func (b *fallbackBackend) Correct(ctx context.Context, words []string) (map[string]string, error) {
+	corrections, err := b.SearchBackend.Correct(ctx, words)
+	if err == nil || ctx.Err() != nil {
+		return corrections, err
+	}
+
+	log.Printf("Error getting spelling corrections from %s, falling back to %s: %v", b.primaryName, b.fallbackName, err)
+	searchBackendFallbacksTotal.WithLabelValues(b.primaryName, b.fallbackName).Inc()
+	return b.fallback.Correct(ctx, words)
+}
+
+// newSearchBackendWithFallback returns the named backend, wrapped so searches fall back
+// to the fallback backend when it fails. An empty fallback name, "none", or the same
+// name as the primary backend disables the fallback.
+func newSearchBackendWithFallback(name, fallbackName string) (SearchBackend, error) {
+	primary, err := newSearchBackend(name)
+	if err != nil {
+		return nil, err
+	}
+	if fallbackName == "" || fallbackName == noSearchBackendName || fallbackName == name {
+		return primary, nil
+	}
+
+	fallback, err := newSearchBackend(fallbackName)
+	if err != nil {
+		return nil, err
+	}
+	return &fallbackBackend{
+		SearchBackend: primary,
+		primaryName:   name,
+		fallback:      fallback,
+		fallbackName:  fallbackName,
+	}, nil
+}
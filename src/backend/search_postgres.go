@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// postgresBackend searches the pages table with Postgres full-text search. Pages are
+// matched with websearch_to_tsquery in the text search configuration of their language,
+// ranked with ts_rank_cd (title weighted above content) and summarised with ts_headline.
+// It relies on the pages_search_config/pages_search_vector functions and the
+// idx_pages_search index from schema.sql (knex migration add_language_aware_search).
+type postgresBackend struct{}
+
+// postgresTextSearchConfigs maps page languages to Postgres text search configurations.
+// Keep it in sync with pages_search_config in schema.sql.
+var postgresTextSearchConfigs = map[string]string{
+	"da": "danish",
+	"en": "english",
+}
+
+// postgresVector must stay identical to the idx_pages_search index expression.
+const postgresVector = "pages_search_vector(language, title, content)"
+
+// postgresRankWeights are the ts_rank_cd weights for {D, C, B, A}; titles are weighted A, content B.
+const postgresRankWeights = "'{0.1, 0.2, 0.4, 1.0}'"
+
+// postgresTextMatch matches pages against the websearch_to_tsquery text in the given
+// placeholder. Every language gets its own branch with a constant text search
+// configuration, so Postgres can answer each from idx_pages_search.
+func postgresTextMatch(placeholder string) string {
+	var branches []string
+	for _, lang := range supportedLanguages {
+		branches = append(branches, fmt.Sprintf("(language = '%s' AND %s @@ websearch_to_tsquery('%s', %s))",
+			lang, postgresVector, postgresTextSearchConfigs[lang], placeholder))
+	}
+	return "(" + strings.Join(branches, " OR ") + ")"
+}
+
+// websearchText renders the positive words and phrases of a parsed query in
+// websearch_to_tsquery syntax, for ranking and highlighting.
+func websearchText(node queryNode) string {
+	switch n := node.(type) {
+	case queryAnd:
+		var parts []string
+		for _, clause := range n.Clauses {
+			if part := websearchText(clause); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		return strings.Join(parts, " ")
+	case queryOr:
+		var parts []string
+		for _, clause := range n.Clauses {
+			if part := websearchText(clause); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		return strings.Join(parts, " OR ")
+	case queryText:
+		if n.Phrase {
+			return `"` + n.Text + `"`
+		}
+		return n.Text
+	}
+	return ""
+}
+
+// ts_headline options; matched words are marked like Elasticsearch highlights.
+var (
+	postgresSnippetOptions = fmt.Sprintf(`StartSel=%s, StopSel=%s, MinWords=15, MaxWords=35, MaxFragments=2, FragmentDelimiter=" … "`,
+		highlightPreTag, highlightPostTag)
+	postgresTitleOptions = fmt.Sprintf("StartSel=%s, StopSel=%s, HighlightAll=true", highlightPreTag, highlightPostTag)
+)
+
+func (postgresBackend) Search(ctx context.Context, searchReq SearchRequest) (SearchResults, error) {
+	var results SearchResults
+
+	parsed, err := parseQuery(searchReq.Query)
+	if err != nil {
+		return results, err
+	}
+	q := &sqlQuery{placeholder: func(n int) string { return fmt.Sprintf("$%d", n) }}
+	where := sqlCondition(parsed, q, func(text queryText, q *sqlQuery) string {
+		return postgresTextMatch(q.arg(websearchText(text)))
+	})
+
+	facetRows, err := db.QueryContext(ctx, "SELECT language, COUNT(*) FROM pages WHERE "+where+
+		" GROUP BY language ORDER BY COUNT(*) DESC", q.args...)
+	if err != nil {
+		return results, err
+	}
+	if results.LanguageFacets, err = scanLanguageFacets(facetRows); err != nil {
+		return results, err
+	}
+
+	if searchReq.Language != "" {
+		where += " AND language = " + q.arg(searchReq.Language)
+	}
+
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pages WHERE "+where, q.args...).Scan(&results.Total); err != nil {
+		return results, err
+	}
+
+	// Pages are ranked and highlighted with the query's positive words and phrases, parsed
+	// in the configuration of the page's language. ts_headline is expensive, so it only
+	// runs on the page of results in the outer query.
+	rowQuery := "websearch_to_tsquery(pages_search_config(language), " + q.arg(websearchText(parsed)) + ")"
+	sqlStmt := fmt.Sprintf(`SELECT title, url, language, last_updated, score,
+			ts_headline(pages_search_config(language), content, %[1]s, %[2]s) AS snippet,
+			ts_headline(pages_search_config(language), title, %[1]s, %[3]s) AS highlighted_title
+		FROM (
+			SELECT title, url, language, last_updated, content,
+				ts_rank_cd(%[4]s, %[5]s, %[1]s, 1) AS score
+			FROM pages WHERE %[6]s
+			ORDER BY score DESC, title LIMIT %[7]s OFFSET %[8]s
+		) ranked
+		ORDER BY score DESC, title`,
+		rowQuery, q.arg(postgresSnippetOptions), q.arg(postgresTitleOptions), postgresRankWeights, postgresVector,
+		where, q.arg(searchReq.Size), q.arg(searchReq.From))
+
+	rows, err := db.QueryContext(ctx, sqlStmt, q.args...)
+	if err != nil {
+		return results, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var hit SearchHit
+		var language sql.NullString
+		var lastUpdated sql.NullTime
+		if err := rows.Scan(&hit.Title, &hit.URL, &language, &lastUpdated, &hit.Score, &hit.Snippet, &hit.HighlightedTitle); err != nil {
+			log.Printf("Error scanning page: %v", err)
+			continue
+		}
+		hit.Language = language.String
+		hit.LastUpdated = lastUpdated.Time
+		results.Hits = append(results.Hits, hit)
+	}
+	return results, rows.Err()
+}
+
+// Suggest matches titles with the idx_pages_title_lower index.
+func (postgresBackend) Suggest(ctx context.Context, prefix string, size int) ([]string, error) {
+	return queryTitles(ctx, `SELECT DISTINCT title FROM pages WHERE lower(title) LIKE $1 ESCAPE '\' ORDER BY title LIMIT $2`,
+		likePrefixPattern(prefix), size)
+}
+
+func (postgresBackend) Correct(ctx context.Context, words []string) (map[string]string, error) {
+	return pagesVocabulary.get().corrections(words), nil
+}
+
+// Index is a no-op: Postgres keeps the full-text indexes up to date itself.
+func (postgresBackend) Index(ctx context.Context, page Page) error {
+	return nil
+}
+
+// Delete is a no-op: Postgres keeps the full-text indexes up to date itself.
+func (postgresBackend) Delete(ctx context.Context, url string) error {
+	return nil
+}
+
+func (postgresBackend) Stats(ctx context.Context) (SearchBackendStats, error) {
+	count, err := countPages(ctx)
+	return SearchBackendStats{Backend: postgresBackendName, Documents: count}, err
+}
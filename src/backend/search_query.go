@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Search query syntax:
+//
+//	go routines           pages containing both words
+//	"go routines"         the exact phrase
+//	-java  -"java beans"  pages without the word or phrase
+//	go OR golang          either word; OR binds tighter than the implicit AND
+//	site:da.wikipedia.org pages on that host
+//	lang:da               pages in that language
+//	before:2024-01-31     pages last updated before that day
+//	after:2024-01-31      pages last updated on or after that day
+//
+// parseQuery turns a query into a tree of the node types below, which each
+// search backend compiles into its own query language.
+
+// queryNode is a node of a parsed search query.
+type queryNode interface {
+	isQueryNode()
+}
+
+// queryAnd matches pages matching all clauses. It is always the root of a parsed query.
+type queryAnd struct {
+	Clauses []queryNode
+}
+
+// queryOr matches pages matching any clause.
+type queryOr struct {
+	Clauses []queryNode
+}
+
+// queryNot matches pages not matching the clause.
+type queryNot struct {
+	Clause queryNode
+}
+
+// queryText matches pages containing a word or, if Phrase is set, a phrase.
+type queryText struct {
+	Text   string
+	Phrase bool
+}
+
+// querySite matches pages whose URL has the host.
+type querySite struct {
+	Host string
+}
+
+// queryLanguage matches pages in the language.
+type queryLanguage struct {
+	Language string
+}
+
+// queryDate matches pages last updated before Date, or on or after it if Before is false.
+type queryDate struct {
+	Date   time.Time
+	Before bool
+}
+
+func (queryAnd) isQueryNode()      {}
+func (queryOr) isQueryNode()       {}
+func (queryNot) isQueryNode()      {}
+func (queryText) isQueryNode()     {}
+func (querySite) isQueryNode()     {}
+func (queryLanguage) isQueryNode() {}
+func (queryDate) isQueryNode()     {}
+
+// QueryError is a syntax error in a search query. Its message is meant for the user.
+type QueryError struct {
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return "invalid search query: " + e.Message
+}
+
+func queryErrorf(format string, args ...interface{}) *QueryError {
+	return &QueryError{Message: fmt.Sprintf(format, args...)}
+}
+
+// queryDateLayout is the format of before: and after: dates.
+const queryDateLayout = "2006-01-02"
+
+var hostPattern = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)*$`)
+
+// queryToken is a lexical token: a word, "phrase", operator:value or OR.
+type queryToken struct {
+	text    string
+	phrase  bool
+	negated bool
+	or      bool
+	// start and end are the rune offsets of the word or the inside of the phrase in the query.
+	start, end int
+}
+
+// lexQuery splits a query into tokens.
+func lexQuery(query string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		var token queryToken
+		if runes[i] == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			token.negated = true
+			i++
+		}
+
+		if runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, queryErrorf("missing closing quote")
+			}
+			token.text = strings.TrimSpace(string(runes[i+1 : end]))
+			token.phrase = true
+			token.start, token.end = i+1, end
+			i = end + 1
+		} else {
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && runes[end] != '"' {
+				end++
+			}
+			token.text = string(runes[i:end])
+			token.or = token.text == "OR" && !token.negated
+			token.start, token.end = i, end
+			i = end
+		}
+
+		// Words and phrases without any letters or digits can't match anything.
+		if token.or || len(tokenize(token.text)) > 0 {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+// parseQuery parses a search query. The result is always a queryAnd.
+func parseQuery(query string) (queryNode, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var root queryAnd
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].or {
+			return nil, queryErrorf("OR must be between two search terms")
+		}
+		clause, err := parseQueryToken(tokens[i])
+		if err != nil {
+			return nil, err
+		}
+
+		group := []queryNode{clause}
+		for i+1 < len(tokens) && tokens[i+1].or {
+			if i+2 >= len(tokens) || tokens[i+2].or {
+				return nil, queryErrorf("OR must be between two search terms")
+			}
+			clause, err := parseQueryToken(tokens[i+2])
+			if err != nil {
+				return nil, err
+			}
+			group = append(group, clause)
+			i += 2
+		}
+
+		if len(group) == 1 {
+			root.Clauses = append(root.Clauses, group[0])
+		} else {
+			root.Clauses = append(root.Clauses, queryOr{Clauses: group})
+		}
+	}
+
+	if len(root.Clauses) == 0 {
+		return nil, queryErrorf("no search terms")
+	}
+	return root, nil
+}
+
+// parseQueryToken turns a word, phrase or operator into a node.
+func parseQueryToken(token queryToken) (queryNode, error) {
+	node, err := parseQueryOperator(token)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		node = queryText{Text: token.text, Phrase: token.phrase}
+	}
+	if token.negated {
+		node = queryNot{Clause: node}
+	}
+	return node, nil
+}
+
+// parseQueryOperator parses operator:value tokens. It returns nil for other tokens.
+func parseQueryOperator(token queryToken) (queryNode, error) {
+	if token.phrase {
+		return nil, nil
+	}
+	name, value, ok := strings.Cut(token.text, ":")
+	if !ok {
+		return nil, nil
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "site", "lang", "before", "after":
+	default:
+		return nil, nil
+	}
+	if value == "" {
+		return nil, queryErrorf("%s: needs a value", name)
+	}
+
+	switch name {
+	case "site":
+		host := strings.ToLower(value)
+		if u, err := url.Parse(host); err == nil && u.Host != "" {
+			host = u.Hostname()
+		}
+		host = strings.TrimSuffix(host, "/")
+		if !hostPattern.MatchString(host) {
+			return nil, queryErrorf("site: must be a host name like da.wikipedia.org, not %q", value)
+		}
+		return querySite{Host: host}, nil
+	case "lang":
+		lang := strings.ToLower(value)
+		if !isSupportedLanguage(lang) {
+			return nil, queryErrorf("lang: must be one of %s", strings.Join(supportedLanguages, ", "))
+		}
+		return queryLanguage{Language: lang}, nil
+	default:
+		date, err := time.Parse(queryDateLayout, value)
+		if err != nil {
+			return nil, queryErrorf("%s: must be a date like 2024-01-31, not %q", name, value)
+		}
+		return queryDate{Date: date, Before: name == "before"}, nil
+	}
+}
+
+// positiveText returns the words and phrases a matching page may contain, i.e. those not negated.
+func positiveText(node queryNode) []queryText {
+	switch n := node.(type) {
+	case queryAnd:
+		var texts []queryText
+		for _, clause := range n.Clauses {
+			texts = append(texts, positiveText(clause)...)
+		}
+		return texts
+	case queryOr:
+		var texts []queryText
+		for _, clause := range n.Clauses {
+			texts = append(texts, positiveText(clause)...)
+		}
+		return texts
+	case queryText:
+		return []queryText{n}
+	}
+	return nil
+}
+
+// highlightText is the text to highlight in results: the query without operators and negated terms.
+func highlightText(node queryNode) string {
+	var words []string
+	for _, text := range positiveText(node) {
+		words = append(words, text.Text)
+	}
+	return strings.Join(words, " ")
+}
+
+// requiresText reports whether every matching page contains one of the query's positive words or phrases.
+func requiresText(node queryNode) bool {
+	switch n := node.(type) {
+	case queryAnd:
+		for _, clause := range n.Clauses {
+			if requiresText(clause) {
+				return true
+			}
+		}
+		return false
+	case queryOr:
+		for _, clause := range n.Clauses {
+			if !requiresText(clause) {
+				return false
+			}
+		}
+		return len(n.Clauses) > 0
+	case queryText:
+		return true
+	}
+	return false
+}
+
+// siteURLPrefixes are the URL prefixes of pages on host.
+func siteURLPrefixes(host string) []string {
+	return []string{"http://" + host + "/", "https://" + host + "/"}
+}
+
+// pageHost returns the lower-case host of a page URL.
+func pageHost(pageURL string) string {
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// sqlQuery accumulates the arguments of a SQL statement.
+type sqlQuery struct {
+	// placeholder returns the placeholder for the nth argument, e.g. "?" or "$n".
+	placeholder func(n int) string
+	args        []interface{}
+}
+
+// arg adds an argument and returns its placeholder.
+func (q *sqlQuery) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return q.placeholder(len(q.args))
+}
+
+// sqlCondition compiles a parsed query into a WHERE condition. textMatch compiles words and phrases.
+func sqlCondition(node queryNode, q *sqlQuery, textMatch func(text queryText, q *sqlQuery) string) string {
+	switch n := node.(type) {
+	case queryAnd:
+		conditions := make([]string, len(n.Clauses))
+		for i, clause := range n.Clauses {
+			conditions[i] = sqlCondition(clause, q, textMatch)
+		}
+		return strings.Join(conditions, " AND ")
+	case queryOr:
+		conditions := make([]string, len(n.Clauses))
+		for i, clause := range n.Clauses {
+			conditions[i] = sqlCondition(clause, q, textMatch)
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")"
+	case queryNot:
+		return "NOT (" + sqlCondition(n.Clause, q, textMatch) + ")"
+	case queryText:
+		return textMatch(n, q)
+	case querySite:
+		var conditions []string
+		for _, prefix := range siteURLPrefixes(n.Host) {
+			conditions = append(conditions, "url LIKE "+q.arg(prefix+"%"))
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")"
+	case queryLanguage:
+		return "language = " + q.arg(n.Language)
+	case queryDate:
+		if n.Before {
+			return "last_updated < " + q.arg(n.Date)
+		}
+		return "last_updated >= " + q.arg(n.Date)
+	}
+	panic(fmt.Sprintf("unknown query node %T", node))
+}
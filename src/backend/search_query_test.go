@@ -0,0 +1,124 @@
+// Unit tests for the search query parser and its SQL compiler
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected queryNode
+	}{
+		{
+			name:     "Words",
+			query:    "go  routines",
+			expected: queryAnd{Clauses: []queryNode{queryText{Text: "go"}, queryText{Text: "routines"}}},
+		},
+		{
+			name:  "Phrases and exclusions",
+			query: `"go routines" -java -"java beans"`,
+			expected: queryAnd{Clauses: []queryNode{
+				queryText{Text: "go routines", Phrase: true},
+				queryNot{Clause: queryText{Text: "java"}},
+				queryNot{Clause: queryText{Text: "java beans", Phrase: true}},
+			}},
+		},
+		{
+			name:  "OR binds tighter than AND",
+			query: "go golang OR gopher OR rust",
+			expected: queryAnd{Clauses: []queryNode{
+				queryText{Text: "go"},
+				queryOr{Clauses: []queryNode{queryText{Text: "golang"}, queryText{Text: "gopher"}, queryText{Text: "rust"}}},
+			}},
+		},
+		{
+			name:  "Operators",
+			query: "SITE:https://Da.Wikipedia.org/ lang:DA before:2024-02-01 -after:2023-01-01",
+			expected: queryAnd{Clauses: []queryNode{
+				querySite{Host: "da.wikipedia.org"},
+				queryLanguage{Language: "da"},
+				queryDate{Date: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), Before: true},
+				queryNot{Clause: queryDate{Date: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}},
+			}},
+		},
+		{
+			name:     "Unknown operators and lower-case or are words",
+			query:    "http://example.com or",
+			expected: queryAnd{Clauses: []queryNode{queryText{Text: "http://example.com"}, queryText{Text: "or"}}},
+		},
+		{
+			name:     "Punctuation is ignored",
+			query:    `go - "" !!`,
+			expected: queryAnd{Clauses: []queryNode{queryText{Text: "go"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := parseQuery(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, query)
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query   string
+		message string
+	}{
+		{query: `"go routines`, message: "missing closing quote"},
+		{query: "OR go", message: "OR must be between two search terms"},
+		{query: "go OR", message: "OR must be between two search terms"},
+		{query: "go OR OR rust", message: "OR must be between two search terms"},
+		{query: "go site:", message: "site: needs a value"},
+		{query: "site:exa_mple.com", message: `site: must be a host name like da.wikipedia.org, not "exa_mple.com"`},
+		{query: "lang:fr", message: "lang: must be one of da, en"},
+		{query: "before:yesterday", message: `before: must be a date like 2024-01-31, not "yesterday"`},
+		{query: `"" --`, message: "no search terms"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := parseQuery(tt.query)
+			var queryErr *QueryError
+			require.ErrorAs(t, err, &queryErr)
+			assert.Equal(t, tt.message, queryErr.Message)
+		})
+	}
+}
+
+func TestSQLCondition(t *testing.T) {
+	query, err := parseQuery(`"go routines" -java golang OR gopher site:da.wikipedia.org lang:da after:2024-01-31`)
+	require.NoError(t, err)
+
+	q := &sqlQuery{placeholder: func(int) string { return "?" }}
+	where := sqlCondition(query, q, func(text queryText, q *sqlQuery) string {
+		return "content LIKE " + q.arg("%"+text.Text+"%")
+	})
+
+	assert.Equal(t, "content LIKE ? AND NOT (content LIKE ?) AND (content LIKE ? OR content LIKE ?) AND "+
+		"(url LIKE ? OR url LIKE ?) AND language = ? AND last_updated >= ?", where)
+	assert.Equal(t, []interface{}{"%go routines%", "%java%", "%golang%", "%gopher%",
+		"http://da.wikipedia.org/%", "https://da.wikipedia.org/%", "da", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)}, q.args)
+}
+
+func TestPositiveQueryText(t *testing.T) {
+	query, err := parseQuery(`"go routines" -java golang OR gopher site:da.wikipedia.org`)
+	require.NoError(t, err)
+
+	assert.Equal(t, "go routines golang gopher", highlightText(query))
+	assert.Equal(t, `"go routines" golang OR gopher`, websearchText(query))
+	assert.True(t, requiresText(query))
+
+	query, err = parseQuery(`-java site:da.wikipedia.org`)
+	require.NoError(t, err)
+	assert.False(t, requiresText(query))
+	assert.Empty(t, highlightText(query))
+}
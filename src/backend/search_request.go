@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+const (
+	defaultSearchSize = 10
+	maxSearchSize     = 100
+	// maxSearchResultWindow matches Elasticsearch's default index.max_result_window.
+	maxSearchResultWindow = 10000
+	// maxSearchBodyBytes caps the size of a JSON body posted to /api/search.
+	maxSearchBodyBytes = 1 << 20
+	// allLanguages is the lang value that turns off language filtering.
+	allLanguages = "all"
+)
+
+// supportedLanguages are the languages pages are scraped in (see tryScrapeInLanguages).
+var supportedLanguages = []string{"da", "en"}
+
+// searchRequestBody is the JSON body accepted by POST /api/search.
+type searchRequestBody struct {
+	Query string `json:"q"`
+	Page  *int   `json:"page"`
+	Size  *int   `json:"size"`
+	From  *int   `json:"from"`
+	Lang  string `json:"lang"`
+}
+
+// errInvalidSearchBody is returned when a posted JSON body can't be decoded.
+var errInvalidSearchBody = errors.New("invalid JSON request body")
+
+// parseSearchRequest reads the query and pagination parameters (q, page, size, from)
+// from the URL, a posted form, or a JSON body. "from" takes precedence over "page".
+// A query with invalid syntax (see parseQuery) is reported as a *QueryError.
+func parseSearchRequest(r *http.Request) (SearchRequest, error) {
+	var body searchRequestBody
+
+	if r.Method == http.MethodPost && isJSONContentType(r.Header.Get("Content-Type")) {
+		decoder := json.NewDecoder(io.LimitReader(r.Body, maxSearchBodyBytes))
+		if err := decoder.Decode(&body); err != nil && err != io.EOF {
+			return SearchRequest{}, errInvalidSearchBody
+		}
+	}
+
+	query := strings.TrimSpace(body.Query)
+	if query == "" {
+		query = searchQueryFromRequest(r)
+	}
+
+	page, err := intParam(r, body.Page, "page", 1)
+	if err != nil {
+		return SearchRequest{}, err
+	}
+	size, err := intParam(r, body.Size, "size", defaultSearchSize)
+	if err != nil {
+		return SearchRequest{}, err
+	}
+	from, err := intParam(r, body.From, "from", -1)
+	if err != nil {
+		return SearchRequest{}, err
+	}
+
+	if page < 1 {
+		return SearchRequest{}, fmt.Errorf("page must be 1 or greater")
+	}
+	if size < 1 || size > maxSearchSize {
+		return SearchRequest{}, fmt.Errorf("size must be between 1 and %d", maxSearchSize)
+	}
+	// Checked before multiplying or adding, which could overflow.
+	beyondWindow := fmt.Errorf("cannot page beyond the first %d results", maxSearchResultWindow)
+	if from < 0 {
+		if page > maxSearchResultWindow/size {
+			return SearchRequest{}, beyondWindow
+		}
+		from = (page - 1) * size
+	}
+	if from > maxSearchResultWindow-size {
+		return SearchRequest{}, beyondWindow
+	}
+
+	lang, err := languageParam(r, body.Lang)
+	if err != nil {
+		return SearchRequest{}, err
+	}
+
+	// Backends parse the query again; this only rejects syntax errors up front.
+	if query != "" {
+		if _, err := parseQuery(query); err != nil {
+			return SearchRequest{}, err
+		}
+	}
+
+	return SearchRequest{Query: query, From: from, Size: size, Language: lang}, nil
+}
+
+// languageParam returns the language to filter on: the lang parameter ("language" is
+// accepted too), or else the best supported match for the Accept-Language header.
+// It returns "" when all languages should be searched.
+func languageParam(r *http.Request, bodyValue string) (string, error) {
+	lang := bodyValue
+	if lang == "" {
+		lang = r.FormValue("lang")
+	}
+	if lang == "" {
+		lang = r.FormValue("language")
+	}
+	lang = strings.ToLower(strings.TrimSpace(lang))
+
+	switch {
+	case lang == "":
+		return preferredLanguage(r.Header.Get("Accept-Language")), nil
+	case lang == allLanguages:
+		return "", nil
+	case !isSupportedLanguage(lang):
+		return "", fmt.Errorf("lang must be one of %s or %s", strings.Join(supportedLanguages, ", "), allLanguages)
+	}
+	return lang, nil
+}
+
+// preferredLanguage picks the highest-ranked supported language from an
+// Accept-Language header, or "" if it names none of them.
+func preferredLanguage(acceptLanguage string) string {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil {
+		return ""
+	}
+	for _, tag := range tags {
+		base, _ := tag.Base()
+		if isSupportedLanguage(base.String()) {
+			return base.String()
+		}
+	}
+	return ""
+}
+
+func isSupportedLanguage(lang string) bool {
+	for _, supported := range supportedLanguages {
+		if lang == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// intParam returns the JSON body value if set, otherwise the named form value,
+// otherwise def. Set values must not be negative.
+func intParam(r *http.Request, bodyValue *int, name string, def int) (int, error) {
+	var value int
+	if bodyValue != nil {
+		value = *bodyValue
+	} else {
+		raw := strings.TrimSpace(r.FormValue(name))
+		if raw == "" {
+			return def, nil
+		}
+		var err error
+		if value, err = strconv.Atoi(raw); err != nil {
+			return 0, fmt.Errorf("%s must be a whole number", name)
+		}
+	}
+
+	if value < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	return value, nil
+}
+
+// searchQueryFromRequest returns the trimmed search query from the URL or a posted form.
+func searchQueryFromRequest(r *http.Request) string {
+	return strings.TrimSpace(r.FormValue("q"))
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+// Page returns the 1-based page number the request starts on.
+func (req SearchRequest) Page() int {
+	if req.Size <= 0 {
+		return 1
+	}
+	return req.From/req.Size + 1
+}
+
+// HasPrevious reports whether there are results before this page.
+func (req SearchRequest) HasPrevious() bool {
+	return req.From > 0
+}
+
+// HasNext reports whether there are more results after this page.
+func (req SearchRequest) HasNext(total int64) bool {
+	next := req.From + req.Size
+	return int64(next) < total && next+req.Size <= maxSearchResultWindow
+}
+
+// languageValue is the lang parameter value that selects language ("" meaning all).
+func languageValue(lang string) string {
+	if lang == "" {
+		return allLanguages
+	}
+	return lang
+}
+
+// pageURL links to the search results page starting at from, keeping the rest of the request.
+func pageURL(path string, req SearchRequest, from int) string {
+	if from < 0 {
+		from = 0
+	}
+	values := url.Values{}
+	values.Set("q", req.Query)
+	values.Set("size", strconv.Itoa(req.Size))
+	values.Set("lang", languageValue(req.Language))
+	if from%req.Size == 0 {
+		values.Set("page", strconv.Itoa(from/req.Size+1))
+	} else {
+		values.Set("from", strconv.Itoa(from))
+	}
+	return path + "?" + values.Encode()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// sqliteBackend searches the pages table with LIKE. It needs no extra services,
+// which makes it the backend for tests and small SQLite-backed deployments.
+type sqliteBackend struct{}
+
+func (sqliteBackend) Search(ctx context.Context, searchReq SearchRequest) (SearchResults, error) {
+	var results SearchResults
+
+	parsed, err := parseQuery(searchReq.Query)
+	if err != nil {
+		return results, err
+	}
+	q := &sqlQuery{placeholder: func(int) string { return "?" }}
+	where := sqlCondition(parsed, q, func(text queryText, q *sqlQuery) string {
+		return "content LIKE " + q.arg("%"+escapeLike(text.Text)+"%") + ` ESCAPE '\'`
+	})
+
+	facetRows, err := db.QueryContext(ctx, "SELECT language, COUNT(*) FROM pages WHERE "+where+" GROUP BY language ORDER BY COUNT(*) DESC", q.args...)
+	if err != nil {
+		return results, err
+	}
+	if results.LanguageFacets, err = scanLanguageFacets(facetRows); err != nil {
+		return results, err
+	}
+
+	if searchReq.Language != "" {
+		where += " AND language = " + q.arg(searchReq.Language)
+	}
+
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pages WHERE "+where, q.args...).Scan(&results.Total); err != nil {
+		return results, err
+	}
+
+	sqlStmt := "SELECT title, url, language, last_updated, content FROM pages WHERE " + where + " ORDER BY title LIMIT ? OFFSET ?"
+	rows, err := db.QueryContext(ctx, sqlStmt, append(q.args, searchReq.Size, searchReq.From)...)
+	if err != nil {
+		return results, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	highlight := highlightText(parsed)
+	for rows.Next() {
+		p, err := scanPage(rows)
+		if err != nil {
+			log.Printf("Error scanning page: %v", err)
+			continue
+		}
+		results.Hits = append(results.Hits, SearchHit{
+			Page:             p,
+			Snippet:          buildSnippet(p.Content, highlight),
+			HighlightedTitle: highlightTerms(p.Title, highlight),
+		})
+	}
+	return results, rows.Err()
+}
+
+func (sqliteBackend) Suggest(ctx context.Context, prefix string, size int) ([]string, error) {
+	return queryTitles(ctx, `SELECT DISTINCT title FROM pages WHERE LOWER(title) LIKE ? ESCAPE '\' ORDER BY title LIMIT ?`,
+		likePrefixPattern(prefix), size)
+}
+
+func (sqliteBackend) Correct(ctx context.Context, words []string) (map[string]string, error) {
+	return pagesVocabulary.get().corrections(words), nil
+}
+
+// Index is a no-op: the pages table is the index.
+func (sqliteBackend) Index(ctx context.Context, page Page) error {
+	return nil
+}
+
+// Delete is a no-op: the pages table is the index.
+func (sqliteBackend) Delete(ctx context.Context, url string) error {
+	return nil
+}
+
+func (sqliteBackend) Stats(ctx context.Context) (SearchBackendStats, error) {
+	count, err := countPages(ctx)
+	return SearchBackendStats{Backend: sqliteBackendName, Documents: count}, err
+}
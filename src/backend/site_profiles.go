@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/gocolly/colly"
+	"gopkg.in/yaml.v3"
+)
+
+// Site profiles say how pages of a site are extracted, so new sources are added
+// by editing a profile file instead of code. The default profiles are in
+// site_profiles.yaml, which documents the format. The YAML or JSON file in
+// SITE_PROFILES adds profiles ahead of them. The profiles are checked when the
+// server starts.
+
+//go:embed site_profiles.yaml
+var defaultSiteProfiles []byte
+
+// siteProfiles are the configured profiles, loaded in init.
+var siteProfiles []*siteProfile
+
+// genericSiteProfile extracts pages no profile matches.
+var genericSiteProfile = mustCompileSiteProfile(&siteProfile{
+	Name:     "generic",
+	Title:    "head > title, h1",
+	Content:  []string{"p"},
+	Language: "html",
+})
+
+// siteProfile says how to extract the pages whose URL matches URLPattern.
+type siteProfile struct {
+	Name       string   `yaml:"name" json:"name"`
+	URLPattern string   `yaml:"url_pattern" json:"url_pattern"`
+	Title      string   `yaml:"title" json:"title"`
+	Content    []string `yaml:"content" json:"content"`
+	Strip      []string `yaml:"strip" json:"strip"`
+	// Language is html, host or a language of the pages table.
+	Language string `yaml:"language" json:"language"`
+
+	urlPattern *regexp.Regexp
+	title      cascadia.Selector
+	content    []cascadia.Selector
+	strip      []cascadia.Selector
+}
+
+type siteProfileFile struct {
+	Profiles []*siteProfile `yaml:"profiles" json:"profiles"`
+}
+
+// loadSiteProfiles reads the profiles in path followed by the default ones, which
+// the scraper relies on for Wikipedia, and checks them. A profile in path replaces
+// the default profile with its name. Files ending in .json are read as JSON, others
+// as YAML; unknown fields are an error in both.
+func loadSiteProfiles(path string) ([]*siteProfile, error) {
+	defaults, err := parseSiteProfiles(defaultSiteProfiles, "site_profiles.yaml")
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return defaults, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := parseSiteProfiles(data, path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, profile := range profiles {
+		names[profile.Name] = true
+	}
+	for _, profile := range defaults {
+		if !names[profile.Name] {
+			profiles = append(profiles, profile)
+		}
+	}
+	return profiles, nil
+}
+
+// parseSiteProfiles parses and checks the profiles in data, read from source.
+func parseSiteProfiles(data []byte, source string) ([]*siteProfile, error) {
+	var file siteProfileFile
+	if strings.EqualFold(filepath.Ext(source), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&file); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", source, err)
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("error parsing %s: %w", source, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, profile := range file.Profiles {
+		if profile == nil || profile.Name == "" {
+			return nil, fmt.Errorf("site profile %d has no name", i+1)
+		}
+		if names[profile.Name] {
+			return nil, fmt.Errorf("there is more than one site profile named %q", profile.Name)
+		}
+		names[profile.Name] = true
+		if profile.URLPattern == "" {
+			return nil, fmt.Errorf("site profile %q has no url_pattern", profile.Name)
+		}
+		if err := profile.compile(); err != nil {
+			return nil, fmt.Errorf("site profile %q: %w", profile.Name, err)
+		}
+	}
+	return file.Profiles, nil
+}
+
+// compile checks the profile and compiles its pattern and selectors.
+func (p *siteProfile) compile() error {
+	var err error
+	if p.URLPattern != "" {
+		if p.urlPattern, err = regexp.Compile(p.URLPattern); err != nil {
+			return fmt.Errorf("invalid url_pattern: %w", err)
+		}
+	}
+	if p.Title == "" {
+		return errors.New("no title selector")
+	}
+	if p.title, err = cascadia.Compile(p.Title); err != nil {
+		return fmt.Errorf("invalid title selector %q: %w", p.Title, err)
+	}
+	if len(p.Content) == 0 {
+		return errors.New("no content selectors")
+	}
+	p.content = make([]cascadia.Selector, len(p.Content))
+	for i, selector := range p.Content {
+		if p.content[i], err = cascadia.Compile(selector); err != nil {
+			return fmt.Errorf("invalid content selector %q: %w", selector, err)
+		}
+	}
+	p.strip = make([]cascadia.Selector, len(p.Strip))
+	for i, selector := range p.Strip {
+		if p.strip[i], err = cascadia.Compile(selector); err != nil {
+			return fmt.Errorf("invalid strip selector %q: %w", selector, err)
+		}
+	}
+	switch p.Language {
+	case "html", "host", "da", "en":
+	default:
+		return fmt.Errorf("language must be html, host, da or en, not %q", p.Language)
+	}
+	return nil
+}
+
+func mustCompileSiteProfile(p *siteProfile) *siteProfile {
+	if err := p.compile(); err != nil {
+		panic(fmt.Sprintf("site profile %q: %v", p.Name, err))
+	}
+	return p
+}
+
+// siteProfileFor returns the first configured profile matching pageURL, or nil.
+func siteProfileFor(pageURL string) *siteProfile {
+	for _, profile := range siteProfiles {
+		if profile.urlPattern.MatchString(pageURL) {
+			return profile
+		}
+	}
+	return nil
+}
+
+// extract removes the elements to strip from the page in e, which must be its
+// html element, and returns its title, text and language.
+func (p *siteProfile) extract(e *colly.HTMLElement) (title, content, lang string) {
+	for _, selector := range p.strip {
+		e.DOM.FindMatcher(selector).Remove()
+	}
+	title = strings.TrimSpace(e.DOM.FindMatcher(p.title).First().Text())
+
+	var lines []string
+	for _, selector := range p.content {
+		e.DOM.FindMatcher(selector).Each(func(_ int, s *goquery.Selection) {
+			if text := strings.TrimSpace(s.Text()); text != "" {
+				lines = append(lines, text)
+			}
+		})
+	}
+
+	switch p.Language {
+	case "html":
+		lang = pageLanguage(e.Attr("lang"))
+	case "host":
+		lang = pageLanguage(hostLanguage(e.Request.URL))
+	default:
+		lang = p.Language
+	}
+	return title, strings.Join(lines, "\n"), lang
+}
+
+// hostLanguage returns the first label of u's host, which names the language on
+// sites like Wikipedia.
+func hostLanguage(u *url.URL) string {
+	label, _, _ := strings.Cut(u.Hostname(), ".")
+	return label
+}
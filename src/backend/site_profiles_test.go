@@ -0,0 +1,129 @@
+// Unit tests for site profiles
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useSiteProfiles makes the scraper and the crawler use the profiles in a YAML file
+// with the given content.
+func useSiteProfiles(t *testing.T, content string) {
+	profiles, err := loadSiteProfiles(writeSiteProfiles(t, "profiles.yaml", content))
+	require.NoError(t, err)
+	previous := siteProfiles
+	siteProfiles = profiles
+	t.Cleanup(func() { siteProfiles = previous })
+}
+
+func writeSiteProfiles(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadSiteProfiles(t *testing.T) {
+	defaults, err := loadSiteProfiles("")
+	require.NoError(t, err, "site_profiles.yaml is valid")
+	require.NotEmpty(t, defaults)
+	assert.Equal(t, "wikipedia", siteProfileFor(buildWikipediaURL("go", "da")).Name)
+	assert.Nil(t, siteProfileFor("https://example.com/wiki/Go"))
+
+	// Profiles in a file come ahead of the default ones, which keep Wikipedia scraped.
+	profiles, err := loadSiteProfiles(writeSiteProfiles(t, "profiles.json", `{"profiles": [
+		{"name": "docs", "url_pattern": "^https://docs\\.example\\.com/", "title": "h1", "content": ["article p", "article li"], "language": "en"}
+	]}`))
+	require.NoError(t, err)
+	require.Len(t, profiles, len(defaults)+1)
+	assert.Equal(t, []string{"article p", "article li"}, profiles[0].Content)
+	assert.Equal(t, defaults[0].Name, profiles[1].Name)
+
+	profiles, err = loadSiteProfiles(writeSiteProfiles(t, "empty.yaml", ""))
+	require.NoError(t, err)
+	assert.Len(t, profiles, len(defaults))
+
+	// A profile replaces the default one with its name.
+	profiles, err = loadSiteProfiles(writeSiteProfiles(t, "wikipedia.yaml", `profiles: [{name: wikipedia, url_pattern: "^https://[a-z]+\\.wikipedia\\.org/", title: h1, content: [p], language: host}]`))
+	require.NoError(t, err)
+	require.Len(t, profiles, len(defaults))
+	assert.Equal(t, []string{"p"}, profiles[0].Content)
+
+	_, err = loadSiteProfiles(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+
+	tests := []struct {
+		name     string
+		profiles string
+		expected string
+	}{
+		{"unnamed", `{url_pattern: ".", title: h1, content: [p], language: en}`, "site profile 1 has no name"},
+		{"duplicate", `{name: a, url_pattern: ".", title: h1, content: [p], language: en}, {name: a, url_pattern: ".", title: h1, content: [p], language: en}`, `more than one site profile named "a"`},
+		{"no pattern", `{name: a, title: h1, content: [p], language: en}`, `site profile "a" has no url_pattern`},
+		{"bad pattern", `{name: a, url_pattern: "(", title: h1, content: [p], language: en}`, "invalid url_pattern"},
+		{"no title", `{name: a, url_pattern: ".", content: [p], language: en}`, "no title selector"},
+		{"bad title", `{name: a, url_pattern: ".", title: "h1[", content: [p], language: en}`, `invalid title selector "h1["`},
+		{"no content", `{name: a, url_pattern: ".", title: h1, language: en}`, "no content selectors"},
+		{"bad content", `{name: a, url_pattern: ".", title: h1, content: [p, "p >"], language: en}`, `invalid content selector "p >"`},
+		{"bad strip", `{name: a, url_pattern: ".", title: h1, content: [p], strip: ["::"], language: en}`, `invalid strip selector "::"`},
+		{"bad language", `{name: a, url_pattern: ".", title: h1, content: [p], language: sv}`, `language must be html, host, da or en, not "sv"`},
+		{"unknown field", `{name: a, url_pattern: ".", title: h1, content: [p], language: en, selector: p}`, "field selector not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadSiteProfiles(writeSiteProfiles(t, "profiles.yml", "profiles: ["+tt.profiles+"]"))
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestSiteProfileExtract(t *testing.T) {
+	usePoliteness(t, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `<html lang="da"><head><title>Site title</title></head><body>
+			<nav><a href="/nav">Menu</a></nav>
+			<h1 class="headline">Overskrift</h1>
+			<article><p>Første afsnit<sup class="ref">[1]</sup></p><p> </p><ul><li>Punkt</li></ul><p>Andet afsnit</p></article>
+			<footer><p>Footer</p></footer>
+		</body></html>`)
+	}))
+	defer server.Close()
+	useSiteProfiles(t, fmt.Sprintf(`
+profiles:
+  - name: news
+    url_pattern: '^%s/news/'
+    title: h1.headline
+    content: [article p, article li]
+    strip: [sup.ref, nav]
+    language: html
+  - name: english
+    url_pattern: '^%s/en/'
+    title: h1
+    content: [footer p]
+    language: en
+`, server.URL, server.URL))
+
+	page, err := fetchCrawledPage(server.URL + "/news/1")
+	require.NoError(t, err)
+	assert.Equal(t, "Overskrift", page.Title)
+	assert.Equal(t, "Første afsnit\nAndet afsnit\nPunkt", page.Content, "lines follow the order of the selectors")
+	assert.Equal(t, "da", page.Language)
+	assert.Contains(t, page.Links, server.URL+"/nav", "links in stripped elements are still followed")
+
+	page, err = fetchCrawledPage(server.URL + "/en/1")
+	require.NoError(t, err)
+	assert.Equal(t, Page{Title: "Overskrift", URL: server.URL + "/en/1", Language: "en", Content: "Footer"}, page.Page)
+
+	// Pages no profile matches are extracted by their title and paragraphs.
+	page, err = fetchCrawledPage(server.URL + "/other")
+	require.NoError(t, err)
+	assert.Equal(t, "Site title", page.Title)
+	assert.Equal(t, "Første afsnit[1]\nAndet afsnit\nFooter", page.Content)
+	assert.Equal(t, "da", page.Language)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Sites list their pages in XML sitemaps (https://www.sitemaps.org/protocol.html),
+// so ingesting a sitemap finds pages without guessing URLs. Sitemap index files
+// are followed to the sitemaps they list, and gzipped sitemaps are unpacked. The
+// listed pages are fetched by the crawler without following their links, skipping
+// those whose lastmod is no later than the last_updated of the saved page.
+
+const (
+	// sitemapMaxSize is the most of a sitemap that is read once unpacked, the
+	// limit of the sitemap protocol.
+	sitemapMaxSize = 50 * 1024 * 1024
+	// sitemapMaxURLs is the most page URLs one ingestion reads from its sitemaps.
+	sitemapMaxURLs = 50000
+	// sitemapMaxDepth is how deeply sitemap index files may nest.
+	sitemapMaxDepth = 3
+	// sitemapRequestTimeout bounds fetching a sitemap.
+	sitemapRequestTimeout = time.Minute
+)
+
+// sitemapLastModLayouts are the W3C datetime forms lastmod is written in.
+var sitemapLastModLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// sitemapEntry is a page listed in a sitemap.
+type sitemapEntry struct {
+	URL string
+	// LastMod is when the page last changed, zero if the sitemap doesn't say.
+	LastMod time.Time
+}
+
+// sitemapDocument is a sitemap or a sitemap index, told apart by XMLName.
+type sitemapDocument struct {
+	XMLName  xml.Name
+	URLs     []sitemapLocation `xml:"url"`
+	Sitemaps []sitemapLocation `xml:"sitemap"`
+}
+
+type sitemapLocation struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// SitemapStats counts what ingesting sitemaps did.
+type SitemapStats struct {
+	// URLs counts the pages listed in the sitemaps.
+	URLs int
+	// Unchanged counts the listed pages not fetched because they haven't changed
+	// since they were saved.
+	Unchanged int
+	CrawlStats
+}
+
+// sitemapReader reads sitemaps, following sitemap index files.
+type sitemapReader struct {
+	client  *http.Client
+	seen    map[string]bool
+	entries map[string]sitemapEntry
+	order   []string
+}
+
+// readSitemaps returns the pages listed in the given sitemaps, each once with its
+// latest lastmod, by canonical URL in the order they are listed. Sitemaps that
+// can't be read are logged and skipped, and it is an error if none could be.
+func readSitemaps(ctx context.Context, sitemaps []string) ([]sitemapEntry, error) {
+	r := &sitemapReader{
+		client:  newPoliteClient(sitemapRequestTimeout),
+		seen:    make(map[string]bool),
+		entries: make(map[string]sitemapEntry),
+	}
+	var lastErr error
+	read := 0
+	for _, sitemapURL := range sitemaps {
+		if err := r.read(ctx, sitemapURL, 0); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Printf("Error reading sitemap %s: %v", sitemapURL, err)
+			lastErr = err
+			continue
+		}
+		read++
+	}
+	if read == 0 && lastErr != nil {
+		return nil, fmt.Errorf("no sitemap could be read: %w", lastErr)
+	}
+
+	entries := make([]sitemapEntry, 0, len(r.order))
+	for _, u := range r.order {
+		entries = append(entries, r.entries[u])
+	}
+	return entries, nil
+}
+
+func (r *sitemapReader) read(ctx context.Context, sitemapURL string, depth int) error {
+	if r.seen[sitemapURL] || len(r.order) >= sitemapMaxURLs {
+		return nil
+	}
+	r.seen[sitemapURL] = true
+
+	doc, err := r.fetch(ctx, sitemapURL)
+	if err != nil {
+		return err
+	}
+	switch doc.XMLName.Local {
+	case "urlset":
+		for _, loc := range doc.URLs {
+			r.add(loc)
+		}
+	case "sitemapindex":
+		if depth >= sitemapMaxDepth {
+			return fmt.Errorf("sitemap indexes nested more than %d deep", sitemapMaxDepth)
+		}
+		for _, loc := range doc.Sitemaps {
+			child := strings.TrimSpace(loc.Loc)
+			if child == "" {
+				continue
+			}
+			// A sitemap in an index that can't be read doesn't spoil the others.
+			if err := r.read(ctx, child, depth+1); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Printf("Error reading sitemap %s listed in %s: %v", child, sitemapURL, err)
+			}
+		}
+	default:
+		return fmt.Errorf("%s is not a sitemap but a <%s> document", sitemapURL, doc.XMLName.Local)
+	}
+	return nil
+}
+
+// add records a page listed in a sitemap, skipping URLs that can't be crawled.
+func (r *sitemapReader) add(loc sitemapLocation) {
+	canonical, err := canonicalizeURL(loc.Loc)
+	if err != nil || len(r.order) >= sitemapMaxURLs {
+		return
+	}
+	lastMod := parseSitemapLastMod(loc.LastMod)
+	entry, ok := r.entries[canonical]
+	if !ok {
+		r.order = append(r.order, canonical)
+	} else if !lastMod.After(entry.LastMod) {
+		return
+	}
+	r.entries[canonical] = sitemapEntry{URL: canonical, LastMod: lastMod}
+}
+
+// fetch fetches and parses a sitemap, unpacking it if it is gzipped, whatever its
+// Content-Type says.
+func (r *sitemapReader) fetch(ctx context.Context, sitemapURL string) (sitemapDocument, error) {
+	var doc sitemapDocument
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sitemapURL, nil)
+	if err != nil {
+		return doc, err
+	}
+	req.Header.Set("User-Agent", scraperUserAgent)
+	res, err := r.client.Do(req)
+	if err != nil {
+		return doc, err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return doc, fmt.Errorf("fetching %s: %s", sitemapURL, res.Status)
+	}
+
+	body := bufio.NewReader(res.Body)
+	var content io.Reader = body
+	if magic, err := body.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		unzipped, err := gzip.NewReader(body)
+		if err != nil {
+			return doc, fmt.Errorf("unpacking %s: %w", sitemapURL, err)
+		}
+		defer func() { _ = unzipped.Close() }()
+		content = unzipped
+	}
+	if err := xml.NewDecoder(io.LimitReader(content, sitemapMaxSize)).Decode(&doc); err != nil {
+		return doc, fmt.Errorf("parsing %s: %w", sitemapURL, err)
+	}
+	return doc, nil
+}
+
+// parseSitemapLastMod parses a lastmod, returning the zero time if it is missing
+// or malformed.
+func parseSitemapLastMod(lastMod string) time.Time {
+	lastMod = strings.TrimSpace(lastMod)
+	if lastMod == "" {
+		return time.Time{}
+	}
+	for _, layout := range sitemapLastModLayouts {
+		if t, err := time.Parse(layout, lastMod); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// ingestSitemaps fetches the pages listed in the given sitemaps that are new or
+// have changed since they were saved, without following their links. Pages not
+// saved before go first, then those saved longest ago, so pages beyond maxPages
+// get their turn in later ingestions. If the crawler has no allowed domains, the
+// pages must be on the hosts of the sitemaps.
+func (c *crawler) ingestSitemaps(ctx context.Context, sitemaps []string) (SitemapStats, error) {
+	var stats SitemapStats
+	entries, err := readSitemaps(ctx, sitemaps)
+	if err != nil {
+		return stats, err
+	}
+	stats.URLs = len(entries)
+
+	saved, err := pagesLastUpdated(ctx, entries)
+	if err != nil {
+		return stats, err
+	}
+	var changed []sitemapEntry
+	for _, entry := range entries {
+		lastUpdated, ok := saved[entry.URL]
+		if ok && !entry.LastMod.IsZero() && !entry.LastMod.After(lastUpdated) {
+			stats.Unchanged++
+			sitemapURLsTotal.WithLabelValues("unchanged").Inc()
+			continue
+		}
+		changed = append(changed, entry)
+		sitemapURLsTotal.WithLabelValues("queued").Inc()
+	}
+	sort.SliceStable(changed, func(i, j int) bool {
+		a, aSaved := saved[changed[i].URL]
+		b, bSaved := saved[changed[j].URL]
+		if aSaved != bSaved {
+			return !aSaved
+		}
+		return a.Before(b)
+	})
+
+	pages := *c
+	pages.maxDepth = 0
+	if len(pages.allowedDomains) == 0 {
+		for _, sitemapURL := range sitemaps {
+			if u, err := url.Parse(sitemapURL); err == nil && u.Hostname() != "" {
+				pages.allowedDomains = append(pages.allowedDomains, strings.ToLower(u.Hostname()))
+			}
+		}
+	}
+	urls := make([]string, len(changed))
+	for i, entry := range changed {
+		urls[i] = entry.URL
+	}
+	log.Printf("Sitemaps list %d pages, %d unchanged since they were saved", stats.URLs, stats.Unchanged)
+	stats.CrawlStats, err = pages.crawl(ctx, urls)
+	return stats, err
+}
+
+// pagesLastUpdated returns the last_updated of the saved pages among entries, by
+// URL, the zero time for pages without one.
+func pagesLastUpdated(ctx context.Context, entries []sitemapEntry) (map[string]time.Time, error) {
+	urls := make([]string, len(entries))
+	for i, entry := range entries {
+		urls[i] = entry.URL
+	}
+	rows, err := db.QueryContext(ctx, "SELECT url, last_updated FROM pages WHERE url = ANY($1)", pq.Array(urls))
+	if err != nil {
+		return nil, fmt.Errorf("error reading when pages were last updated: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	lastUpdated := make(map[string]time.Time)
+	for rows.Next() {
+		var u string
+		var updated sql.NullTime
+		if err := rows.Scan(&u, &updated); err != nil {
+			return nil, err
+		}
+		lastUpdated[u] = updated.Time
+	}
+	return lastUpdated, rows.Err()
+}
+
+// errSitemapIngestionRunning is returned by ingestConfiguredSitemaps while another
+// ingestion is going.
+var errSitemapIngestionRunning = errors.New("a sitemap ingestion is already running")
+
+// sitemapMu makes ingestions of the configured sitemaps take turns, as one may
+// outlast the cron interval.
+var sitemapMu sync.Mutex
+
+// ingestConfiguredSitemaps ingests the sitemaps configured in SITEMAP_URLS.
+func ingestConfiguredSitemaps(ctx context.Context) (SitemapStats, error) {
+	if !sitemapMu.TryLock() {
+		return SitemapStats{}, errSitemapIngestionRunning
+	}
+	defer sitemapMu.Unlock()
+	return newCrawler().ingestSitemaps(ctx, sitemapURLs)
+}
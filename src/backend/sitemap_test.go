@@ -0,0 +1,161 @@
+// Unit tests for sitemap ingestion
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSitemapSite serves a sitemap index at /sitemap.xml listing a gzipped sitemap,
+// a plain one, a missing one and itself, and the pages /a to /d they list.
+func newSitemapSite(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	sitemap := func(path, contentType string, body func() string, gzipped bool) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			if !gzipped {
+				_, _ = fmt.Fprint(w, body())
+				return
+			}
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			_, _ = zw.Write([]byte(body()))
+			_ = zw.Close()
+			_, _ = w.Write(buf.Bytes())
+		})
+	}
+	sitemap("/sitemap.xml", "application/xml", func() string {
+		return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>%[1]s/sitemap-pages.xml.gz</loc></sitemap>
+  <sitemap><loc>%[1]s/sitemap-posts.xml</loc><lastmod>2025-05-01</lastmod></sitemap>
+  <sitemap><loc>%[1]s/missing.xml</loc></sitemap>
+  <sitemap><loc>%[1]s/sitemap.xml</loc></sitemap>
+</sitemapindex>`, server.URL)
+	}, false)
+	sitemap("/sitemap-pages.xml.gz", "application/x-gzip", func() string {
+		return fmt.Sprintf(`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%[1]s/a</loc><lastmod>2025-01-01</lastmod></url>
+  <url><loc>%[1]s/b?utm_source=sitemap</loc><lastmod>2025-03-01T12:00:00+02:00</lastmod></url>
+  <url><loc>mailto:someone@example.com</loc></url>
+</urlset>`, server.URL)
+	}, true)
+	sitemap("/sitemap-posts.xml", "text/xml", func() string {
+		return fmt.Sprintf(`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%[1]s/c</loc><lastmod>not a date</lastmod></url>
+  <url><loc>%[1]s/d</loc></url>
+  <url><loc>%[1]s/a</loc><lastmod>2025-02-01</lastmod></url>
+  <url><loc>https://elsewhere.example/e</loc></url>
+</urlset>`, server.URL)
+	}, false)
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, `<html><head><title>Page %[1]s</title></head><body><p>Text of %[1]s</p><a href="/linked">Linked</a></body></html>`, r.URL.Path)
+		})
+	}
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestParseSitemapLastMod(t *testing.T) {
+	tests := []struct {
+		lastMod  string
+		expected time.Time
+	}{
+		{"2025-05-01", time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{" 2025-05 ", time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"2025-05-01T10:30+02:00", time.Date(2025, 5, 1, 8, 30, 0, 0, time.UTC)},
+		{"2025-05-01T10:30:15Z", time.Date(2025, 5, 1, 10, 30, 15, 0, time.UTC)},
+		{"2025-05-01T10:30:15.5-01:00", time.Date(2025, 5, 1, 11, 30, 15, 500000000, time.UTC)},
+		{"", time.Time{}},
+		{"yesterday", time.Time{}},
+	}
+	for _, tt := range tests {
+		assert.True(t, tt.expected.Equal(parseSitemapLastMod(tt.lastMod)), tt.lastMod)
+	}
+}
+
+func TestReadSitemaps(t *testing.T) {
+	usePoliteness(t, 0)
+	site := newSitemapSite(t)
+
+	entries, err := readSitemaps(context.Background(), []string{site.URL + "/sitemap.xml"})
+	require.NoError(t, err)
+	assert.Equal(t, []sitemapEntry{
+		{URL: site.URL + "/a", LastMod: time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{URL: site.URL + "/b", LastMod: time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)},
+		{URL: site.URL + "/c"},
+		{URL: site.URL + "/d"},
+		{URL: "https://elsewhere.example/e"},
+	}, normalizeSitemapEntries(entries), "the later lastmod of /a is kept")
+
+	// Only sitemaps that can't be read at all are an error.
+	_, err = readSitemaps(context.Background(), []string{site.URL + "/missing.xml", site.URL + "/a"})
+	assert.ErrorContains(t, err, "no sitemap could be read")
+	entries, err = readSitemaps(context.Background(), []string{site.URL + "/missing.xml", site.URL + "/sitemap-posts.xml"})
+	require.NoError(t, err)
+	assert.Len(t, entries, 4)
+}
+
+// normalizeSitemapEntries puts lastmods in UTC so they compare with assert.Equal.
+func normalizeSitemapEntries(entries []sitemapEntry) []sitemapEntry {
+	for i := range entries {
+		if !entries[i].LastMod.IsZero() {
+			entries[i].LastMod = entries[i].LastMod.UTC()
+		}
+	}
+	return entries
+}
+
+func TestIngestSitemaps(t *testing.T) {
+	usePoliteness(t, 0)
+	site := newSitemapSite(t)
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+
+	// /a hasn't changed since it was saved, /b has, /c and /d have no lastmod and
+	// /c isn't saved, while /e is on another host.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT url, last_updated FROM pages WHERE url = ANY($1)")).
+		WithArgs(pq.Array([]string{site.URL + "/a", site.URL + "/b", site.URL + "/c", site.URL + "/d", "https://elsewhere.example/e"})).
+		WillReturnRows(sqlmock.NewRows([]string{"url", "last_updated"}).
+			AddRow(site.URL+"/a", time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)).
+			AddRow(site.URL+"/b", time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)).
+			AddRow(site.URL+"/d", nil))
+
+	var saved []string
+	c := &crawler{maxDepth: 2, maxPages: 10, save: func(page Page, lang string) error {
+		saved = append(saved, strings.TrimPrefix(page.URL, site.URL))
+		return nil
+	}}
+	stats, err := c.ingestSitemaps(context.Background(), []string{site.URL + "/sitemap.xml"})
+	require.NoError(t, err)
+	assert.Equal(t, SitemapStats{URLs: 5, Unchanged: 1, CrawlStats: CrawlStats{Fetched: 3, Saved: 3}}, stats)
+	assert.Equal(t, []string{"/c", "/d", "/b"}, saved, "new pages go first, then those saved longest ago, and links aren't followed")
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT url, last_updated FROM pages WHERE url = ANY($1)")).
+		WillReturnError(fmt.Errorf("connection refused"))
+	_, err = c.ingestSitemaps(context.Background(), []string{site.URL + "/sitemap.xml"})
+	assert.ErrorContains(t, err, "connection refused")
+
+	// Ingestions of the configured sitemaps take turns.
+	sitemapMu.Lock()
+	_, err = ingestConfiguredSitemaps(context.Background())
+	sitemapMu.Unlock()
+	assert.ErrorIs(t, err, errSitemapIngestionRunning)
+}
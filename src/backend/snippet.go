@@ -0,0 +1,145 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Highlighted terms in snippets are wrapped in these private-use runes instead of
+// HTML tags, so snippets stay plain text until highlightHTML escapes and renders them.
+const (
+	highlightPreTag  = "\ue000"
+	highlightPostTag = "\ue001"
+)
+
+// snippetLength is the approximate number of characters in a result snippet.
+const snippetLength = 200
+
+// queryTerms splits a search query into the distinct words used for highlighting.
+func queryTerms(query string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, field := range strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		term := strings.ToLower(field)
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// termsPattern matches any of the terms, case-insensitively. It returns nil if there are no terms.
+func termsPattern(terms []string) *regexp.Regexp {
+	if len(terms) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	return regexp.MustCompile(`(?i)(` + strings.Join(quoted, "|") + `)`)
+}
+
+// buildSnippet cuts a window of about snippetLength characters out of content,
+// centred on the first query term it finds, and marks every term in it.
+// It is the database counterpart of Elasticsearch's highlighter.
+func buildSnippet(content, query string) string {
+	content = strings.Join(strings.Fields(stripHighlightTags(content)), " ")
+	pattern := termsPattern(queryTerms(query))
+
+	runes := []rune(content)
+	startRune := 0
+	if pattern != nil {
+		if loc := pattern.FindStringIndex(content); loc != nil {
+			startRune = utf8.RuneCountInString(content[:loc[0]]) - snippetLength/4
+		}
+	}
+	endRune := min(max(startRune, 0)+snippetLength, len(runes))
+	startRune = max(endRune-snippetLength, 0)
+
+	// Move the edges to word boundaries so the snippet doesn't start or end mid-word.
+	if startRune > 0 {
+		wordStart := startRune
+		for wordStart < endRune && runes[wordStart-1] != ' ' {
+			wordStart++
+		}
+		if wordStart < endRune {
+			startRune = wordStart
+		}
+	}
+	if endRune < len(runes) {
+		for wordEnd := endRune; wordEnd > startRune; wordEnd-- {
+			if runes[wordEnd] == ' ' {
+				endRune = wordEnd
+				break
+			}
+		}
+	}
+
+	snippet := string(runes[startRune:endRune])
+	if pattern != nil {
+		snippet = pattern.ReplaceAllString(snippet, highlightPreTag+"$1"+highlightPostTag)
+	}
+	if startRune > 0 {
+		snippet = "…" + snippet
+	}
+	if endRune < len(runes) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// highlightTerms marks every query term in text without shortening it.
+func highlightTerms(text, query string) string {
+	text = stripHighlightTags(text)
+	pattern := termsPattern(queryTerms(query))
+	if pattern == nil {
+		return text
+	}
+	return pattern.ReplaceAllString(text, highlightPreTag+"$1"+highlightPostTag)
+}
+
+func stripHighlightTags(text string) string {
+	return strings.NewReplacer(highlightPreTag, "", highlightPostTag, "").Replace(text)
+}
+
+// highlightHTML escapes a snippet and turns its highlight markers into <mark> elements.
+func highlightHTML(snippet string) template.HTML {
+	var b strings.Builder
+	open := false
+	for len(snippet) > 0 {
+		pre := strings.Index(snippet, highlightPreTag)
+		post := strings.Index(snippet, highlightPostTag)
+
+		next, tag := pre, highlightPreTag
+		if post >= 0 && (pre < 0 || post < pre) {
+			next, tag = post, highlightPostTag
+		}
+		if next < 0 {
+			b.WriteString(html.EscapeString(snippet))
+			break
+		}
+
+		b.WriteString(html.EscapeString(snippet[:next]))
+		switch {
+		case tag == highlightPreTag && !open:
+			b.WriteString("<mark>")
+			open = true
+		case tag == highlightPostTag && open:
+			b.WriteString("</mark>")
+			open = false
+		}
+		snippet = snippet[next+len(tag):]
+	}
+	if open {
+		b.WriteString("</mark>")
+	}
+	return template.HTML(b.String())
+}
@@ -0,0 +1,73 @@
+// Unit tests for search result snippets and highlighting
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryTerms(t *testing.T) {
+	assert.Equal(t, []string{"go", "routines"}, queryTerms(`"Go routines" go`))
+	assert.Equal(t, []string{"æblegrød"}, queryTerms("Æblegrød!"))
+	assert.Empty(t, queryTerms(`"" -- !!`))
+}
+
+func TestBuildSnippet(t *testing.T) {
+	t.Run("Short content is kept whole", func(t *testing.T) {
+		snippet := buildSnippet("Go is a  programming\nlanguage", "programming")
+		assert.Equal(t, "Go is a "+highlightPreTag+"programming"+highlightPostTag+" language", snippet)
+	})
+
+	t.Run("Window around the first match", func(t *testing.T) {
+		content := strings.Repeat("filler words here ", 40) + "the Gopher mascot " + strings.Repeat("more trailing text ", 40)
+		snippet := buildSnippet(content, "gopher")
+
+		assert.True(t, strings.HasPrefix(snippet, "…"))
+		assert.True(t, strings.HasSuffix(snippet, "…"))
+		assert.Contains(t, snippet, highlightPreTag+"Gopher"+highlightPostTag)
+		assert.LessOrEqual(t, utf8.RuneCountInString(stripHighlightTags(snippet)), snippetLength+2)
+		assert.NotContains(t, snippet, "…ller")
+	})
+
+	t.Run("No match falls back to the beginning", func(t *testing.T) {
+		content := strings.Repeat("lorem ipsum ", 50)
+		snippet := buildSnippet(content, "absent")
+
+		assert.True(t, strings.HasPrefix(snippet, "lorem"))
+		assert.True(t, strings.HasSuffix(snippet, "…"))
+		assert.NotContains(t, snippet, highlightPreTag)
+	})
+}
+
+func TestHighlightHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		snippet  string
+		expected string
+	}{
+		{
+			name:     "Marks terms",
+			snippet:  "about " + highlightPreTag + "Go" + highlightPostTag + " code",
+			expected: "about <mark>Go</mark> code",
+		},
+		{
+			name:     "Escapes markup in content",
+			snippet:  `<script>alert("x")</script> ` + highlightPreTag + "term" + highlightPostTag,
+			expected: "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; <mark>term</mark>",
+		},
+		{
+			name:     "Ignores unbalanced markers",
+			snippet:  highlightPostTag + "a " + highlightPreTag + "b",
+			expected: "a <mark>b</mark>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, string(highlightHTML(tt.snippet)))
+		})
+	}
+}
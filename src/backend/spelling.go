@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// minCorrectedWordLength is the length in runes below which words are never corrected.
+const minCorrectedWordLength = 3
+
+// vocabularyMaxAge is how long the vocabulary of the SQL backends is used before it is rebuilt.
+const vocabularyMaxAge = time.Hour
+
+// vocabularyBuildTimeout bounds reading the vocabulary from the pages table.
+const vocabularyBuildTimeout = 5 * time.Minute
+
+// vocabulary counts the pages every lower-case word occurs in. It suggests
+// corrections for misspelled words by edit distance.
+type vocabulary map[string]int
+
+// pageWords returns the distinct words of a page's title and content.
+func pageWords(page Page) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range tokenize(page.Title + " " + page.Content) {
+		words[word] = true
+	}
+	return words
+}
+
+func (v vocabulary) addPage(page Page) {
+	for word := range pageWords(page) {
+		v[word]++
+	}
+}
+
+func (v vocabulary) removePage(page Page) {
+	for word := range pageWords(page) {
+		if v[word] <= 1 {
+			delete(v, word)
+		} else {
+			v[word]--
+		}
+	}
+}
+
+// correct returns the word closest to word in edit distance, preferring words in
+// more pages. It returns false if word is known, too short, or nothing is close.
+func (v vocabulary) correct(word string) (string, bool) {
+	length := utf8.RuneCountInString(word)
+	if _, ok := v[word]; ok || length < minCorrectedWordLength || isNumber(word) {
+		return "", false
+	}
+	maxDistance := 2
+	if length <= 4 {
+		maxDistance = 1
+	}
+
+	runes := []rune(word)
+	best, bestDistance, bestCount := "", maxDistance+1, 0
+	for candidate, count := range v {
+		if diff := utf8.RuneCountInString(candidate) - length; diff > maxDistance || -diff > maxDistance {
+			continue
+		}
+		distance := editDistance(runes, []rune(candidate), min(bestDistance, maxDistance))
+		if distance > maxDistance {
+			continue
+		}
+		if distance < bestDistance || (distance == bestDistance && (count > bestCount || (count == bestCount && candidate < best))) {
+			best, bestDistance, bestCount = candidate, distance, count
+		}
+	}
+	return best, best != ""
+}
+
+// corrections returns a correction for every word in words that has one.
+func (v vocabulary) corrections(words []string) map[string]string {
+	corrections := make(map[string]string)
+	for _, word := range words {
+		if correction, ok := v.correct(word); ok {
+			corrections[word] = correction
+		}
+	}
+	return corrections
+}
+
+func isNumber(word string) bool {
+	return strings.IndexFunc(word, func(r rune) bool { return !unicode.IsNumber(r) }) == -1
+}
+
+// editDistance is the Damerau-Levenshtein (optimal string alignment) distance between
+// a and b. Distances above limit are returned as limit+1.
+func editDistance(a, b []rune, limit int) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return min(prev[len(b)], limit+1)
+}
+
+// cachedVocabulary is the vocabulary of the pages table. It is built in the background
+// and swapped in whole, so corrections never wait for the pages table to be read.
+type cachedVocabulary struct {
+	current atomic.Pointer[builtVocabulary]
+	// building is held while the vocabulary is built, so one build runs at a time.
+	building sync.Mutex
+}
+
+type builtVocabulary struct {
+	words   vocabulary
+	builtAt time.Time
+}
+
+// pagesVocabulary corrects words for the backends that search the pages table directly.
+var pagesVocabulary = &cachedVocabulary{}
+
+// get returns the current vocabulary, which is empty until it is first built. A
+// vocabulary that is missing or older than vocabularyMaxAge is rebuilt in the background.
+func (c *cachedVocabulary) get() vocabulary {
+	built := c.current.Load()
+	if built == nil || time.Since(built.builtAt) >= vocabularyMaxAge {
+		c.refresh()
+	}
+	if built == nil {
+		return nil
+	}
+	return built.words
+}
+
+// refresh builds the vocabulary in the background, unless a build is already running.
+func (c *cachedVocabulary) refresh() {
+	if !c.building.TryLock() {
+		return
+	}
+	go func() {
+		defer c.building.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), vocabularyBuildTimeout)
+		defer cancel()
+		if err := c.build(ctx); err != nil {
+			log.Printf("Error building the spelling vocabulary: %v", err)
+		}
+	}()
+}
+
+// build reads the vocabulary from the pages table and swaps it in.
+func (c *cachedVocabulary) build(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "SELECT title, content FROM pages")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	words := make(vocabulary)
+	for rows.Next() {
+		var page Page
+		if err := rows.Scan(&page.Title, &page.Content); err != nil {
+			return err
+		}
+		words.addPage(page)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	c.current.Store(&builtVocabulary{words: words, builtAt: time.Now()})
+	return nil
+}
+
+// correctionWords returns the distinct lower-case words of the query's positive words and
+// phrases in the order they are written, as the phrase suggester scores words by their neighbours.
+func correctionWords(node queryNode) []string {
+	seen := make(map[string]bool)
+	var words []string
+	for _, text := range positiveText(node) {
+		for _, word := range tokenize(text.Text) {
+			if !seen[word] {
+				seen[word] = true
+				words = append(words, word)
+			}
+		}
+	}
+	return words
+}
+
+// correctQuery replaces misspelled words in the query's positive words and phrases,
+// leaving operators, exclusions and spacing as they are.
+func correctQuery(query string, corrections map[string]string) string {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return query
+	}
+
+	runes := []rune(query)
+	var b strings.Builder
+	last := 0
+	for _, token := range tokens {
+		if token.or || token.negated {
+			continue
+		}
+		if node, err := parseQueryOperator(token); err != nil || node != nil {
+			continue
+		}
+		b.WriteString(string(runes[last:token.start]))
+		b.WriteString(correctWords(string(runes[token.start:token.end]), corrections))
+		last = token.end
+	}
+	b.WriteString(string(runes[last:]))
+	return b.String()
+}
+
+// correctWords replaces every word of text that has a correction.
+func correctWords(text string, corrections map[string]string) string {
+	var b strings.Builder
+	var word []rune
+	flush := func() {
+		if correction, ok := corrections[strings.ToLower(string(word))]; ok {
+			b.WriteString(correction)
+		} else {
+			b.WriteString(string(word))
+		}
+		word = word[:0]
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		b.WriteRune(r)
+	}
+	flush()
+	return b.String()
+}
+
+// didYouMean returns a corrected query for a search that found nothing, or "" if the
+// search found pages or the search backend knows no better spelling.
+func didYouMean(ctx context.Context, query string, results SearchResults) string {
+	if results.Total > 0 || len(results.LanguageFacets) > 0 {
+		return ""
+	}
+	parsed, err := parseQuery(query)
+	if err != nil {
+		return ""
+	}
+	words := correctionWords(parsed)
+	if len(words) == 0 {
+		return ""
+	}
+
+	corrections, err := searchBackend.Correct(ctx, words)
+	if err != nil {
+		log.Printf("Error getting spelling corrections: %v", err)
+		return ""
+	}
+	for word, correction := range corrections {
+		if correction == word {
+			delete(corrections, word)
+		}
+	}
+	if len(corrections) == 0 {
+		return ""
+	}
+
+	if corrected := correctQuery(query, corrections); corrected != query {
+		return corrected
+	}
+	return ""
+}
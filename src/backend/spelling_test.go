@@ -0,0 +1,192 @@
+// Unit tests for "did you mean" spelling corrections
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"golang", "golang", 0},
+		{"golnag", "golang", 1},
+		{"goland", "golang", 1},
+		{"glang", "golang", 1},
+		{"programing", "programming", 1},
+		{"prgoramign", "programming", 3},
+		{"kærlighd", "kærlighed", 1},
+		{"", "go", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"/"+tt.b, func(t *testing.T) {
+			assert.Equal(t, tt.expected, editDistance([]rune(tt.a), []rune(tt.b), 3))
+		})
+	}
+
+	assert.Equal(t, 2, editDistance([]rune("prgoramign"), []rune("programming"), 1), "distances above the limit are capped")
+}
+
+func TestVocabularyCorrect(t *testing.T) {
+	v := make(vocabulary)
+	v.addPage(Page{Title: "Go", Content: "Go, or golang, is a programming language with goroutines"})
+	v.addPage(Page{Title: "Golang", Content: "golang programming"})
+	v.addPage(Page{Title: "Goland", Content: "Goland is an IDE"})
+	v.addPage(Page{Title: "Rust", Content: "Rust is a programming language"})
+
+	corrections := v.corrections([]string{"programing", "golnag", "langauge", "rust", "gp", "2024", "haskell"})
+	assert.Equal(t, map[string]string{
+		"programing": "programming",
+		"golnag":     "golang",
+		"langauge":   "language",
+	}, corrections, "known, short, numeric and distant words are not corrected")
+
+	correction, ok := v.correct("golanf")
+	require.True(t, ok)
+	assert.Equal(t, "golang", correction, "the word in more pages wins a tie")
+
+	v.removePage(Page{Title: "Golang", Content: "golang programming"})
+	correction, _ = v.correct("golanf")
+	assert.Equal(t, "goland", correction, "ties on pages go to the first word alphabetically")
+	assert.Equal(t, 2, v["programming"])
+}
+
+func TestCorrectQuery(t *testing.T) {
+	corrections := map[string]string{"golnag": "golang", "rutines": "routines", "jaav": "java"}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "golnag", expected: "golang"},
+		{query: `"go  rutines" Golnag`, expected: `"go  routines" golang`},
+		{query: "golnag OR rutines site:golnag.org", expected: "golang OR routines site:golnag.org"},
+		{query: "golnag -jaav", expected: "golang -jaav"},
+		{query: `"golnag`, expected: `"golnag`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			assert.Equal(t, tt.expected, correctQuery(tt.query, corrections))
+		})
+	}
+}
+
+func TestCorrectionWords(t *testing.T) {
+	parsed, err := parseQuery(`"Golnag rutines" -java programing golnag OR rutines`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"golnag", "rutines", "programing"}, correctionWords(parsed))
+}
+
+func TestDidYouMean(t *testing.T) {
+	backend := &stubBackend{corrections: map[string]string{"golnag": "golang", "java": "java"}}
+	useSearchBackend(t, backend)
+
+	assert.Equal(t, "golang -jaav", didYouMean(context.Background(), "golnag -jaav", SearchResults{}))
+	assert.Empty(t, didYouMean(context.Background(), "java", SearchResults{}), "unchanged words are not corrections")
+	assert.Empty(t, didYouMean(context.Background(), "site:golnag.org", SearchResults{}), "there are no words to correct")
+
+	calls := backend.calls
+	assert.Empty(t, didYouMean(context.Background(), "golnag", SearchResults{Total: 1}))
+	assert.Empty(t, didYouMean(context.Background(), "golnag lang:da", SearchResults{LanguageFacets: []LanguageFacet{{Language: "en", Count: 1}}}),
+		"pages were found in another language")
+	assert.Equal(t, calls, backend.calls, "searches that found pages are not corrected")
+
+	useSearchBackend(t, &stubBackend{err: errors.New("connection refused")})
+	assert.Empty(t, didYouMean(context.Background(), "golnag", SearchResults{}))
+}
+
+func TestSQLBackendCorrect(t *testing.T) {
+	mockDB, mock := setupMockDB()
+	defer func() { _ = mockDB.Close() }()
+	previous := pagesVocabulary
+	pagesVocabulary = &cachedVocabulary{}
+	t.Cleanup(func() { pagesVocabulary = previous })
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT title, content FROM pages")).
+		WillReturnRows(sqlmock.NewRows([]string{"title", "content"}).
+			AddRow("Go", "Go is a programming language").
+			AddRow("Rust", "Rust is a programming language"))
+
+	// Nothing is corrected until the vocabulary has been built in the background.
+	corrections, err := sqliteBackend{}.Correct(context.Background(), []string{"programing", "rust"})
+	require.NoError(t, err)
+	assert.Empty(t, corrections)
+	waitForVocabulary(t, nil)
+
+	corrections, err = sqliteBackend{}.Correct(context.Background(), []string{"programing", "rust"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"programing": "programming"}, corrections)
+
+	// The vocabulary is reused until it gets old.
+	corrections, err = postgresBackend{}.Correct(context.Background(), []string{"langage"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"langage": "language"}, corrections)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// An old vocabulary is used while the new one is built.
+	old := pagesVocabulary.current.Load()
+	pagesVocabulary.current.Store(&builtVocabulary{words: old.words, builtAt: time.Now().Add(-vocabularyMaxAge)})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT title, content FROM pages")).
+		WillReturnRows(sqlmock.NewRows([]string{"title", "content"}).AddRow("Java", "Java is a programming language"))
+	corrections, err = postgresBackend{}.Correct(context.Background(), []string{"rusd"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"rusd": "rust"}, corrections)
+	waitForVocabulary(t, old)
+
+	corrections, err = postgresBackend{}.Correct(context.Background(), []string{"rusd", "jaav"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"jaav": "java"}, corrections)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// waitForVocabulary waits until pagesVocabulary has been built anew after previous
+// and the build has finished.
+func waitForVocabulary(t *testing.T, previous *builtVocabulary) {
+	require.Eventually(t, func() bool {
+		if !pagesVocabulary.building.TryLock() {
+			return false
+		}
+		defer pagesVocabulary.building.Unlock()
+		built := pagesVocabulary.current.Load()
+		return built != nil && built != previous
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestAPISearchDidYouMean(t *testing.T) {
+	useSearchBackend(t, &stubBackend{corrections: map[string]string{"golnag": "golang"}})
+
+	req := httptest.NewRequest("GET", "/api/search?q=golnag", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+
+	apiSearchHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response SearchResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "golang", response.DidYouMean)
+
+	req = httptest.NewRequest("GET", "/api/search?q=golnag&lang=en", nil)
+	req.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+
+	apiSearchHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `Did you mean <a id="did-you-mean" href="/api/search?lang=en&amp;page=1&amp;q=golang&amp;size=10">golang</a>?`)
+	assert.Contains(t, w.Body.String(), "No results found")
+}
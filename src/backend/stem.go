@@ -0,0 +1,319 @@
+package main
+
+import (
+	"strings"
+)
+
+// stemWord reduces a lower-case word to its stem with the stemmer for lang
+// (the Snowball Danish and English algorithms). Words in other languages are
+// returned unchanged.
+func stemWord(word, lang string) string {
+	switch lang {
+	case "da":
+		return stemDanish(word)
+	case "en":
+		return stemEnglish(word)
+	}
+	return word
+}
+
+// suffixRule replaces suffix with replacement.
+type suffixRule struct {
+	suffix      string
+	replacement string
+}
+
+func isDanishVowel(r rune) bool {
+	return strings.ContainsRune("aeiouyæåø", r)
+}
+
+// danishStep1Suffixes are removed from R1 by step 1, longest first.
+var danishStep1Suffixes = []string{
+	"erendes",
+	"erende", "hedens",
+	"ethed", "erede", "heden", "heder", "endes", "ernes", "erens", "erets",
+	"ered", "ende", "erne", "eren", "erer", "heds", "enes", "eres", "eret",
+	"hed", "ene", "ere", "ens", "ers", "ets",
+	"en", "er", "es", "et",
+	"e",
+}
+
+// stemDanish implements the Snowball Danish stemmer.
+func stemDanish(word string) string {
+	w := []rune(word)
+
+	// R1 starts after the first non-vowel following a vowel, but never before the fourth letter.
+	r1 := len(w)
+	for i := 1; i < len(w); i++ {
+		if !isDanishVowel(w[i]) && isDanishVowel(w[i-1]) {
+			r1 = i + 1
+			break
+		}
+	}
+	if r1 < 3 {
+		r1 = 3
+	}
+	inR1 := func(suffix string) bool {
+		n := len([]rune(suffix))
+		return len(w)-n >= r1 && strings.HasSuffix(string(w), suffix)
+	}
+	trim := func(n int) { w = w[:len(w)-n] }
+
+	// Step 1: main suffixes.
+	removed := false
+	for _, suffix := range danishStep1Suffixes {
+		if inR1(suffix) {
+			trim(len([]rune(suffix)))
+			removed = true
+			break
+		}
+	}
+	if !removed && len(w) >= 2 && inR1("s") && strings.ContainsRune("abcdfghjklmnoprtvyzå", w[len(w)-2]) {
+		trim(1)
+	}
+
+	// Step 2: consonant pairs.
+	undoublePair := func() {
+		for _, pair := range []string{"gd", "dt", "gt", "kt"} {
+			if inR1(pair) {
+				trim(1)
+				return
+			}
+		}
+	}
+	undoublePair()
+
+	// Step 3: other suffixes.
+	if strings.HasSuffix(string(w), "igst") {
+		trim(2)
+	}
+	for _, suffix := range []string{"elig", "løst", "lig", "els", "ig"} {
+		if inR1(suffix) {
+			if suffix == "løst" {
+				trim(1)
+			} else {
+				trim(len([]rune(suffix)))
+				undoublePair()
+			}
+			break
+		}
+	}
+
+	// Step 4: undouble a final double consonant in R1.
+	if n := len(w); n-1 >= r1 && n >= 2 && w[n-1] == w[n-2] && !isDanishVowel(w[n-1]) {
+		trim(1)
+	}
+	return string(w)
+}
+
+func isEnglishVowel(b byte) bool {
+	return strings.IndexByte("aeiouy", b) >= 0
+}
+
+// englishRegion returns the start of the region after the first non-vowel following a vowel at or after start.
+func englishRegion(w []byte, start int) int {
+	for i := start + 1; i < len(w); i++ {
+		if !isEnglishVowel(w[i]) && isEnglishVowel(w[i-1]) {
+			return i + 1
+		}
+	}
+	return len(w)
+}
+
+func containsEnglishVowel(w []byte) bool {
+	for _, b := range w {
+		if isEnglishVowel(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// endsShortSyllable reports whether w ends in a short syllable: a vowel followed by a
+// non-vowel other than w, x or Y and preceded by a non-vowel, or a vowel at the
+// start of the word followed by a non-vowel.
+func endsShortSyllable(w []byte) bool {
+	n := len(w)
+	switch {
+	case n == 2:
+		return isEnglishVowel(w[0]) && !isEnglishVowel(w[1])
+	case n > 2:
+		return !isEnglishVowel(w[n-3]) && isEnglishVowel(w[n-2]) && !isEnglishVowel(w[n-1]) &&
+			w[n-1] != 'w' && w[n-1] != 'x' && w[n-1] != 'Y'
+	}
+	return false
+}
+
+func endsDoubleConsonant(w []byte) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && strings.IndexByte("bdfgmnprt", w[n-1]) >= 0
+}
+
+// englishStep2Rules and englishStep3Rules are ordered longest suffix first.
+var englishStep2Rules = []suffixRule{
+	{"ization", "ize"}, {"ational", "ate"}, {"fulness", "ful"}, {"ousness", "ous"}, {"iveness", "ive"},
+	{"tional", "tion"}, {"biliti", "ble"}, {"lessli", "less"},
+	{"entli", "ent"}, {"ation", "ate"}, {"alism", "al"}, {"aliti", "al"}, {"ousli", "ous"}, {"iviti", "ive"}, {"fulli", "ful"},
+	{"enci", "ence"}, {"anci", "ance"}, {"abli", "able"}, {"izer", "ize"}, {"ator", "ate"}, {"alli", "al"},
+	{"bli", "ble"}, {"ogi", "og"},
+	{"li", ""},
+}
+
+var englishStep3Rules = []suffixRule{
+	{"ational", "ate"}, {"tional", "tion"},
+	{"alize", "al"}, {"icate", "ic"}, {"iciti", "ic"}, {"ative", ""},
+	{"ical", "ic"}, {"ness", ""},
+	{"ful", ""},
+}
+
+var englishStep4Suffixes = []string{
+	"ement",
+	"ance", "ence", "able", "ible", "ment",
+	"ant", "ent", "ism", "ate", "iti", "ous", "ive", "ize", "ion",
+	"al", "er", "ic",
+}
+
+// stemEnglish implements the Snowball English (Porter2) stemmer, without its list of exceptional words.
+func stemEnglish(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	w := []byte(strings.TrimPrefix(word, "'"))
+
+	// A y that starts the word or follows a vowel is a consonant; mark it as Y.
+	for i := range w {
+		if w[i] == 'y' && (i == 0 || isEnglishVowel(w[i-1])) {
+			w[i] = 'Y'
+		}
+	}
+
+	r1 := -1
+	for _, prefix := range []string{"gener", "commun", "arsen"} {
+		if strings.HasPrefix(string(w), prefix) {
+			r1 = len(prefix)
+			break
+		}
+	}
+	if r1 < 0 {
+		r1 = englishRegion(w, 0)
+	}
+	r2 := englishRegion(w, r1)
+
+	hasSuffix := func(suffix string) bool { return strings.HasSuffix(string(w), suffix) }
+	replace := func(suffix, replacement string) {
+		w = append(w[:len(w)-len(suffix)], replacement...)
+	}
+	stemStart := func(suffix string) int { return len(w) - len(suffix) }
+
+	// Step 0: possessives.
+	for _, suffix := range []string{"'s'", "'s", "'"} {
+		if hasSuffix(suffix) {
+			replace(suffix, "")
+			break
+		}
+	}
+
+	// Step 1a: plurals.
+	switch {
+	case hasSuffix("sses"):
+		replace("sses", "ss")
+	case hasSuffix("ied"), hasSuffix("ies"):
+		suffix := string(w[len(w)-3:])
+		if len(w) > 4 {
+			replace(suffix, "i")
+		} else {
+			replace(suffix, "ie")
+		}
+	case hasSuffix("us"), hasSuffix("ss"):
+	case hasSuffix("s"):
+		if containsEnglishVowel(w[:len(w)-2]) {
+			replace("s", "")
+		}
+	}
+
+	// Step 1b: -ed and -ing.
+	for _, suffix := range []string{"eedly", "ingly", "edly", "eed", "ing", "ed"} {
+		if !hasSuffix(suffix) {
+			continue
+		}
+		if suffix == "eed" || suffix == "eedly" {
+			if stemStart(suffix) >= r1 {
+				replace(suffix, "ee")
+			}
+			break
+		}
+		if !containsEnglishVowel(w[:stemStart(suffix)]) {
+			break
+		}
+		replace(suffix, "")
+		switch {
+		case hasSuffix("at"), hasSuffix("bl"), hasSuffix("iz"):
+			w = append(w, 'e')
+		case endsDoubleConsonant(w):
+			w = w[:len(w)-1]
+		case r1 >= len(w) && endsShortSyllable(w):
+			w = append(w, 'e')
+		}
+		break
+	}
+
+	// Step 1c: a final y after a consonant becomes i.
+	if n := len(w); n > 2 && (w[n-1] == 'y' || w[n-1] == 'Y') && !isEnglishVowel(w[n-2]) {
+		w[n-1] = 'i'
+	}
+
+	// Step 2.
+	for _, rule := range englishStep2Rules {
+		if !hasSuffix(rule.suffix) {
+			continue
+		}
+		start := stemStart(rule.suffix)
+		ok := start >= r1
+		switch rule.suffix {
+		case "ogi":
+			ok = ok && start > 0 && w[start-1] == 'l'
+		case "li":
+			ok = ok && start > 0 && strings.IndexByte("cdeghkmnrt", w[start-1]) >= 0
+		}
+		if ok {
+			replace(rule.suffix, rule.replacement)
+		}
+		break
+	}
+
+	// Step 3.
+	for _, rule := range englishStep3Rules {
+		if !hasSuffix(rule.suffix) {
+			continue
+		}
+		start := stemStart(rule.suffix)
+		if start >= r1 && (rule.suffix != "ative" || start >= r2) {
+			replace(rule.suffix, rule.replacement)
+		}
+		break
+	}
+
+	// Step 4.
+	for _, suffix := range englishStep4Suffixes {
+		if !hasSuffix(suffix) {
+			continue
+		}
+		start := stemStart(suffix)
+		if start >= r2 && (suffix != "ion" || (start > 0 && (w[start-1] == 's' || w[start-1] == 't'))) {
+			replace(suffix, "")
+		}
+		break
+	}
+
+	// Step 5: a final e or l.
+	if n := len(w); n > 0 {
+		switch {
+		case w[n-1] == 'e' && (n-1 >= r2 || (n-1 >= r1 && !endsShortSyllable(w[:n-1]))):
+			w = w[:n-1]
+		case w[n-1] == 'l' && n-1 >= r2 && n >= 2 && w[n-2] == 'l':
+			w = w[:n-1]
+		}
+	}
+
+	return strings.ReplaceAll(string(w), "Y", "y")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultSuggestSize = 8
+	maxSuggestSize     = 20
+	// minPopularQueryCount is how often a query must have been searched before it is
+	// suggested to others, so one-off queries never leak into suggestions.
+	minPopularQueryCount = 2
+	// maxPopularQueries caps the number of distinct queries counted in memory.
+	maxPopularQueries = 10000
+	// suggestCacheMaxAge is how long clients may cache suggestions, in seconds.
+	suggestCacheMaxAge = 60
+)
+
+// Sources of a Suggestion.
+const (
+	suggestionSourceQuery = "query"
+	suggestionSourceTitle = "title"
+)
+
+// SuggestResponse is the JSON document returned by /api/suggest.
+type SuggestResponse struct {
+	APIVersion  string       `json:"api_version"`
+	Query       string       `json:"query"`
+	Suggestions []Suggestion `json:"suggestions"`
+}
+
+// Suggestion is a completion of the typed query: a popular past query or a page title.
+type Suggestion struct {
+	Text   string `json:"text"`
+	Source string `json:"source"`
+}
+
+// queryCounter counts how often each normalised query has been searched.
+type queryCounter struct {
+	mu     sync.RWMutex
+	counts map[string]int
+}
+
+// popularQueries counts the queries in the search log. It is filled by loadSearchLog
+// at startup and kept up to date by logSearchQuery.
+var popularQueries = newQueryCounter()
+
+func newQueryCounter() *queryCounter {
+	return &queryCounter{counts: make(map[string]int)}
+}
+
+// normalizeQuery lower-cases a query and collapses its whitespace.
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
+
+// add counts a search for query. New queries are ignored once maxPopularQueries are counted.
+func (c *queryCounter) add(query string) {
+	query = normalizeQuery(query)
+	if query == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.counts[query]; ok || len(c.counts) < maxPopularQueries {
+		c.counts[query]++
+	}
+}
+
+// withPrefix returns up to n queries starting with prefix that were searched at least
+// minPopularQueryCount times, most popular first.
+func (c *queryCounter) withPrefix(prefix string, n int) []string {
+	prefix = normalizeQuery(prefix)
+
+	type queryCount struct {
+		query string
+		count int
+	}
+	var matches []queryCount
+	c.mu.RLock()
+	for query, count := range c.counts {
+		if count >= minPopularQueryCount && strings.HasPrefix(query, prefix) {
+			matches = append(matches, queryCount{query, count})
+		}
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].count != matches[j].count {
+			return matches[i].count > matches[j].count
+		}
+		return matches[i].query < matches[j].query
+	})
+
+	queries := make([]string, 0, min(n, len(matches)))
+	for _, match := range matches[:min(n, len(matches))] {
+		queries = append(queries, match.query)
+	}
+	return queries
+}
+
+// searchLogQueryPattern matches the quoted query logSearchQuery writes.
+var searchLogQueryPattern = regexp.MustCompile(`query=("(?:[^"\\]|\\.)*")`)
+
+// loadSearchLog counts every query in the search log at path.
+func (c *queryCounter) loadSearchLog(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		match := searchLogQueryPattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		if query, err := strconv.Unquote(match[1]); err == nil {
+			c.add(query)
+		}
+	}
+	return scanner.Err()
+}
+
+// apiSuggestHandler serves /api/suggest?q=, completions of a partly typed query for
+// search-as-you-type. Popular past queries come first, interleaved with page titles.
+func apiSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	size := defaultSuggestSize
+	if value := r.URL.Query().Get("size"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxSuggestSize {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("size must be a number between 1 and %d", maxSuggestSize))
+			return
+		}
+		size = parsed
+	}
+
+	response := SuggestResponse{APIVersion: searchAPIVersion, Query: prefix, Suggestions: []Suggestion{}}
+	if prefix == "" {
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	titles, err := searchBackend.Suggest(r.Context(), prefix, size)
+	if err != nil {
+		log.Printf("Error getting suggestions: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error getting suggestions")
+		return
+	}
+	response.Suggestions = mergeSuggestions(popularQueries.withPrefix(prefix, size), titles, size)
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", suggestCacheMaxAge))
+	writeJSON(w, http.StatusOK, response)
+}
+
+// mergeSuggestions alternates between queries and titles, skipping duplicates that
+// differ only in case, until it has size suggestions.
+func mergeSuggestions(queries, titles []string, size int) []Suggestion {
+	suggestions := []Suggestion{}
+	seen := make(map[string]bool)
+	add := func(text, source string) {
+		key := normalizeQuery(text)
+		if len(suggestions) < size && !seen[key] {
+			seen[key] = true
+			suggestions = append(suggestions, Suggestion{Text: text, Source: source})
+		}
+	}
+
+	for i := 0; i < max(len(queries), len(titles)); i++ {
+		if i < len(queries) {
+			add(queries[i], suggestionSourceQuery)
+		}
+		if i < len(titles) {
+			add(titles[i], suggestionSourceTitle)
+		}
+	}
+	return suggestions
+}
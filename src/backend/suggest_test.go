@@ -0,0 +1,135 @@
+// Unit tests for search suggestions and popular query counting
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// usePopularQueries replaces popularQueries with a counter holding the given queries.
+func usePopularQueries(t *testing.T, queries ...string) {
+	t.Helper()
+	previous := popularQueries
+	popularQueries = newQueryCounter()
+	for _, query := range queries {
+		popularQueries.add(query)
+	}
+	t.Cleanup(func() { popularQueries = previous })
+}
+
+func TestQueryCounterWithPrefix(t *testing.T) {
+	counter := newQueryCounter()
+	for _, query := range []string{"golang", "Golang ", "go  routines", "go routines", "go routines", "gopher", "rust", "rust"} {
+		counter.add(query)
+	}
+	counter.add("   ")
+
+	assert.Equal(t, []string{"go routines", "golang"}, counter.withPrefix("GO", 5), "queries searched once are left out")
+	assert.Equal(t, []string{"go routines"}, counter.withPrefix("go", 1))
+	assert.Equal(t, []string{"go routines", "golang", "rust"}, counter.withPrefix("", 5))
+	assert.Empty(t, counter.withPrefix("java", 5))
+}
+
+func TestQueryCounterLoadSearchLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "search.log")
+	log := `SEARCH: 2025/12/25 10:00:00 query="golang" from=127.0.0.1:1234
+SEARCH: 2025/12/25 10:00:01 query="say \"hi\"" from=127.0.0.1:1234
+SEARCH: 2025/12/25 10:00:02 query="GoLang" from=127.0.0.1:1234
+SEARCH: 2025/12/25 10:00:03 query="say \"hi\"" from=127.0.0.1:1234
+not a search line
+`
+	require.NoError(t, os.WriteFile(path, []byte(log), 0644))
+
+	counter := newQueryCounter()
+	require.NoError(t, counter.loadSearchLog(path))
+	assert.Equal(t, map[string]int{"golang": 2, `say "hi"`: 2}, counter.counts)
+
+	assert.ErrorIs(t, counter.loadSearchLog(filepath.Join(t.TempDir(), "missing.log")), os.ErrNotExist)
+}
+
+func TestMergeSuggestions(t *testing.T) {
+	suggestions := mergeSuggestions([]string{"go", "golang", "gopher"}, []string{"Go", "Goroutine"}, 4)
+	assert.Equal(t, []Suggestion{
+		{Text: "go", Source: suggestionSourceQuery},
+		{Text: "golang", Source: suggestionSourceQuery},
+		{Text: "Goroutine", Source: suggestionSourceTitle},
+		{Text: "gopher", Source: suggestionSourceQuery},
+	}, suggestions)
+}
+
+func TestAPISuggest(t *testing.T) {
+	usePopularQueries(t, "golang", "golang", "gopher")
+	backend := &stubBackend{suggestions: []string{"Go", "Goroutine"}}
+	useSearchBackend(t, backend)
+
+	req := httptest.NewRequest("GET", "/api/suggest?q=go", nil)
+	w := httptest.NewRecorder()
+
+	apiSuggestHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+	assert.Equal(t, "public, max-age=60", w.Header().Get("Cache-Control"))
+
+	var response SuggestResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, SuggestResponse{
+		APIVersion: searchAPIVersion,
+		Query:      "go",
+		Suggestions: []Suggestion{
+			{Text: "golang", Source: suggestionSourceQuery},
+			{Text: "Go", Source: suggestionSourceTitle},
+			{Text: "Goroutine", Source: suggestionSourceTitle},
+		},
+	}, response)
+}
+
+func TestAPISuggestBlankQuery(t *testing.T) {
+	backend := &stubBackend{}
+	useSearchBackend(t, backend)
+
+	req := httptest.NewRequest("GET", "/api/suggest?q=%20", nil)
+	w := httptest.NewRecorder()
+
+	apiSuggestHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"api_version": "v1", "query": "", "suggestions": []}`, w.Body.String())
+	assert.Equal(t, 0, backend.calls, "the backend is not asked for blank queries")
+}
+
+func TestAPISuggestErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		target         string
+		backendErr     error
+		expectedStatus int
+	}{
+		{name: "Invalid size", target: "/api/suggest?q=go&size=abc", expectedStatus: http.StatusBadRequest},
+		{name: "Size too large", target: "/api/suggest?q=go&size=100", expectedStatus: http.StatusBadRequest},
+		{name: "Backend error", target: "/api/suggest?q=go", backendErr: errors.New("connection refused"), expectedStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSearchBackend(t, &stubBackend{err: tt.backendErr})
+			req := httptest.NewRequest("GET", tt.target, nil)
+			w := httptest.NewRecorder()
+
+			apiSuggestHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			var response ErrorResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tt.expectedStatus, response.Error.Status)
+		})
+	}
+}
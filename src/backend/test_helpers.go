@@ -5,6 +5,7 @@ package main
 
 import (
 	"github.com/gorilla/mux"
+	"log"
 	"net/http"
 )
 
@@ -12,14 +13,18 @@ import (
 // Used by integration and smoke tests
 func setupRouter() http.Handler {
 	if esClient == nil {
-		initElasticsearch()
+		if err := initElasticsearch(); err != nil {
+			log.Fatalf("Failed to set up Elasticsearch: %v", err)
+		}
 	}
+	searchBackend = newElasticsearchBackend()
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", rootHandler).Methods("GET")
 	r.HandleFunc("/about", aboutHandler).Methods("GET")
 	r.HandleFunc("/api/weather", weatherHandler).Methods("GET")
-	r.HandleFunc("/api/search", searchHandler).Methods("GET")
+	r.HandleFunc("/api/search", apiSearchHandler).Methods("GET", "POST")
+	r.HandleFunc("/api/suggest", apiSuggestHandler).Methods("GET")
 	r.HandleFunc("/api/login", apiLogin).Methods("POST")
 	r.HandleFunc("/api/register", apiRegisterHandler).Methods("POST")
 	r.HandleFunc("/reset-password", resetPasswordHandler).Methods("GET")
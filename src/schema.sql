@@ -10,13 +10,90 @@ INSERT INTO users (username, email, password)
     ON CONFLICT (username) DO NOTHING;
 
 CREATE TABLE IF NOT EXISTS pages (
-    title TEXT PRIMARY KEY,
-    url TEXT NOT NULL UNIQUE,
+    title TEXT NOT NULL,
+    url TEXT PRIMARY KEY,
     language TEXT NOT NULL CHECK(language IN ('en', 'da')) DEFAULT 'en',
     last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     content TEXT NOT NULL
 );
 
--- Create an index on content and title for improved search performance
-CREATE INDEX IF NOT EXISTS idx_pages_content ON pages USING GIN (to_tsvector('english', content));
-CREATE INDEX IF NOT EXISTS idx_pages_title ON pages USING GIN (to_tsvector('english', title));
+-- Language-aware full-text search used by the postgres search backend
+CREATE OR REPLACE FUNCTION pages_search_config(lang TEXT) RETURNS regconfig
+LANGUAGE sql IMMUTABLE PARALLEL SAFE AS $$
+  SELECT CASE lang
+    WHEN 'da' THEN 'danish'::regconfig
+    WHEN 'en' THEN 'english'::regconfig
+    ELSE 'simple'::regconfig
+  END
+$$;
+
+CREATE OR REPLACE FUNCTION pages_search_vector(lang TEXT, title TEXT, content TEXT) RETURNS tsvector
+LANGUAGE sql IMMUTABLE PARALLEL SAFE AS $$
+  SELECT setweight(to_tsvector(pages_search_config(lang), coalesce(title, '')), 'A') ||
+         setweight(to_tsvector(pages_search_config(lang), coalesce(content, '')), 'B')
+$$;
+
+CREATE INDEX IF NOT EXISTS idx_pages_search ON pages USING GIN (pages_search_vector(language, title, content));
+
+-- Prefix index on lower-case titles for search suggestions
+CREATE INDEX IF NOT EXISTS idx_pages_title_lower ON pages (lower(title) text_pattern_ops);
+
+-- Change data capture: every change to pages is recorded in pages_outbox and
+-- announced on the pages_outbox channel for the search backend consumer
+CREATE TABLE IF NOT EXISTS pages_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    operation TEXT NOT NULL CHECK(operation IN ('upsert', 'delete')),
+    url TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE OR REPLACE FUNCTION pages_outbox_capture() RETURNS trigger
+LANGUAGE plpgsql AS $$
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    INSERT INTO pages_outbox (operation, url) VALUES ('delete', OLD.url);
+  ELSIF TG_OP = 'INSERT' THEN
+    INSERT INTO pages_outbox (operation, url) VALUES ('upsert', NEW.url);
+  ELSE
+    IF OLD IS NOT DISTINCT FROM NEW THEN
+      RETURN NULL;
+    END IF;
+    IF OLD.url IS DISTINCT FROM NEW.url THEN
+      INSERT INTO pages_outbox (operation, url) VALUES ('delete', OLD.url);
+    END IF;
+    INSERT INTO pages_outbox (operation, url) VALUES ('upsert', NEW.url);
+  END IF;
+  PERFORM pg_notify('pages_outbox', '');
+  RETURN NULL;
+END
+$$;
+
+DROP TRIGGER IF EXISTS pages_outbox_capture ON pages;
+CREATE TRIGGER pages_outbox_capture
+    AFTER INSERT OR UPDATE OR DELETE ON pages
+    FOR EACH ROW EXECUTE FUNCTION pages_outbox_capture();
+
+-- Dead-letter queue for pages that failed to index into Elasticsearch, retried
+-- with backoff until next_attempt_at
+CREATE TABLE IF NOT EXISTS index_failures (
+    url TEXT PRIMARY KEY,
+    error TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 1,
+    first_failed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_failed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    next_attempt_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_index_failures_next_attempt_at ON index_failures (next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS page_recrawls (
+    url TEXT PRIMARY KEY REFERENCES pages (url) ON DELETE CASCADE ON UPDATE CASCADE,
+    etag TEXT,
+    last_modified TEXT,
+    interval_seconds DOUBLE PRECISION NOT NULL,
+    last_crawled_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    next_crawl_at TIMESTAMP NOT NULL,
+    gone_count INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_page_recrawls_next_crawl_at ON page_recrawls (next_crawl_at);